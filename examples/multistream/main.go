@@ -78,11 +78,14 @@ func main() {
 			log.Printf("Update: connectionID=%s, clientID=%s, %d minutes connected", message.ConnectionID, message.ClientID, message.Minutes)
 		case "connection.destroyed":
 			log.Printf("Leave: connectionID=%s, clientID=%s", message.ConnectionID, message.ClientID)
-			if message.Role != "recvonly" {
-				err := viewer.RemoveTrack(message.ConnectionID)
-				if err != nil {
-					log.Println(err)
-				}
+		}
+	})
+
+	con.OnParticipantLeft(func(p sora.Participant) {
+		if p.Role != sora.RecvOnlyRole {
+			err := viewer.RemoveTrack(p.ConnectionID)
+			if err != nil {
+				log.Println(err)
 			}
 		}
 	})
@@ -1,6 +1,6 @@
 module github.com/hakobera/go-sora/examples/sdl2
 
-go 1.14
+go 1.15
 
 replace github.com/hakobera/go-sora v0.4.0 => ../../../go-sora
 
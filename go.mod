@@ -1,6 +1,6 @@
 module github.com/hakobera/go-sora
 
-go 1.14
+go 1.15
 
 require (
 	github.com/oklog/ulid/v2 v2.0.2
@@ -8,5 +8,9 @@ require (
 	github.com/pion/rtp v1.6.0
 	github.com/pion/sdp v1.3.0
 	github.com/pion/webrtc/v2 v2.2.24
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	golang.org/x/crypto v0.0.0-20200709230013-948cd5f35899
 	nhooyr.io/websocket v1.8.6
 )
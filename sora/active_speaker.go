@@ -0,0 +1,281 @@
+package sora
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	// silentAudioLevel は RFC 6464 の音声レベルの最小 (無音) です
+	silentAudioLevel = 127
+
+	defaultSpeakerSmoothing    = 0.3
+	defaultSpeakingAudioLevel  = 50
+	defaultSilenceAudioLevel   = 60
+	defaultSpeakerHoldTime     = 500 * time.Millisecond
+	defaultSpeakerSwitchMargin = 6
+	defaultSpeakerInterval     = 100 * time.Millisecond
+)
+
+// ActiveSpeakerOptions は受信した音声の音声レベル (RFC 6464 の ssrc-audio-level) から話者を検出する設定です。
+// 音声レベルは 0 が最大、127 が無音の -dBov です。音声をデコードしないので、音声レベルのヘッダー拡張をネゴシエーションしている必要があります。
+type ActiveSpeakerOptions struct {
+	// Smoothing は音声レベルを平滑化する指数移動平均の係数で、0 より大きく 1 以下です。大きいほど新しい値を重視します。0 の場合は 0.3
+	Smoothing float64
+
+	// SpeakingLevel は平滑化した音声レベルがこの値以下になったら話し始めたと判定します。0 の場合は 50
+	SpeakingLevel uint8
+
+	// SilenceLevel は平滑化した音声レベルがこの値以上の状態が HoldTime 続いたら話し終えたと判定します。
+	// SpeakingLevel より大きくして、話している途中の短い無音で切り替わらないようにします。0 の場合は 60
+	SilenceLevel uint8
+
+	// HoldTime は話し終えたと判定するまでの時間。0 の場合は 500ms
+	HoldTime time.Duration
+
+	// SwitchMargin はアクティブスピーカーが話している間に、別の話者に切り替えるのに必要な音声レベルの差 (dB)。0 の場合は 6
+	SwitchMargin uint8
+
+	// Interval は話者を判定する間隔。0 の場合は 100ms
+	Interval time.Duration
+}
+
+// speakerState は 1 人の話者の状態です。
+type speakerState struct {
+	level      float64
+	lastPacket time.Time
+	speaking   bool
+	// quietSince は SilenceLevel 以上になった時刻。話している間に SpeakingLevel 未満に戻ると初期化します
+	quietSince time.Time
+}
+
+// speakingChange は話しているかどうかが変わった話者です。
+type speakingChange struct {
+	connectionID string
+	speaking     bool
+}
+
+// speakerDetector は音声レベルを平滑化し、ヒステリシスをかけて話者を判定します。
+type speakerDetector struct {
+	opts ActiveSpeakerOptions
+
+	mu       sync.Mutex
+	speakers map[string]*speakerState
+	active   string
+}
+
+func newSpeakerDetector(opts ActiveSpeakerOptions) *speakerDetector {
+	if opts.Smoothing <= 0 || opts.Smoothing > 1 {
+		opts.Smoothing = defaultSpeakerSmoothing
+	}
+	if opts.SpeakingLevel == 0 {
+		opts.SpeakingLevel = defaultSpeakingAudioLevel
+	}
+	if opts.SilenceLevel == 0 {
+		opts.SilenceLevel = defaultSilenceAudioLevel
+	}
+	if opts.SilenceLevel < opts.SpeakingLevel {
+		opts.SilenceLevel = opts.SpeakingLevel
+	}
+	if opts.HoldTime <= 0 {
+		opts.HoldTime = defaultSpeakerHoldTime
+	}
+	if opts.SwitchMargin == 0 {
+		opts.SwitchMargin = defaultSpeakerSwitchMargin
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultSpeakerInterval
+	}
+	return &speakerDetector{
+		opts:     opts,
+		speakers: map[string]*speakerState{},
+	}
+}
+
+// observe は connectionID から受信した音声レベルを平滑化して記録します。
+func (d *speakerDetector) observe(connectionID string, level uint8, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, ok := d.speakers[connectionID]
+	if !ok {
+		s = &speakerState{level: silentAudioLevel}
+		d.speakers[connectionID] = s
+	}
+	s.level += d.opts.Smoothing * (float64(level) - s.level)
+	s.lastPacket = now
+}
+
+// evaluate は now の時点で話しているかどうかとアクティブスピーカーを判定し、変化を返します。
+func (d *speakerDetector) evaluate(now time.Time) ([]speakingChange, string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ids := make([]string, 0, len(d.speakers))
+	for id := range d.speakers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var changes []speakingChange
+	for _, id := range ids {
+		s := d.speakers[id]
+		// DTX などでパケットが届かない間は無音として扱う
+		if now.Sub(s.lastPacket) > d.opts.HoldTime {
+			s.level = silentAudioLevel
+			if s.speaking && s.quietSince.IsZero() {
+				s.quietSince = s.lastPacket
+			}
+		}
+
+		switch {
+		case !s.speaking && s.level <= float64(d.opts.SpeakingLevel):
+			s.speaking = true
+			s.quietSince = time.Time{}
+			changes = append(changes, speakingChange{connectionID: id, speaking: true})
+		case s.speaking && s.level >= float64(d.opts.SilenceLevel):
+			if s.quietSince.IsZero() {
+				s.quietSince = now
+			}
+			if now.Sub(s.quietSince) >= d.opts.HoldTime {
+				s.speaking = false
+				s.quietSince = time.Time{}
+				changes = append(changes, speakingChange{connectionID: id, speaking: false})
+			}
+		case s.speaking && s.level < float64(d.opts.SilenceLevel):
+			s.quietSince = time.Time{}
+		}
+	}
+
+	// 話している中で一番大きい話者を選ぶ。アクティブスピーカーが話している間は SwitchMargin 以上大きい場合だけ切り替える
+	candidate := ""
+	for _, id := range ids {
+		s := d.speakers[id]
+		if s.speaking && (candidate == "" || s.level < d.speakers[candidate].level) {
+			candidate = id
+		}
+	}
+	if candidate == "" || candidate == d.active {
+		return changes, d.active, false
+	}
+	if current, ok := d.speakers[d.active]; ok && current.speaking && current.level-d.speakers[candidate].level < float64(d.opts.SwitchMargin) {
+		return changes, d.active, false
+	}
+	d.active = candidate
+	return changes, d.active, true
+}
+
+// remove は退出した connectionID の状態を削除します。話していた場合と、アクティブスピーカーだった場合はそれぞれ true を返します。
+func (d *speakerDetector) remove(connectionID string) (bool, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, ok := d.speakers[connectionID]
+	if !ok {
+		return false, false
+	}
+	delete(d.speakers, connectionID)
+	wasActive := d.active == connectionID
+	if wasActive {
+		d.active = ""
+	}
+	return s.speaking, wasActive
+}
+
+func (d *speakerDetector) activeSpeaker() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.active
+}
+
+// startActiveSpeaker は ActiveSpeakerOptions が設定されている場合に、done が閉じられるまで話者を判定します。
+func (c *Connection) startActiveSpeaker(done chan struct{}) {
+	if c.Options.ActiveSpeaker == nil {
+		return
+	}
+	d := newSpeakerDetector(*c.Options.ActiveSpeaker)
+	c.mu.Lock()
+	c.speakers = d
+	c.mu.Unlock()
+
+	c.goroutine(func() {
+		ticker := time.NewTicker(d.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				changes, active, changed := d.evaluate(now)
+				for _, change := range changes {
+					c.speakingStateChanged(change.connectionID, change.speaking)
+				}
+				if changed {
+					c.activeSpeakerChanged(active)
+				}
+			}
+		}
+	})
+}
+
+func (c *Connection) speakerDetector() *speakerDetector {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.speakers
+}
+
+// observeAudioLevel は受信した音声の packet の音声レベルを話者の判定に使います。
+func (c *Connection) observeAudioLevel(d *speakerDetector, t *Track, packet *rtp.Packet) {
+	if d == nil || t.Kind() != webrtc.RTPCodecTypeAudio {
+		return
+	}
+	if e := t.HeaderExtensions(packet); e.AudioLevel != nil {
+		d.observe(t.Label(), e.AudioLevel.Level, time.Now())
+	}
+}
+
+// removeSpeaker は退出した参加者を話者の判定から取り除きます。
+func (c *Connection) removeSpeaker(connectionID string) {
+	d := c.speakerDetector()
+	if d == nil {
+		return
+	}
+	speaking, active := d.remove(connectionID)
+	if speaking {
+		c.speakingStateChanged(connectionID, false)
+	}
+	if active {
+		c.activeSpeakerChanged("")
+	}
+}
+
+func (c *Connection) speakingStateChanged(connectionID string, speaking bool) {
+	c.handlers().onSpeakingStateChangedHandler(connectionID, speaking)
+	c.emit(&SpeakingStateChangedEvent{ConnectionID: connectionID, Speaking: speaking})
+}
+
+func (c *Connection) activeSpeakerChanged(connectionID string) {
+	c.handlers().onActiveSpeakerChangedHandler(connectionID)
+	c.emit(&ActiveSpeakerChangedEvent{ConnectionID: connectionID})
+}
+
+// ActiveSpeaker は現在のアクティブスピーカーを返します。Roster にいない場合は ConnectionID だけを設定して返します。
+// ActiveSpeakerOptions を設定していない場合や、まだ誰も話していない場合は false を返します。
+func (c *Connection) ActiveSpeaker() (Participant, bool) {
+	d := c.speakerDetector()
+	if d == nil {
+		return Participant{}, false
+	}
+	id := d.activeSpeaker()
+	if id == "" {
+		return Participant{}, false
+	}
+	if p, ok := c.roster.Participant(id); ok {
+		return p, true
+	}
+	return Participant{ConnectionID: id}, true
+}
@@ -0,0 +1,145 @@
+package sora
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSpeakerDetector(t *testing.T) {
+	d := newSpeakerDetector(ActiveSpeakerOptions{Smoothing: 0.5, HoldTime: 300 * time.Millisecond})
+	now := time.Unix(0, 0)
+
+	// 20ms ごとに音声レベルを受信し、100ms ごとに判定する
+	step := func(levels map[string]uint8) ([]speakingChange, string, bool) {
+		for i := 0; i < 5; i++ {
+			now = now.Add(20 * time.Millisecond)
+			for id, level := range levels {
+				d.observe(id, level, now)
+			}
+		}
+		return d.evaluate(now)
+	}
+
+	// 平滑化するので、1 回の大きな音では話し始めない
+	d.observe("A", 0, now)
+	if changes, _, _ := d.evaluate(now); len(changes) != 0 {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+
+	changes, active, changed := step(map[string]uint8{"A": 20})
+	if !reflect.DeepEqual(changes, []speakingChange{{"A", true}}) || active != "A" || !changed {
+		t.Fatalf("unexpected result: %v %s %v", changes, active, changed)
+	}
+
+	// B も話し始めるが、A との差が SwitchMargin 未満なのでアクティブスピーカーは A のまま
+	changes, active, changed = step(map[string]uint8{"A": 20, "B": 16})
+	if !reflect.DeepEqual(changes, []speakingChange{{"B", true}}) || active != "A" || changed {
+		t.Fatalf("unexpected result: %v %s %v", changes, active, changed)
+	}
+
+	// B が十分大きくなると切り替わる
+	changes, active, changed = step(map[string]uint8{"A": 20, "B": 5})
+	if len(changes) != 0 || active != "B" || !changed {
+		t.Fatalf("unexpected result: %v %s %v", changes, active, changed)
+	}
+
+	// HoldTime より短い無音では話し終えない
+	step(map[string]uint8{"A": 100, "B": 5})
+	changes, _, _ = step(map[string]uint8{"A": 20, "B": 5})
+	if len(changes) != 0 {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+
+	// HoldTime 以上 SilenceLevel 以上が続くと話し終える
+	var got []speakingChange
+	for i := 0; i < 5; i++ {
+		changes, _, _ = step(map[string]uint8{"A": 100, "B": 5})
+		got = append(got, changes...)
+	}
+	if !reflect.DeepEqual(got, []speakingChange{{"A", false}}) {
+		t.Fatalf("unexpected changes: %v", got)
+	}
+
+	// パケットが届かなくなった (DTX) 場合も話し終える
+	now = now.Add(time.Second)
+	changes, active, changed = d.evaluate(now)
+	if !reflect.DeepEqual(changes, []speakingChange{{"B", false}}) || active != "B" || changed {
+		t.Fatalf("unexpected result: %v %s %v", changes, active, changed)
+	}
+
+	// 退出したアクティブスピーカーは取り除かれる
+	if speaking, wasActive := d.remove("B"); speaking || !wasActive {
+		t.Errorf("unexpected remove result: %v %v", speaking, wasActive)
+	}
+	if d.activeSpeaker() != "" {
+		t.Errorf("unexpected active speaker: %s", d.activeSpeaker())
+	}
+	if speaking, wasActive := d.remove("unknown"); speaking || wasActive {
+		t.Errorf("unexpected remove result: %v %v", speaking, wasActive)
+	}
+}
+
+func TestActiveSpeaker(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+	s.headerExtensions = map[string]uint8{HeaderExtensionAudioLevel: 1}
+
+	opts := DefaultOptions()
+	opts.Multistream = true
+	opts.ActiveSpeaker = &ActiveSpeakerOptions{Interval: 20 * time.Millisecond}
+	c := NewConnection(s.URL(), "sora", opts)
+	defer c.Disconnect()
+
+	speaking := make(chan speakingChange, 10)
+	active := make(chan string, 10)
+	c.OnSpeakingStateChanged(func(connectionID string, s bool) {
+		speaking <- speakingChange{connectionID, s}
+	})
+	c.OnActiveSpeakerChanged(func(connectionID string) {
+		active <- connectionID
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	ss := s.session(0)
+	if err := ss.send(map[string]interface{}{
+		"type":          "notify",
+		"event_type":    "connection.created",
+		"connection_id": "publisher-1",
+		"client_id":     "alice",
+		"role":          "sendonly",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case change := <-speaking:
+		if change != (speakingChange{"publisher-1", true}) {
+			t.Errorf("unexpected speaking change: %+v", change)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for speaking state")
+	}
+	select {
+	case id := <-active:
+		if id != "publisher-1" {
+			t.Errorf("unexpected active speaker: %s", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for active speaker")
+	}
+
+	// Roster の参加者として返す
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p, ok := c.ActiveSpeaker()
+		if ok && p.ClientID == "alice" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected active speaker: %+v %v", p, ok)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,250 @@
+package sora
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+	"nhooyr.io/websocket"
+)
+
+// goroutineGroup は Connection が起動した goroutine を、goroutine の ID ごとに数えます。
+// コールバック関数の中から Close が呼ばれた場合に、呼び出し元の goroutine の終了を待って止まらないようにするためです。
+type goroutineGroup struct {
+	mu sync.Mutex
+	// running は実行中の goroutine、waiting は wait で待っている goroutine の ID ごとの数です
+	running map[uint64]int
+	waiting map[uint64]int
+	changed chan struct{}
+}
+
+func (g *goroutineGroup) update(f func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.running == nil {
+		g.running = map[uint64]int{}
+		g.waiting = map[uint64]int{}
+	}
+	f()
+	if g.changed != nil {
+		close(g.changed)
+		g.changed = nil
+	}
+}
+
+func (g *goroutineGroup) add(id uint64) {
+	g.update(func() { g.running[id]++ })
+}
+
+func (g *goroutineGroup) done(id uint64) {
+	g.update(func() {
+		if g.running[id]--; g.running[id] <= 0 {
+			delete(g.running, id)
+		}
+	})
+}
+
+// wait は goroutine がすべて終了するのを待ちます。
+// 呼び出した goroutine 自身と、別のコールバック関数の中から同時に wait している goroutine は待ちません。
+func (g *goroutineGroup) wait(ctx context.Context) error {
+	self := goroutineID()
+	g.update(func() { g.waiting[self]++ })
+	defer g.update(func() {
+		if g.waiting[self]--; g.waiting[self] <= 0 {
+			delete(g.waiting, self)
+		}
+	})
+
+	for {
+		g.mu.Lock()
+		finished := true
+		for id := range g.running {
+			if id != self && g.waiting[id] == 0 {
+				finished = false
+				break
+			}
+		}
+		if finished {
+			g.mu.Unlock()
+			return nil
+		}
+		if g.changed == nil {
+			g.changed = make(chan struct{})
+		}
+		changed := g.changed
+		g.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// goroutineID は呼び出した goroutine の ID を返します。
+// Go は goroutine の ID を取得する API を提供していないので、runtime.Stack の 1 行目 "goroutine 1 [running]:" から取り出します。
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
+
+// goroutine は f を Close で終了を待つ goroutine として実行します。
+func (c *Connection) goroutine(f func()) {
+	// 数え終わるまで待たないと、起動した直後の wait が待たずに戻ることがあります
+	ready := make(chan struct{})
+	go func() {
+		id := goroutineID()
+		c.goroutines.add(id)
+		close(ready)
+		defer c.goroutines.done(id)
+		f()
+	}()
+	<-ready
+}
+
+// track は pion が起動した goroutine を、Close で終了を待つ goroutine として数えます。戻り値の関数を終了時に呼び出してください。
+func (c *Connection) track() func() {
+	id := goroutineID()
+	c.goroutines.add(id)
+	return func() {
+		c.goroutines.done(id)
+	}
+}
+
+// wait は Connection が起動した goroutine がすべて終了するのを待ちます。
+// コールバック関数の中から呼び出した場合、その goroutine は wait から戻った後に終了するので待ちません。
+func (c *Connection) wait(ctx context.Context) error {
+	return c.goroutines.wait(ctx)
+}
+
+// Close は reason を理由として disconnect メッセージを送信し、PeerConnection と WebSocket を閉じて、
+// Connection が起動した goroutine がすべて終了するのを待ちます。reason が空の場合は NO-ERROR を送信します。
+// ctx が終了した場合は待つのをやめて ctx.Err() を返します。
+// 何度呼び出しても問題なく、コールバック関数の中からも呼び出せます。その場合、呼び出したコールバック関数の終了は待ちませんが、
+// 別の goroutine で実行中のコールバック関数は戻るまで待ちます。
+// Disconnect と異なり、設定されたコールバック関数は初期化しないので、Close の後にもう一度 Connect できます。
+func (c *Connection) Close(ctx context.Context, reason string) error {
+	if reason == "" {
+		reason = "NO-ERROR"
+	}
+	opened, err := c.close(reason)
+	c.endClosed(reason, opened)
+	if waitErr := c.wait(ctx); waitErr != nil {
+		return waitErr
+	}
+	return err
+}
+
+// close は disconnect メッセージを送信して PeerConnection と WebSocket を閉じ、接続の状態を初期化します。
+// goroutine の終了は待ちません。すでに切断されていた場合は false を返します。最初に発生したエラーを返します。
+func (c *Connection) close(reason string) (bool, error) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	c.mu.Lock()
+	opened := c.pc != nil || c.ws != nil || c.done != nil
+	// signaling で WebSocket を設定する前に数えておき、接続中の WebSocket を捨てさせます
+	c.closes++
+	if c.cancelDial != nil {
+		c.cancelDial()
+	}
+	c.mu.Unlock()
+
+	c.endConnectSpan(errorDisconnectedBeforeConnect)
+	err := c.closeTransport(reason)
+
+	c.mu.Lock()
+	c.connectionID = ""
+	c.clientID = ""
+	c.soraVersion = ""
+	c.sessionInfo = nil
+	c.connectionState = webrtc.ICEConnectionStateNew
+	c.reconnects = 0
+	c.lastReconnect = time.Time{}
+	c.extensions = nil
+	c.speakers = nil
+	c.e2ee = nil
+	c.e2eePending = nil
+	c.mu.Unlock()
+	c.roster.reset()
+	c.streamsMu.Lock()
+	c.streams = map[string]*RemoteStream{}
+	c.streamsMu.Unlock()
+	return opened, err
+}
+
+// closeTransport は disconnect メッセージを送信して PeerConnection と WebSocket を閉じ、シグナリングの goroutine に終了を通知します。
+func (c *Connection) closeTransport(reason string) error {
+	err := c.sendDisconnectMessage(reason)
+	if pcErr := c.closePeerConnection(); err == nil {
+		err = pcErr
+	}
+	if wsErr := c.closeWebSocketConnection(); err == nil {
+		err = wsErr
+	}
+
+	c.mu.Lock()
+	done := c.done
+	c.done = nil
+	c.mu.Unlock()
+	if done != nil {
+		close(done)
+	}
+	return err
+}
+
+// isClosed は done が閉じられているかどうかを返します。
+func isClosed(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Connection) closePeerConnection() error {
+	c.mu.Lock()
+	pc := c.pc
+	c.pc = nil
+	c.mu.Unlock()
+	if pc == nil {
+		return nil
+	}
+
+	pc.OnICEConnectionStateChange(func(_ webrtc.ICEConnectionState) {})
+	return pc.Close()
+}
+
+func (c *Connection) closeWebSocketConnection() error {
+	c.mu.Lock()
+	ws := c.ws
+	c.ws = nil
+	c.mu.Unlock()
+	if ws == nil {
+		return nil
+	}
+
+	if err := ws.Close(websocket.StatusNormalClosure, ""); err != nil {
+		c.trace("FAILED-SEND-CLOSE-MESSAGE: %v", err)
+		// Sora が先に閉じた場合はエラーにしない
+		if websocket.CloseStatus(err) == -1 {
+			return nil
+		}
+		return err
+	}
+	c.trace("SENT-CLOSE-MESSAGE")
+	return nil
+}
@@ -0,0 +1,199 @@
+package sora
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+// connectionGoroutines は Connection のメソッドを実行中の goroutine のスタックを返します。
+func connectionGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+
+	var stacks []string
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(stack, "go-sora/sora.(*Connection)") {
+			stacks = append(stacks, stack)
+		}
+	}
+	return stacks
+}
+
+// expectNoConnectionGoroutines は Connection の goroutine がすべて終了していることを確認します。
+// goroutine は Close が戻った直後に defer を実行しているだけの場合があるので、少しだけ待ちます。
+func expectNoConnectionGoroutines(t *testing.T) {
+	t.Helper()
+
+	var stacks []string
+	for i := 0; i < 50; i++ {
+		if stacks = connectionGoroutines(); len(stacks) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("%d goroutines leaked:\n%s", len(stacks), strings.Join(stacks, "\n\n"))
+}
+
+func connectAndReceive(t *testing.T, s *fakeSora, setup func(c *Connection)) *Connection {
+	t.Helper()
+
+	opts := DefaultOptions()
+	opts.Multistream = true
+	c := NewConnection(s.URL(), "sora", opts)
+
+	packets := make(chan struct{}, 1)
+	c.OnTrackPacket(func(track *webrtc.Track, packet *rtp.Packet) {
+		select {
+		case packets <- struct{}{}:
+		default:
+		}
+	})
+	if setup != nil {
+		setup(c)
+	}
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-packets:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for RTP packets")
+	}
+	return c
+}
+
+func TestCloseReason(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+	c := connectAndReceive(t, s, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Close(ctx, "SHUTDOWN"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg := s.session(0).expect("disconnect"); msg["reason"] != "SHUTDOWN" {
+		t.Errorf("unexpected reason: %v", msg["reason"])
+	}
+}
+
+func TestClose(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+	disconnected := make(chan string, 1)
+	c := connectAndReceive(t, s, func(c *Connection) {
+		c.OnDisconnect(func(reason string, err error) { disconnected <- reason })
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Close(ctx, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	msg := s.session(0).expect("disconnect")
+	if msg["reason"] != "NO-ERROR" {
+		t.Errorf("unexpected reason: %v", msg["reason"])
+	}
+	expectNoConnectionGoroutines(t)
+
+	// 2 回目以降は何もしない
+	if err := c.Close(ctx, ""); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if c.PeerConnection() != nil {
+		t.Error("PeerConnection should be nil")
+	}
+
+	// 自分から切断した場合は OnDisconnect は呼ばれない
+	select {
+	case reason := <-disconnected:
+		t.Errorf("unexpected disconnect: %s", reason)
+	default:
+	}
+}
+
+func TestCloseInCallback(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+	closed := make(chan error, 1)
+	c := connectAndReceive(t, s, nil)
+	c.OnTrackPacket(func(track *webrtc.Track, packet *rtp.Packet) {
+		select {
+		case closed <- c.Close(context.Background(), ""):
+		default:
+		}
+	})
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close in callback did not return")
+	}
+
+	s.session(0).expect("disconnect")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Close(ctx, ""); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expectNoConnectionGoroutines(t)
+}
+
+func TestCloseWaitsForCallback(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	c := connectAndReceive(t, s, nil)
+	c.OnTrackPacket(func(track *webrtc.Track, packet *rtp.Packet) {
+		select {
+		case entered <- struct{}{}:
+			<-release
+		default:
+		}
+	})
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for OnTrackPacket")
+	}
+
+	// 別の goroutine で実行中のコールバック関数が戻るまで Close は戻らない
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	closed := make(chan error, 1)
+	go func() { closed <- c.Close(ctx, "") }()
+	select {
+	case err := <-closed:
+		close(release)
+		t.Fatalf("Close returned while OnTrackPacket was running: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-closed; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expectNoConnectionGoroutines(t)
+}
+
+func TestGoroutineID(t *testing.T) {
+	id := goroutineID()
+	if id == 0 {
+		t.Fatal("expected a goroutine ID")
+	}
+	other := make(chan uint64)
+	go func() { other <- goroutineID() }()
+	if o := <-other; o == 0 || o == id {
+		t.Errorf("expected a different goroutine ID, but got %d and %d", id, o)
+	}
+}
@@ -2,21 +2,27 @@ package sora
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/url"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+	"go.opentelemetry.io/otel/trace"
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/wsjson"
 )
 
 const (
+	dialTimeout  = 10 * time.Second
 	readTimeout  = 90 * time.Second
 	readLimit    = 1048576
 	writeTimeout = 10 * time.Second
@@ -26,69 +32,282 @@ const (
 type Connection struct {
 	Options *ConnectionOptions
 
+	// mu は複数の goroutine から読み書きする接続の状態を保護します
+	mu sync.Mutex
+
 	connectionID string
 	clientID     string
 	soraVersion  string
+	sessionInfo  *SessionInfo
 
 	ws              *websocket.Conn
 	pc              *webrtc.PeerConnection
-	pcConfig        webrtc.Configuration
 	connectionState webrtc.ICEConnectionState
-	answerSent      bool
+	// reconnects は network.status で接続し直した回数で、lastReconnect は最後に接続し直した時刻
+	reconnects    int
+	lastReconnect time.Time
+	// closes は close を呼び出した回数で、接続し直している間に切断されたことを検出するために使います
+	closes int
+	// cancelDial は WebSocket の接続中に close から中断するための関数です
+	cancelDial context.CancelFunc
+	e2ee       *e2eeSession
+	// e2eePending は鍵交換を始める前に受け取った e2ee メッセージ
+	e2eePending []*e2eeData
+	extensions  map[webrtc.RTPCodecType]headerExtensionIDs
+	speakers    *speakerDetector
+	// done はシグナリングごとに作成し、切断時に閉じて goroutine を終了させます
+	done chan struct{}
+
+	// pcConfig は main goroutine だけが使います
+	pcConfig webrtc.Configuration
+	roster   *Roster
+
+	streams   map[string]*RemoteStream
+	streamsMu sync.Mutex
+
+	// callbacks は設定されたコールバック関数、hooks はパッケージの内部で登録した関数です。callbackMu で保護します
+	callbacks  connectionHandlers
+	hooks      connectionHooks
+	callbackMu sync.Mutex
 
+	// closeMu は切断処理が同時に実行されないようにするために使います
+	closeMu sync.Mutex
+	// goroutines は Close で終了を待つ goroutine を数えます
+	goroutines goroutineGroup
+
+	// queues は DispatchOptions を設定した場合の、コールバック関数ごとのキューです
+	queues     map[string]*callbackQueue
+	dispatchMu sync.Mutex
+
+	// events は Events() で返したチャネル、tracks は受信中のトラックです
+	events        chan Event
+	droppedEvents uint64
+	tracks        map[*webrtc.Track]*Track
+	eventsMu      sync.Mutex
+
+	spanMu      sync.Mutex
+	connectCtx  context.Context
+	connectSpan trace.Span
+	waitSpans   map[string]trace.Span
+}
+
+// connectionHandlers は Connection に設定されたコールバック関数の一覧です。
+type connectionHandlers struct {
+	onOfferHandler           func(info SessionInfo)
 	onOpenHandler            func(pc *webrtc.PeerConnection, m webrtc.MediaEngine)
 	onConnectHandler         func()
 	onDisconnectHandler      func(reason string, err error)
 	onTrackHandler           func(track *webrtc.Track)
 	onTrackPacketHandler     func(track *webrtc.Track, packet *rtp.Packet)
+	onTrackSampleHandler     func(track *webrtc.Track, sample media.Sample)
 	onSignalingNotifyHandler func(eventType string, message *SignalingNotifyMessage)
 	onSpotlightNotifyHandler func(eventType string, message *SpotlightNotifyMessage)
 	onNetworkNotifyHandler   func(eventType string, message *NetworkNotifyMessage)
+	onNotifyHandler          func(event NotifyEvent)
 	onPushHandler            func(message []byte)
+	onPushMessageHandler     func(message *PushMessage)
+	onPushErrorHandler       func(message *PushMessage, err error)
+	pushDataHandler          *pushDataHandler
 
-	callbackMu sync.Mutex
+	onParticipantJoinedHandler  func(p Participant)
+	onParticipantLeftHandler    func(p Participant)
+	onParticipantUpdatedHandler func(p Participant)
+
+	onStreamAddedHandler   func(stream *RemoteStream)
+	onStreamRemovedHandler func(stream *RemoteStream)
+	onTrackRemovedHandler  func(track *webrtc.Track)
+
+	onRemoteSDPHandler SDPTransform
+	onLocalSDPHandler  SDPTransform
+
+	onActiveSpeakerChangedHandler func(connectionID string)
+	onSpeakingStateChangedHandler func(connectionID string, speaking bool)
+
+	onTrackStalledHandler func(track *webrtc.Track, reason StallReason)
+	onTrackResumedHandler func(track *webrtc.Track, reason StallReason, stalled time.Duration)
+}
+
+// connectionHooks は Manager などがコールバック関数とは別に登録する関数の一覧です。
+// コールバック関数と異なり、resetHandlers で初期化されず、dispatch も経由せずに呼び出されます。
+type connectionHooks struct {
+	onConnect    []func()
+	onDisconnect []func(reason string, err error)
+}
+
+// addConnectHook は接続した時に OnConnect のコールバック関数より先に呼び出す関数を追加します。
+func (c *Connection) addConnectHook(f func()) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.hooks.onConnect = append(c.hooks.onConnect, f)
+}
+
+// addDisconnectHook は切断された時に OnDisconnect のコールバック関数の後に呼び出す関数を追加します。
+func (c *Connection) addDisconnectHook(f func(reason string, err error)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.hooks.onDisconnect = append(c.hooks.onDisconnect, f)
+}
+
+// onConnect は登録された関数と OnConnect のコールバック関数を呼び出します。
+func (c *Connection) onConnect() {
+	c.callbackMu.Lock()
+	hooks := c.hooks.onConnect
+	handler := c.callbacks.onConnectHandler
+	c.callbackMu.Unlock()
+
+	for _, f := range hooks {
+		f()
+	}
+	handler()
+}
+
+// onDisconnect は handler に渡された OnDisconnect のコールバック関数と、登録された関数を呼び出します。
+// コールバック関数は切断の前に取り出しておく必要があるので、引数で受け取ります。
+func (c *Connection) onDisconnect(handler func(reason string, err error), reason string, err error) {
+	c.callbackMu.Lock()
+	hooks := c.hooks.onDisconnect
+	c.callbackMu.Unlock()
+
+	handler(reason, err)
+	for _, f := range hooks {
+		f(reason, err)
+	}
+}
+
+// handlers は設定されたコールバック関数のコピーを返します。
+// 別の goroutine から設定し直されることがあるので、コールバック関数はこのコピーから呼び出します。
+func (c *Connection) handlers() connectionHandlers {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	return c.callbacks
 }
 
 // Connect は sora に接続します
 func (c *Connection) Connect() error {
-	if c.ws != nil || c.pc != nil {
+	c.mu.Lock()
+	exists := c.ws != nil || c.pc != nil
+	closes := c.closes
+	c.mu.Unlock()
+	if exists {
 		c.trace("connection already exists")
 		return fmt.Errorf("connection alreay exists")
 	}
-	c.signaling()
-	return nil
+	if f := c.Options.ForwardingFilter; f != nil {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Options.E2EE && len(c.Options.E2EESecret) < e2eeMinSecretLength {
+		return errorE2EESecretRequired
+	}
+	return c.signaling(closes)
 }
 
-// Disconnect は sora から切断します
+// Disconnect は sora から切断し、設定されたコールバック関数を初期化します。
+// goroutine の終了は待たず、エラーも返しません。終了を待つ場合は Close を使ってください。
 func (c *Connection) Disconnect() {
+	opened, _ := c.close("NO-ERROR")
+	c.endClosed("NO-ERROR", opened)
+	c.resetHandlers()
+}
+
+// resetHandlers は設定されたコールバック関数を初期化します。
+func (c *Connection) resetHandlers() {
 	c.callbackMu.Lock()
 	defer c.callbackMu.Unlock()
 
-	c.sendDisconnectMessage()
-	c.closePeerConnection()
-	c.closeWebSocketConnection()
-	c.connectionID = ""
-	c.clientID = ""
-	c.connectionState = webrtc.ICEConnectionStateNew
-	c.answerSent = false
+	c.callbacks.onOfferHandler = func(info SessionInfo) {}
+	c.callbacks.onOpenHandler = func(pc *webrtc.PeerConnection, m webrtc.MediaEngine) {}
+	c.callbacks.onConnectHandler = func() {}
+	c.callbacks.onDisconnectHandler = func(reason string, err error) {}
+	c.callbacks.onSignalingNotifyHandler = func(eventType string, message *SignalingNotifyMessage) {}
+	c.callbacks.onSpotlightNotifyHandler = func(eventType string, message *SpotlightNotifyMessage) {}
+	c.callbacks.onNetworkNotifyHandler = func(eventType string, message *NetworkNotifyMessage) {}
+	c.callbacks.onNotifyHandler = func(event NotifyEvent) {}
+	c.callbacks.onPushMessageHandler = func(message *PushMessage) {}
+	c.callbacks.onPushErrorHandler = func(message *PushMessage, err error) {}
+	c.callbacks.pushDataHandler = nil
+	c.callbacks.onParticipantJoinedHandler = func(p Participant) {}
+	c.callbacks.onParticipantLeftHandler = func(p Participant) {}
+	c.callbacks.onParticipantUpdatedHandler = func(p Participant) {}
+	c.callbacks.onStreamAddedHandler = func(stream *RemoteStream) {}
+	c.callbacks.onStreamRemovedHandler = func(stream *RemoteStream) {}
+	c.callbacks.onTrackRemovedHandler = func(track *webrtc.Track) {}
+	c.callbacks.onTrackHandler = func(track *webrtc.Track) {}
+	c.callbacks.onTrackPacketHandler = func(track *webrtc.Track, packet *rtp.Packet) {}
+	c.callbacks.onTrackSampleHandler = func(track *webrtc.Track, sample media.Sample) {}
+	c.callbacks.onRemoteSDPHandler = nil
+	c.callbacks.onLocalSDPHandler = nil
+	c.callbacks.onActiveSpeakerChangedHandler = func(connectionID string) {}
+	c.callbacks.onSpeakingStateChangedHandler = func(connectionID string, speaking bool) {}
+	c.callbacks.onTrackStalledHandler = func(track *webrtc.Track, reason StallReason) {}
+	c.callbacks.onTrackResumedHandler = func(track *webrtc.Track, reason StallReason, stalled time.Duration) {}
+}
+
+// disconnect は切断して、OnDisconnect で設定されたコールバック関数を呼び出します。
+// コールバック関数は初期化するので、その前に取り出しておきます。
+// Close などですでに切断されていた場合は何もしません。
+func (c *Connection) disconnect(reason string, err error) {
+	onDisconnect := c.handlers().onDisconnectHandler
 
-	c.onOpenHandler = func(pc *webrtc.PeerConnection, m webrtc.MediaEngine) {}
-	c.onConnectHandler = func() {}
-	c.onDisconnectHandler = func(reason string, err error) {}
-	c.onSignalingNotifyHandler = func(eventType string, message *SignalingNotifyMessage) {}
-	c.onSpotlightNotifyHandler = func(eventType string, message *SpotlightNotifyMessage) {}
-	c.onNetworkNotifyHandler = func(eventType string, message *NetworkNotifyMessage) {}
-	c.onTrackHandler = func(track *webrtc.Track) {}
-	c.onTrackPacketHandler = func(track *webrtc.Track, packet *rtp.Packet) {}
+	if opened, _ := c.close(reason); !opened {
+		return
+	}
+	c.endEvents(&DisconnectedEvent{Reason: reason, Err: err})
+	c.resetHandlers()
+	c.onDisconnect(onDisconnect, reason, err)
 }
 
 // ConnectionID はコネクションIDを返します。
 func (c *Connection) ConnectionID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.connectionID
 }
 
+// SoraVersion は offer メッセージで通知された Sora のバージョンを返します。
+func (c *Connection) SoraVersion() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.soraVersion
+}
+
+// SessionInfo は offer メッセージで通知された接続の情報を返します。offer を受け取る前は false を返します。
+func (c *Connection) SessionInfo() (SessionInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessionInfo == nil {
+		return SessionInfo{}, false
+	}
+	return c.sessionInfo.clone(), true
+}
+
+// OfferMetadata は offer メッセージで受け取った metadata を返します。
+// 認証 Webhook が metadata を返さなかった場合は nil を返します。
+func (c *Connection) OfferMetadata() json.RawMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessionInfo == nil {
+		return nil
+	}
+	return cloneRawMessage(c.sessionInfo.Metadata)
+}
+
+// AuthzMetadata は offer メッセージで受け取った authz_metadata を返します。
+// 認証 Webhook が authz_metadata を返さなかった場合は nil を返します。
+func (c *Connection) AuthzMetadata() json.RawMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessionInfo == nil {
+		return nil
+	}
+	return cloneRawMessage(c.sessionInfo.AuthzMetadata)
+}
+
 // ClientID はクライアントIDを返します。
 func (c *Connection) ClientID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.clientID
 }
 
@@ -99,70 +318,294 @@ func (c *Connection) ChannelID() string {
 
 // PeerConnection は webrtc.PeerConnection オブジェクトを返します。
 func (c *Connection) PeerConnection() *webrtc.PeerConnection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.pc
 }
 
+// websocket は Sora との WebSocket 接続を返します。
+func (c *Connection) websocket() *websocket.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ws
+}
+
+// e2eeSession は E2EE の鍵交換の状態を返します。E2EE が無効な場合は nil を返します。
+func (c *Connection) e2eeSession() *e2eeSession {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.e2ee
+}
+
+// Roster はチャネルの参加者一覧を返します。
+func (c *Connection) Roster() *Roster {
+	return c.roster
+}
+
+// OnOffer は Sora から offer メッセージを受け取った時に発生するコールバック関数を設定します。
+// PeerConnection を作成する前に呼ばれるので、Sora が通知した設定に合わせて準備できます。
+func (c *Connection) OnOffer(f func(info SessionInfo)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.onOfferHandler = f
+}
+
 // OnOpen は open イベント発生時のコールバック関数を設定します。
 func (c *Connection) OnOpen(f func(pc *webrtc.PeerConnection, m webrtc.MediaEngine)) {
 	c.callbackMu.Lock()
 	defer c.callbackMu.Unlock()
-	c.onOpenHandler = f
+	c.callbacks.onOpenHandler = f
+}
+
+// OnActiveSpeakerChanged はアクティブスピーカーが変わった時に発生するコールバック関数を設定します。
+// connectionID はアクティブスピーカーのコネクション ID で、アクティブスピーカーが退出した場合は空文字列です。
+// ConnectionOptions.ActiveSpeaker を設定している場合だけ発生します。
+func (c *Connection) OnActiveSpeakerChanged(f func(connectionID string)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.onActiveSpeakerChangedHandler = func(connectionID string) {
+		c.dispatch("OnActiveSpeakerChanged", func() { f(connectionID) })
+	}
+}
+
+// OnSpeakingStateChanged は参加者が話し始めた時と話し終えた時に発生するコールバック関数を設定します。
+// ConnectionOptions.ActiveSpeaker を設定している場合だけ発生します。
+func (c *Connection) OnSpeakingStateChanged(f func(connectionID string, speaking bool)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.onSpeakingStateChangedHandler = func(connectionID string, speaking bool) {
+		c.dispatch("OnSpeakingStateChanged", func() { f(connectionID, speaking) })
+	}
+}
+
+// OnTrackStalled は受信しているトラックが止まったと判定した時に発生するコールバック関数を設定します。
+// 止まっている間に reason が変わった場合は、新しい reason で再度発生します。
+// ConnectionOptions.Liveness を設定している場合だけ発生します。
+func (c *Connection) OnTrackStalled(f func(track *webrtc.Track, reason StallReason)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.onTrackStalledHandler = func(track *webrtc.Track, reason StallReason) {
+		c.dispatch("OnTrackStalled", func() { f(track, reason) })
+	}
+}
+
+// OnTrackResumed は止まっていたトラックが再開した時に発生するコールバック関数を設定します。
+// reason は最後に判定した止まっていた理由で、stalled は止まっていた時間です。
+// ConnectionOptions.Liveness を設定している場合だけ発生します。
+func (c *Connection) OnTrackResumed(f func(track *webrtc.Track, reason StallReason, stalled time.Duration)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.onTrackResumedHandler = func(track *webrtc.Track, reason StallReason, stalled time.Duration) {
+		c.dispatch("OnTrackResumed", func() { f(track, reason, stalled) })
+	}
+}
+
+// OnRemoteSDP は Sora から受け取った offer を適用する前に書き換える関数を設定します。
+// PreferCodecs や RemoveCodecs などを SDPTransforms でまとめて設定できます。
+// 書き換えた offer は受信するコーデックの選択にも使われます。
+func (c *Connection) OnRemoteSDP(f SDPTransform) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.onRemoteSDPHandler = f
+}
+
+// OnLocalSDP は Sora に送信する answer を書き換える関数を設定します。
+// pion/webrtc v2 は書き換えた answer を SetLocalDescription できないため、PeerConnection には書き換える前の answer を設定します。
+// そのため、書き換えられるのは Sora が送信する内容にだけ影響する b= (LimitBandwidth), a=fmtp (SetOpusParams), a=extmap (StripHeaderExtensions) に限ります。
+// それ以外を書き換えた場合は PeerConnection と食い違うので、answer を送信せずに CREATE-ANSWER-ERROR で切断します。
+// その時 OnDisconnect に渡されるエラーは errors.Is で ErrUnsupportedLocalSDPChange と比較できます。
+func (c *Connection) OnLocalSDP(f SDPTransform) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	if f != nil {
+		f = localSafeSDPTransform(f)
+	}
+	c.callbacks.onLocalSDPHandler = f
 }
 
 // OnConnect は connect イベント発生時のコールバック関数を設定します。
 func (c *Connection) OnConnect(f func()) {
 	c.callbackMu.Lock()
 	defer c.callbackMu.Unlock()
-	c.onConnectHandler = f
+	c.callbacks.onConnectHandler = func() {
+		c.dispatch("OnConnect", f)
+	}
 }
 
 // OnDisconnect は disconnect イベント発生時のコールバック関数を設定します。
 func (c *Connection) OnDisconnect(f func(reason string, err error)) {
 	c.callbackMu.Lock()
 	defer c.callbackMu.Unlock()
-	c.onDisconnectHandler = f
+	c.callbacks.onDisconnectHandler = func(reason string, err error) {
+		c.dispatch("OnDisconnect", func() { f(reason, err) })
+	}
 }
 
 // OnTrack は RTP Packet 受診時に発生するコールバック関数を設定します。
 func (c *Connection) OnTrack(f func(track *webrtc.Track)) {
 	c.callbackMu.Lock()
 	defer c.callbackMu.Unlock()
-	c.onTrackHandler = f
+	c.callbacks.onTrackHandler = func(track *webrtc.Track) {
+		c.dispatch("OnTrack", func() { f(track) })
+	}
+}
+
+// OnTrackRemoved は受信していたトラックが終了した時に発生するコールバック関数を設定します。
+// Sora が update で再 offer した SDP から、そのトラックの m-line がなくなったか送信が止まった時に発生します。
+func (c *Connection) OnTrackRemoved(f func(track *webrtc.Track)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.onTrackRemovedHandler = func(track *webrtc.Track) {
+		c.dispatch("OnTrackRemoved", func() { f(track) })
+	}
 }
 
 // OnTrackPacket は RTP Packet 受診時に発生するコールバック関数を設定します。
 func (c *Connection) OnTrackPacket(f func(track *webrtc.Track, packet *rtp.Packet)) {
 	c.callbackMu.Lock()
 	defer c.callbackMu.Unlock()
-	c.onTrackPacketHandler = f
+	c.callbacks.onTrackPacketHandler = func(track *webrtc.Track, packet *rtp.Packet) {
+		c.dispatch("OnTrackPacket", func() { f(track, packet) })
+	}
+}
+
+// OnTrackSample は E2EE が有効な場合に、受信した RTP パケットから組み立てたフレームを復号した時に発生するコールバック関数を設定します。
+// フレームは次のフレームのパケットが届いた時に組み立て終わります。OnTrackPacket や Track.Packets() で受け取るペイロードは暗号化されたままです。
+// 送信者の鍵がまだ届いていないなど、復号できなかったフレームは捨てます。
+func (c *Connection) OnTrackSample(f func(track *webrtc.Track, sample media.Sample)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.onTrackSampleHandler = func(track *webrtc.Track, sample media.Sample) {
+		c.dispatch("OnTrackSample", func() { f(track, sample) })
+	}
 }
 
 // OnNotify は Sora から notify メッセージを受け取った時に発生するコールバック関数を設定します。
 func (c *Connection) OnSignalingNotify(f func(eventType string, message *SignalingNotifyMessage)) {
 	c.callbackMu.Lock()
 	defer c.callbackMu.Unlock()
-	c.onSignalingNotifyHandler = f
+	c.callbacks.onSignalingNotifyHandler = func(eventType string, message *SignalingNotifyMessage) {
+		c.dispatch("OnSignalingNotify", func() { f(eventType, message) })
+	}
 }
 
 // OnNotify は Sora から notify メッセージを受け取った時に発生するコールバック関数を設定します。
 func (c *Connection) OnSpotlightNotify(f func(eventType string, message *SpotlightNotifyMessage)) {
 	c.callbackMu.Lock()
 	defer c.callbackMu.Unlock()
-	c.onSpotlightNotifyHandler = f
+	c.callbacks.onSpotlightNotifyHandler = func(eventType string, message *SpotlightNotifyMessage) {
+		c.dispatch("OnSpotlightNotify", func() { f(eventType, message) })
+	}
 }
 
 // OnNotify は Sora から notify メッセージを受け取った時に発生するコールバック関数を設定します。
 func (c *Connection) OnNetworkNotify(f func(eventType string, message *NetworkNotifyMessage)) {
 	c.callbackMu.Lock()
 	defer c.callbackMu.Unlock()
-	c.onNetworkNotifyHandler = f
+	c.callbacks.onNetworkNotifyHandler = func(eventType string, message *NetworkNotifyMessage) {
+		c.dispatch("OnNetworkNotify", func() { f(eventType, message) })
+	}
+}
+
+// OnNotify は Sora から notify メッセージを受け取った時に発生するコールバック関数を設定します。
+// すべての event_type が対象で、go-sora が知らない event_type は *UnknownNotifyEvent として渡されます。
+func (c *Connection) OnNotify(f func(event NotifyEvent)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.onNotifyHandler = func(event NotifyEvent) {
+		c.dispatch("OnNotify", func() { f(event) })
+	}
+}
+
+// OnParticipantJoined はチャネルへの参加者を検知した時に発生するコールバック関数を設定します。
+// 自分が参加した時には、すでに接続していた参加者についても呼び出されます。
+func (c *Connection) OnParticipantJoined(f func(p Participant)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.onParticipantJoinedHandler = func(p Participant) {
+		c.dispatch("OnParticipantJoined", func() { f(p) })
+	}
+}
+
+// OnParticipantLeft は参加者がチャネルから退出した時に発生するコールバック関数を設定します。
+func (c *Connection) OnParticipantLeft(f func(p Participant)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.onParticipantLeftHandler = func(p Participant) {
+		c.dispatch("OnParticipantLeft", func() { f(p) })
+	}
+}
+
+// OnParticipantUpdated は参加者の情報が更新された時に発生するコールバック関数を設定します。
+func (c *Connection) OnParticipantUpdated(f func(p Participant)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.onParticipantUpdatedHandler = func(p Participant) {
+		c.dispatch("OnParticipantUpdated", func() { f(p) })
+	}
+}
+
+// OnStreamAdded は新しいリモートの MediaStream のトラックを受信した時に発生するコールバック関数を設定します。
+// 呼び出し時点では最初のトラックしか含まれていない場合があります。後から届いたトラックも同じ RemoteStream に追加されます。
+func (c *Connection) OnStreamAdded(f func(stream *RemoteStream)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.onStreamAddedHandler = func(stream *RemoteStream) {
+		c.dispatch("OnStreamAdded", func() { f(stream) })
+	}
+}
+
+// OnStreamRemoved はリモートの MediaStream が取り除かれた時に発生するコールバック関数を設定します。
+// update で再 offer された SDP から該当する m-line がなくなった時か、送信元の connection.destroyed を受け取った時に発生します。
+func (c *Connection) OnStreamRemoved(f func(stream *RemoteStream)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.onStreamRemovedHandler = func(stream *RemoteStream) {
+		c.dispatch("OnStreamRemoved", func() { f(stream) })
+	}
 }
 
 // OnPush は Sora から push メッセージを受け取った時に発生するコールバック関数を設定します。
 func (c *Connection) OnPush(f func(message []byte)) {
 	c.callbackMu.Lock()
 	defer c.callbackMu.Unlock()
-	c.onPushHandler = f
+	c.callbacks.onPushHandler = func(message []byte) {
+		c.dispatch("OnPush", func() { f(message) })
+	}
+}
+
+// OnPushMessage は Sora から push メッセージを受け取った時に発生するコールバック関数を設定します。
+func (c *Connection) OnPushMessage(f func(message *PushMessage)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.onPushMessageHandler = func(message *PushMessage) {
+		c.dispatch("OnPushMessage", func() { f(message) })
+	}
+}
+
+// OnPushData は push メッセージの data をデコードして受け取るコールバック関数を設定します。
+// f には func(T) または func(*T) を指定し、data は T に JSON としてデコードされます。
+// デコードに失敗した場合は f は呼ばれず、OnPushError で設定したコールバック関数が呼ばれます。
+func (c *Connection) OnPushData(f interface{}) error {
+	h, err := newPushDataHandler(f)
+	if err != nil {
+		return err
+	}
+
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.pushDataHandler = h
+	return nil
+}
+
+// OnPushError は push メッセージのデコードに失敗した時に発生するコールバック関数を設定します。
+// message 自体がデコードできなかった場合、message は nil になります。
+func (c *Connection) OnPushError(f func(message *PushMessage, err error)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.callbacks.onPushErrorHandler = func(message *PushMessage, err error) {
+		c.dispatch("OnPushError", func() { f(message, err) })
+	}
 }
 
 func (c *Connection) trace(format string, v ...interface{}) {
@@ -171,36 +614,77 @@ func (c *Connection) trace(format string, v ...interface{}) {
 	}
 }
 
-func (c *Connection) signaling() error {
-	if c.ws != nil {
+// signaling は WebSocket で Sora に接続して、シグナリングを開始します。
+// closes は呼び出す前に確認した close の回数で、WebSocket の接続中に close された場合は接続を捨てて errorClosed を返します。
+// WebSocket の接続は dialTimeout か close で中断されます。
+func (c *Connection) signaling(closes int) error {
+	if c.websocket() != nil {
 		return fmt.Errorf("WS-ALREADY-EXISTS")
 	}
 
-	ctx := context.Background()
+	spanCtx := c.startConnectSpan()
 
-	ws, err := c.openWS(ctx)
+	dialCtx, cancelDial := context.WithTimeout(spanCtx, dialTimeout)
+	defer cancelDial()
+	c.mu.Lock()
+	c.cancelDial = cancelDial
+	if c.closes != closes {
+		cancelDial()
+	}
+	c.mu.Unlock()
+
+	ws, err := c.openWS(dialCtx)
+	done := make(chan struct{})
+	c.mu.Lock()
+	c.cancelDial = nil
+	closed := c.closes != closes
+	if err == nil && !closed {
+		c.ws = ws
+		c.done = done
+	}
+	c.mu.Unlock()
+	if closed {
+		// close の後に設定すると WebSocket が閉じられないまま残るので、ここで閉じます
+		if err == nil {
+			ws.Close(websocket.StatusNormalClosure, "")
+		}
+		c.endConnectSpan(errorClosed)
+		return errorClosed
+	}
 	if err != nil {
+		c.endConnectSpan(err)
 		return fmt.Errorf("WS-OPEN-ERROR: %w", err)
 	}
-	c.ws = ws
-
-	ctx, cancel := context.WithCancel(ctx)
+	ctx, cancel := context.WithCancel(context.Background())
 	messageChannel := make(chan []byte, 100)
 
-	go c.recv(ctx, messageChannel)
-	go c.main(cancel, messageChannel)
+	c.goroutine(func() { c.recv(ctx, ws, messageChannel, done) })
+	c.goroutine(func() { c.main(cancel, messageChannel, done) })
 
-	return c.sendConnectMessage()
+	_, span := c.startSpan(spanCtx, "sora.sendConnectMessage")
+	c.startWaitSpan("offer", "sora.waitOffer")
+	err = c.sendConnectMessage()
+	endSpan(span, err)
+	if err != nil {
+		c.endConnectSpan(err)
+		return err
+	}
+	return nil
 }
 
-func (c *Connection) openWS(ctx context.Context) (*websocket.Conn, error) {
+func (c *Connection) openWS(ctx context.Context) (conn *websocket.Conn, err error) {
+	ctx, span := c.startSpan(ctx, "sora.openWS")
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	c.trace("Connecting to %s", c.Options.SoraURL)
 	u, err := url.Parse(c.Options.SoraURL)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, _, err := websocket.Dial(ctx, u.String(), nil)
+	conn, _, err = websocket.Dial(ctx, u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -209,11 +693,11 @@ func (c *Connection) openWS(ctx context.Context) (*websocket.Conn, error) {
 }
 
 func (c *Connection) sendMsg(v interface{}) error {
-	if c.ws != nil {
+	if ws := c.websocket(); ws != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
 		defer cancel()
 		c.trace("send %+v", v)
-		if err := wsjson.Write(ctx, c.ws, v); err != nil {
+		if err := wsjson.Write(ctx, ws, v); err != nil {
 			c.trace("failed to send %v: %v", v, err)
 			return err
 		}
@@ -227,10 +711,12 @@ func (c *Connection) sendPongMessage(stats bool) error {
 		Stats: []webrtc.Stats{},
 	}
 
-	if stats && c.pc != nil {
-		for _, s := range c.pc.GetStats() {
+	if pc := c.PeerConnection(); stats && pc != nil {
+		report := pc.GetStats()
+		for _, s := range report {
 			msg.Stats = append(msg.Stats, s)
 		}
+		c.emit(&StatsEvent{Report: report, Stats: c.Stats()})
 	}
 
 	if err := c.sendMsg(msg); err != nil {
@@ -239,6 +725,14 @@ func (c *Connection) sendPongMessage(stats bool) error {
 	return nil
 }
 
+// connectMetadata は connect メッセージの metadata を返します。RawMetadata を指定した場合は Metadata より優先します。
+func (c *Connection) connectMetadata() interface{} {
+	if v := metadataValue(c.Options.RawMetadata); v != nil {
+		return v
+	}
+	return metadataValue(c.Options.Metadata)
+}
+
 func (c *Connection) sendConnectMessage() error {
 	msg := &connectMessage{
 		Type:        "connect",
@@ -249,10 +743,18 @@ func (c *Connection) sendConnectMessage() error {
 		ClientID:    c.Options.ClientID,
 		Sdp:         "",
 		Audio:       c.Options.Audio,
-		Video:       c.Options.Video,
+		Video:       false,
 		Simulcast:   c.Options.Simulcast,
 		Multistream: c.Options.Multistream,
-		Metadata:    c.Options.Metadata,
+		E2EE:        c.Options.E2EE,
+
+		ForwardingFilter: c.Options.ForwardingFilter,
+
+		Metadata:                c.connectMetadata(),
+		SignalingNotifyMetadata: metadataValue(c.Options.SignalingNotifyMetadata),
+	}
+	if c.Options.Video != nil {
+		msg.Video = c.Options.Video
 	}
 
 	if err := c.sendMsg(msg); err != nil {
@@ -261,9 +763,10 @@ func (c *Connection) sendConnectMessage() error {
 	return nil
 }
 
-func (c *Connection) sendDisconnectMessage() error {
-	msg := &signalingMessage{
-		Type: "disconnect",
+func (c *Connection) sendDisconnectMessage(reason string) error {
+	msg := &disconnectMessage{
+		Type:   "disconnect",
+		Reason: reason,
 	}
 
 	if err := c.sendMsg(msg); err != nil {
@@ -272,26 +775,37 @@ func (c *Connection) sendDisconnectMessage() error {
 	return nil
 }
 
-func (c *Connection) createPeerConnection(offer *offerMessage) error {
+func (c *Connection) createPeerConnection(offer *offerMessage, sd webrtc.SessionDescription) error {
 	c.trace("Start createPeerConnection")
+	c.mu.Lock()
+	done := c.done
+	c.mu.Unlock()
+	if done == nil {
+		return errorClosed
+	}
+
 	m := webrtc.MediaEngine{}
-	codecs, err := populateFromSDP(createOfferSessionDescription(offer.Sdp))
+	codecs, err := populateFromSDP(sd)
 	if err != nil {
 		return err
 	}
-	for _, codec := range codecs {
-		m.RegisterCodec(codec)
-	}
 
-	videoCodecType, err := CreateVideoCodec(c.Options.Video.CodecType)
-	if err != nil {
-		return err
+	var videoCodec *webrtc.RTPCodec
+	if c.Options.Video != nil {
+		videoCodec, err = selectVideoCodec(codecs, c.Options.Video)
+		if err != nil {
+			return err
+		}
+		c.trace("%+v", *videoCodec)
+
+		// answer と GetCodecsByKind で選んだペイロードタイプが優先されるように、最初に登録する
+		m.RegisterCodec(videoCodec)
 	}
-	vcs := m.GetCodecsByName(videoCodecType.Name)
-	if len(vcs) == 0 {
-		return fmt.Errorf("Remote peer does not support %s", c.Options.Video.CodecType)
+	for _, codec := range codecs {
+		if codec != videoCodec {
+			m.RegisterCodec(codec)
+		}
 	}
-	c.trace("%+v", *vcs[0])
 
 	if c.Options.Audio {
 		acs := m.GetCodecsByName(webrtc.Opus)
@@ -308,8 +822,14 @@ func (c *Connection) createPeerConnection(offer *offerMessage) error {
 	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(s))
 
 	c.trace("RTCConfiguration: %v", c.pcConfig)
-	c.pcConfig.ICEServers = *offer.Config.IceServers
-	c.pcConfig.ICETransportPolicy = webrtc.NewICETransportPolicy(offer.Config.IceTransportPolicy)
+	var iceServers []webrtc.ICEServer
+	if offer.Config.IceServers != nil {
+		iceServers = *offer.Config.IceServers
+	}
+	c.pcConfig.ICEServers, c.pcConfig.ICETransportPolicy, err = c.iceOptions().apply(iceServers, webrtc.NewICETransportPolicy(offer.Config.IceTransportPolicy))
+	if err != nil {
+		return err
+	}
 	c.trace("RTCConfiguration: %+v", c.pcConfig)
 
 	pc, err := api.NewPeerConnection(c.pcConfig)
@@ -327,9 +847,11 @@ func (c *Connection) createPeerConnection(offer *offerMessage) error {
 		rtpTransceiverInit.Direction = webrtc.RTPTransceiverDirectionSendrecv
 	}
 
-	_, err = pc.AddTransceiver(webrtc.RTPCodecTypeVideo, rtpTransceiverInit)
-	if err != nil {
-		return err
+	if c.Options.Video != nil {
+		_, err = pc.AddTransceiver(webrtc.RTPCodecTypeVideo, rtpTransceiverInit)
+		if err != nil {
+			return err
+		}
 	}
 
 	if c.Options.Audio {
@@ -342,13 +864,18 @@ func (c *Connection) createPeerConnection(offer *offerMessage) error {
 	// Set a Handler for when a new remote track starts, this Handler copies inbound RTP packets,
 	// replaces the SSRC and sends them back
 	pc.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
+		defer c.track()()
+
 		// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
 		// This is a temporary fix until we implement incoming RTCP events, then we would push a PLI only when a viewer requests it
-		go func() {
+		c.goroutine(func() {
 			ticker := time.NewTicker(time.Second * 3)
-			for range ticker.C {
-				if c.pc == nil || c.pc.SignalingState() == webrtc.SignalingStateClosed {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
 					return
+				case <-ticker.C:
 				}
 
 				errSend := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: track.SSRC()}})
@@ -356,45 +883,81 @@ func (c *Connection) createPeerConnection(offer *offerMessage) error {
 					c.trace("Failed to write RTCP packet: %s", errSend.Error())
 				}
 			}
-		}()
+		})
 
 		c.trace("peerConnection.ontrack(): %d, codec: %s", track.PayloadType(), track.Codec().Name)
-		c.onTrackHandler(track)
+		t := c.addTrack(track)
+		c.handlers().onTrackHandler(track)
+		stream, added := c.addRemoteTrack(track)
+		if added {
+			c.handlers().onStreamAddedHandler(stream)
+		}
+		c.emit(&TrackAddedEvent{Track: t, Stream: stream})
 
-		go func() {
+		speakers := c.speakerDetector()
+		var frames *e2eeFrameReader
+		if c.Options.E2EE {
+			if frames = newE2EEFrameReader(track); frames == nil {
+				c.trace("E2EE is not supported for %s, frames are not decrypted", track.Codec().Name)
+			}
+		}
+		c.goroutine(func() {
+			defer c.endTrack(t)
 			for {
 				rtp, readErr := track.ReadRTP()
 				if readErr != nil {
-					if readErr == io.EOF {
+					if readErr == io.EOF || isClosed(done) {
 						return
 					}
 					c.trace("read RTP error %v", readErr)
-					c.Disconnect()
-					c.onDisconnectHandler("READ-RTP-ERROR", err)
+					c.disconnect("READ-RTP-ERROR", readErr)
 					return
 				}
-				c.onTrackPacketHandler(track, rtp)
+				c.handlers().onTrackPacketHandler(track, rtp)
+				if frames != nil {
+					samples, err := frames.push(c.e2eeSession(), rtp)
+					if err != nil {
+						c.trace("failed to decrypt frame of %s: %v", track.ID(), err)
+					}
+					for _, sample := range samples {
+						c.handlers().onTrackSampleHandler(track, sample)
+					}
+				}
+				t.push(rtp)
+				t.observe(rtp)
+				c.observeAudioLevel(speakers, t, rtp)
 
-				if c.pc == nil || c.pc.SignalingState() == webrtc.SignalingStateClosed {
+				if isClosed(done) {
 					return
 				}
 			}
-		}()
+		})
 	})
 	// Set the Handler for ICE connection state
 	// This will notify you when the peer has connected/disconnected
 	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		defer c.track()()
+
 		c.trace("ICE connection Status has changed to %s", connectionState.String())
-		if c.connectionState != connectionState {
-			c.connectionState = connectionState
-			switch c.connectionState {
+		c.mu.Lock()
+		changed := c.connectionState != connectionState
+		c.connectionState = connectionState
+		c.mu.Unlock()
+		if changed {
+			c.emit(&StateChangedEvent{State: connectionState})
+			switch connectionState {
 			case webrtc.ICEConnectionStateConnected:
-				c.onConnectHandler()
+				c.endWaitSpan("ice", nil, attrICEState.String(connectionState.String()))
+				c.endConnectSpan(nil)
+				c.onConnect()
+				c.emit(&ConnectedEvent{})
 			case webrtc.ICEConnectionStateDisconnected:
 				fallthrough
 			case webrtc.ICEConnectionStateFailed:
-				c.Disconnect()
-				c.onDisconnectHandler("ICE-CONNECTION-STATE-FAILED", nil)
+				err := fmt.Errorf("ICE connection state is %s", connectionState.String())
+				c.endWaitSpan("ice", err, attrICEState.String(connectionState.String()))
+				c.endConnectSpan(err)
+				c.disconnect("ICE-CONNECTION-STATE-FAILED", nil)
 			}
 		}
 	})
@@ -404,9 +967,15 @@ func (c *Connection) createPeerConnection(offer *offerMessage) error {
 	})
 
 	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		defer c.track()()
+
 		if candidate == nil {
 			return
 		}
+		if !c.iceOptions().allowCandidate(*candidate) {
+			c.trace("filtered local candidate: %s", candidate.String())
+			return
+		}
 
 		candidateJSON := candidate.ToJSON()
 		candidateMsg := &candidateMessage{
@@ -419,110 +988,92 @@ func (c *Connection) createPeerConnection(offer *offerMessage) error {
 		c.sendMsg(candidateMsg)
 	})
 
+	c.mu.Lock()
+	if c.done != done {
+		// PeerConnection の作成中に切断された
+		c.mu.Unlock()
+		pc.Close()
+		return errorClosed
+	}
 	c.pc = pc
 	c.clientID = offer.ClientID
 	c.connectionID = offer.ConnectionID
 	c.soraVersion = offer.Version
+	c.mu.Unlock()
 
-	c.onOpenHandler(pc, m)
+	c.startActiveSpeaker(done)
+	c.startLiveness(done)
+	c.handlers().onOpenHandler(pc, m)
 
 	return nil
 }
 
-func (c *Connection) createAnswer() error {
-	if c.pc == nil {
+// createAnswer は answer を作成し、msgType のメッセージとして Sora に送信します。
+func (c *Connection) createAnswer(ctx context.Context, msgType string) (err error) {
+	pc := c.PeerConnection()
+	if pc == nil {
 		return nil
 	}
 
-	answer, err := c.pc.CreateAnswer(nil)
+	_, span := c.startSpan(ctx, "sora.createAnswer")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	answer, err := pc.CreateAnswer(nil)
 	if err != nil {
-		c.Disconnect()
-		c.onDisconnectHandler("CREATE-ANSWER-ERROR", err)
+		c.disconnect("CREATE-ANSWER-ERROR", err)
 		return err
 	}
 	c.trace("create answer sdp=%s", answer.SDP)
-	c.pc.SetLocalDescription(answer)
-	if c.pc.LocalDescription() != nil {
-		msgType := "answer"
-		if c.answerSent {
-			msgType = "update"
+	pc.SetLocalDescription(answer)
+	if pc.LocalDescription() != nil {
+		// pion は書き換えた answer を SetLocalDescription できないので、Sora に送信する answer だけを書き換える
+		answerSDP, err := transformSDP(answer.SDP, c.localSDPTransform())
+		if err != nil {
+			c.disconnect("CREATE-ANSWER-ERROR", err)
+			return err
 		}
 		answerMsg := &answerMessage{
 			Type: msgType,
-			Sdp:  answer.SDP,
+			Sdp:  answerSDP,
+		}
+		if msgType == "answer" {
+			c.startWaitSpan("ice", "sora.iceConnected")
 		}
 		err = c.sendMsg(answerMsg)
 		if err != nil {
 			return err
 		}
-		if msgType == "answer" {
-			c.answerSent = true
-		}
 	}
 	return nil
 }
 
-func (c *Connection) setOffer(sessionDescription webrtc.SessionDescription) error {
-	if c.pc == nil {
+func (c *Connection) setOffer(ctx context.Context, sessionDescription webrtc.SessionDescription, answerType string) (err error) {
+	pc := c.PeerConnection()
+	if pc == nil {
 		return nil
 	}
-	err := c.pc.SetRemoteDescription(sessionDescription)
+
+	ctx, span := c.startSpan(ctx, "sora.setOffer")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	err = pc.SetRemoteDescription(sessionDescription)
 	if err != nil {
-		c.Disconnect()
-		c.onDisconnectHandler("CREATE-OFFER-ERROR", err)
+		c.disconnect("CREATE-OFFER-ERROR", err)
 		return err
 	}
 	c.trace("set offer sdp=%s", sessionDescription.SDP)
-	err = c.createAnswer()
+	err = c.createAnswer(ctx, answerType)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *Connection) closePeerConnection() {
-	if c.pc == nil {
-		return
-	}
-
-	if c.pc != nil && c.pc.SignalingState() == webrtc.SignalingStateClosed {
-		c.pc = nil
-		return
-	}
-	c.pc.OnICEConnectionStateChange(func(_ webrtc.ICEConnectionState) {})
-
-	go func() {
-		ticker := time.NewTicker(400 * time.Millisecond)
-		for range ticker.C {
-			if c.pc == nil {
-				ticker.Stop()
-				return
-			}
-			if c.pc != nil && c.pc.SignalingState() == webrtc.SignalingStateClosed {
-				ticker.Stop()
-				c.pc = nil
-				return
-			}
-		}
-	}()
-	if c.pc != nil {
-		c.pc.Close()
-	}
-}
-
-func (c *Connection) closeWebSocketConnection() {
-	if c.ws == nil {
-		return
-	}
-
-	if err := c.ws.Close(websocket.StatusNormalClosure, ""); err != nil {
-		c.trace("FAILED-SEND-CLOSE-MESSAGE")
-	}
-	c.trace("SENT-CLOSE-MESSAGE")
-	c.ws = nil
-}
-
-func (c *Connection) main(cancel context.CancelFunc, messageChannel chan []byte) {
+func (c *Connection) main(cancel context.CancelFunc, messageChannel chan []byte, done chan struct{}) {
 	defer func() {
 		cancel()
 		c.trace("EXIT-MAIN")
@@ -531,6 +1082,8 @@ func (c *Connection) main(cancel context.CancelFunc, messageChannel chan []byte)
 loop:
 	for {
 		select {
+		case <-done:
+			return
 		case rawMessage, ok := <-messageChannel:
 			if !ok {
 				c.trace("CLOSED-MESSAGE-CHANNEL")
@@ -544,28 +1097,32 @@ loop:
 	}
 }
 
-func (c *Connection) recv(ctx context.Context, messageChannel chan []byte) {
+func (c *Connection) recv(ctx context.Context, ws *websocket.Conn, messageChannel chan []byte, done chan struct{}) {
 loop:
 	for {
-		if c.ws == nil {
-			break loop
-		}
-
 		cctx, cancel := context.WithTimeout(ctx, readTimeout)
-		_, rawMessage, err := c.ws.Read(cctx)
+		_, rawMessage, err := ws.Read(cctx)
 		cancel()
 		if err != nil {
 			c.trace("failed to ReadMessage: %v", err)
 			break loop
 		}
-		messageChannel <- rawMessage
+		select {
+		case messageChannel <- rawMessage:
+		case <-done:
+			break loop
+		}
 	}
 	close(messageChannel)
 	c.trace("CLOSE-MESSAGE-CHANNEL")
 	<-ctx.Done()
 	c.trace("EXITED-MAIN")
-	c.Disconnect()
-	c.onDisconnectHandler("EXIT-RECV", nil)
+	if c.websocket() != ws {
+		// 切断済みか、接続し直して新しい接続に置き換わっている
+		c.trace("EXIT-RECV")
+		return
+	}
+	c.disconnect("EXIT-RECV", nil)
 	c.trace("EXIT-RECV")
 }
 
@@ -577,8 +1134,6 @@ func (c *Connection) handleMessage(rawMessage []byte) error {
 
 	c.trace("recv type: %s, rawMessage: %s", message.Type, string(rawMessage))
 
-	var err error
-
 	switch message.Type {
 	case "ping":
 		pingMsg := &pingMessage{}
@@ -592,50 +1147,109 @@ func (c *Connection) handleMessage(rawMessage []byte) error {
 			return err
 		}
 
-		switch notifyMsg.EventType {
-		case "connection.created":
-			fallthrough
-		case "connection.updated":
-			fallthrough
-		case "connection.destroyed":
-			signalingNotifyMsg := &SignalingNotifyMessage{}
-			if err := unmarshalMessage(c, rawMessage, &signalingNotifyMsg); err != nil {
-				return err
-			}
-			c.onSignalingNotifyHandler(notifyMsg.EventType, signalingNotifyMsg)
-		case "spotlight.changed":
-			spotlightNotifyMsg := &SpotlightNotifyMessage{}
-			if err := unmarshalMessage(c, rawMessage, &spotlightNotifyMsg); err != nil {
-				return err
-			}
-			c.onSpotlightNotifyHandler(notifyMsg.EventType, spotlightNotifyMsg)
-		case "network.status":
-			networkNotifyMsg := &NetworkNotifyMessage{}
-			if err := unmarshalMessage(c, rawMessage, &networkNotifyMsg); err != nil {
-				return err
+		// 他の参加者の metadata などで変換できなくても切断せずに、*UnknownNotifyEvent として渡す
+		event, err := parseNotifyEvent(notifyMsg.EventType, rawMessage)
+		if err != nil {
+			c.trace("invalid notify message, rawMessage: %s, error: %v", rawMessage, err)
+		}
+
+		c.updateRoster(event)
+
+		switch e := event.(type) {
+		case *ConnectionCreatedEvent:
+			c.handlers().onSignalingNotifyHandler(e.EventType, &e.SignalingNotifyMessage)
+		case *ConnectionUpdatedEvent:
+			c.handlers().onSignalingNotifyHandler(e.EventType, &e.SignalingNotifyMessage)
+		case *ConnectionDestroyedEvent:
+			c.handlers().onSignalingNotifyHandler(e.EventType, &e.SignalingNotifyMessage)
+			c.removeRemoteStream(e.ConnectionID)
+			c.removeSpeaker(e.ConnectionID)
+			if e2ee := c.e2eeSession(); e2ee != nil {
+				msgs, err := e2ee.removePeer(e.ConnectionID)
+				c.sendE2EEMessages(msgs, err)
 			}
-			c.onNetworkNotifyHandler(notifyMsg.EventType, networkNotifyMsg)
+		case *SpotlightChangedEvent:
+			c.handlers().onSpotlightNotifyHandler(e.EventType, &e.SpotlightNotifyMessage)
+		case *NetworkStatusEvent:
+			c.handlers().onNetworkNotifyHandler(e.EventType, &e.NetworkNotifyMessage)
+		}
+		c.handlers().onNotifyHandler(event)
+		c.emit(&NotifyReceivedEvent{Notify: event})
+
+		if e, ok := event.(*NetworkStatusEvent); ok && c.shouldReconnect(e.UnstableLevel) {
+			c.mu.Lock()
+			done := c.done
+			c.mu.Unlock()
+			c.goroutine(func() { c.reconnect(done) })
 		}
 		return nil
 	case "offer":
 		offerMsg := &offerMessage{}
 		if err := unmarshalMessage(c, rawMessage, &offerMsg); err != nil {
+			c.endConnectSpan(err)
+			return err
+		}
+		c.endWaitSpan("offer", nil)
+		info := newSessionInfo(offerMsg, rawMessage)
+		c.mu.Lock()
+		c.sessionInfo = info
+		c.mu.Unlock()
+		c.handlers().onOfferHandler(info.clone())
+
+		sd, err := c.createOfferSessionDescription(offerMsg.Sdp)
+		if err != nil {
+			c.endConnectSpan(err)
 			return err
 		}
 
-		err = c.createPeerConnection(offerMsg)
+		ctx := c.connectContext()
+		_, span := c.startSpan(ctx, "sora.createPeerConnection")
+		err = c.createPeerConnection(offerMsg, sd)
+		endSpan(span, err)
+		if err != nil {
+			c.endConnectSpan(err)
+			return err
+		}
+		err = c.setOffer(ctx, sd, "answer")
 		if err != nil {
+			c.endConnectSpan(err)
 			return err
 		}
-		return c.setOffer(createOfferSessionDescription(offerMsg.Sdp))
-	case "update":
+		return c.startE2EE()
+	case "update", "re-offer":
 		updateMsg := &answerMessage{}
 		if err := unmarshalMessage(c, rawMessage, &updateMsg); err != nil {
 			return err
 		}
-		return c.setOffer(createOfferSessionDescription(updateMsg.Sdp))
+		sd, err := c.createOfferSessionDescription(updateMsg.Sdp)
+		if err != nil {
+			return err
+		}
+		before := c.receivingTracks()
+		answerType := reanswerType(c.SoraVersion(), message.Type)
+		if (answerType == "re-answer") != (message.Type == "re-offer") {
+			c.trace("received %s from Sora %s, answering with %s", message.Type, c.SoraVersion(), answerType)
+		}
+		ctx, span := c.startSpan(context.Background(), "sora.update", attrMessageType.String(message.Type))
+		err = c.setOffer(ctx, sd, answerType)
+		endSpan(span, err)
+		if err != nil {
+			return err
+		}
+		if err := c.removeEndedTracks(before, updateMsg.Sdp); err != nil {
+			return err
+		}
+		return c.pruneRemoteStreams(updateMsg.Sdp)
+	case "e2ee":
+		e2eeMsg := &e2eeMessage{}
+		if err := unmarshalMessage(c, rawMessage, &e2eeMsg); err != nil {
+			return err
+		}
+		c.handleE2EEMessage(e2eeMsg.Data)
+		return nil
 	case "push":
-		c.onPushHandler(rawMessage)
+		c.handlers().onPushHandler(rawMessage)
+		c.handlePush(rawMessage)
 		return nil
 	default:
 		c.trace("invalid message type %s", message.Type)
@@ -643,3 +1257,71 @@ func (c *Connection) handleMessage(rawMessage []byte) error {
 	}
 	return nil
 }
+
+func (c *Connection) handlePush(rawMessage []byte) {
+	pushMsg := &PushMessage{}
+	if err := json.Unmarshal(rawMessage, pushMsg); err != nil {
+		c.trace("invalid push message: %v", err)
+		c.handlers().onPushErrorHandler(nil, err)
+		c.emit(&PushReceivedEvent{Raw: rawMessage})
+		return
+	}
+	c.handlers().onPushMessageHandler(pushMsg)
+	c.emit(&PushReceivedEvent{Message: pushMsg, Raw: rawMessage})
+
+	pushDataHandler := c.handlers().pushDataHandler
+	if pushDataHandler == nil {
+		return
+	}
+	c.dispatch("OnPushData", func() {
+		if err := pushDataHandler.call(pushMsg.Data); err != nil {
+			c.trace("failed to decode push data: %v", err)
+			c.handlers().onPushErrorHandler(pushMsg, err)
+		}
+	})
+}
+
+// reanswerType は Sora からの再 offer に対する応答のメッセージ名を、offer の version から返します。
+// 2022.1 より前の Sora は update で再 offer し update で応答を受け取りますが、
+// それ以降の Sora は re-offer で再 offer し re-answer で応答を受け取ります。
+// version がない場合や解釈できない場合は、受け取った offerType に合わせて応答します。
+func reanswerType(version, offerType string) string {
+	year, release, ok := parseSoraVersion(version)
+	if !ok {
+		if offerType == "re-offer" {
+			return "re-answer"
+		}
+		return "update"
+	}
+	if year > 2022 || (year == 2022 && release >= 1) {
+		return "re-answer"
+	}
+	return "update"
+}
+
+// parseSoraVersion は 2022.1.0 や 2022.1.0-canary.1 のような Sora のバージョンから、年とリリース番号を返します。
+func parseSoraVersion(version string) (int, int, bool) {
+	fields := strings.SplitN(version, ".", 3)
+	if len(fields) < 2 {
+		return 0, 0, false
+	}
+	year, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	release, err := strconv.Atoi(strings.SplitN(fields[1], "-", 2)[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	return year, release, true
+}
+
+// sendE2EEMessages は鍵交換のメッセージを送信します。鍵交換の失敗はその参加者のフレームが復号できなくなるだけなので、シグナリングは継続します。
+func (c *Connection) sendE2EEMessages(msgs []*e2eeMessage, err error) {
+	if err != nil {
+		c.trace("E2EE error: %v", err)
+	}
+	for _, msg := range msgs {
+		c.sendMsg(msg)
+	}
+}
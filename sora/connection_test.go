@@ -0,0 +1,333 @@
+package sora
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+func TestRenegotiationProtocolGenerations(t *testing.T) {
+	cases := []struct {
+		version    string
+		answerType string
+	}{
+		{"2020.1", "update"},
+		{"2022.1.0", "re-answer"},
+		{"2023.2.0-canary.4", "re-answer"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.version, func(t *testing.T) {
+			s := newFakeSora(t,
+				fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true},
+				fakePublisher{ConnectionID: "publisher-2", Audio: true, Video: true},
+			)
+			s.version = tc.version
+
+			opts := DefaultOptions()
+			opts.Multistream = true
+			c := NewConnection(s.URL(), "sora", opts)
+			defer c.Disconnect()
+
+			tracks := make(chan *webrtc.Track, 4)
+			removed := make(chan *webrtc.Track, 4)
+			c.OnTrack(func(track *webrtc.Track) { tracks <- track })
+			c.OnTrackRemoved(func(track *webrtc.Track) { removed <- track })
+
+			if err := c.Connect(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 4; i++ {
+				select {
+				case <-tracks:
+				case <-time.After(10 * time.Second):
+					t.Fatalf("timeout waiting for tracks, got %d", i)
+				}
+			}
+
+			ss := s.session(0)
+			if err := ss.removePublisher("publisher-2"); err != nil {
+				t.Fatal(err)
+			}
+			ss.expect(tc.answerType)
+
+			for i := 0; i < 2; i++ {
+				select {
+				case track := <-removed:
+					if track.Label() != "publisher-2" {
+						t.Errorf("expected track of publisher-2 to be removed, but got %s", track.Label())
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("timeout waiting for track removal")
+				}
+			}
+		})
+	}
+}
+
+func TestReanswerType(t *testing.T) {
+	cases := []struct {
+		version    string
+		offerType  string
+		answerType string
+	}{
+		{"2021.2.3", "update", "update"},
+		{"2022.1.0", "re-offer", "re-answer"},
+		{"2022.1.0-canary.1", "re-offer", "re-answer"},
+		{"2024.1", "re-offer", "re-answer"},
+		// バージョンで応答を決める
+		{"2021.1", "re-offer", "update"},
+		{"2022.2.0", "update", "re-answer"},
+		// バージョンがわからない場合は受け取ったメッセージに合わせる
+		{"", "update", "update"},
+		{"", "re-offer", "re-answer"},
+		{"develop", "re-offer", "re-answer"},
+	}
+	for _, tc := range cases {
+		if got := reanswerType(tc.version, tc.offerType); got != tc.answerType {
+			t.Errorf("reanswerType(%q, %q) = %q, expected %q", tc.version, tc.offerType, got, tc.answerType)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+	s.offerExtra = map[string]interface{}{
+		"metadata":       map[string]interface{}{"room": "A"},
+		"authz_metadata": map[string]interface{}{"is_admin": true},
+	}
+
+	opts := DefaultOptions()
+	opts.RawMetadata = map[string]interface{}{"access_token": "xyz"}
+	opts.SignalingNotifyMetadata = json.RawMessage(`{"name":"bot"}`)
+	c := NewConnection(s.URL(), "sora", opts)
+	defer c.Disconnect()
+
+	connected := make(chan struct{})
+	c.OnConnect(func() { close(connected) })
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for connect")
+	}
+
+	ss := s.session(0)
+	if m, ok := ss.connect.Metadata.(map[string]interface{}); !ok || m["access_token"] != "xyz" {
+		t.Errorf("unexpected metadata: %#v", ss.connect.Metadata)
+	}
+	if m, ok := ss.connect.SignalingNotifyMetadata.(map[string]interface{}); !ok || m["name"] != "bot" {
+		t.Errorf("unexpected signaling_notify_metadata: %#v", ss.connect.SignalingNotifyMetadata)
+	}
+
+	if got := string(c.OfferMetadata()); got != `{"room":"A"}` {
+		t.Errorf("unexpected offer metadata: %s", got)
+	}
+	if got := string(c.AuthzMetadata()); got != `{"is_admin":true}` {
+		t.Errorf("unexpected authz_metadata: %s", got)
+	}
+}
+
+func TestConnectMetadata(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Metadata.SignalingKey = "key"
+	c := NewConnection("ws://127.0.0.1/signaling", "sora", opts)
+	if m, ok := c.connectMetadata().(*Metadata); !ok || m.SignalingKey != "key" {
+		t.Errorf("unexpected metadata: %#v", c.connectMetadata())
+	}
+
+	// RawMetadata は Metadata より優先する
+	opts.RawMetadata = json.RawMessage(`"token"`)
+	if m, ok := c.connectMetadata().(json.RawMessage); !ok || string(m) != `"token"` {
+		t.Errorf("unexpected metadata: %#v", c.connectMetadata())
+	}
+
+	opts.RawMetadata = nil
+	opts.Metadata = nil
+	if m := c.connectMetadata(); m != nil {
+		t.Errorf("unexpected metadata: %#v", m)
+	}
+}
+
+func TestSessionInfo(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+	s.version = "2021.2.3"
+	s.offerExtra = map[string]interface{}{
+		"session_id": "fake-session-id",
+		"mid":        map[string]string{"audio": "0", "video": "1"},
+		"simulcast":  true,
+		"encodings": []map[string]interface{}{
+			{"rid": "r0", "active": true, "maxBitrate": 100000, "scaleResolutionDownBy": 4},
+			{"rid": "r1", "active": false, "maxBitrate": 500000},
+		},
+	}
+
+	c := NewConnection(s.URL(), "sora", nil)
+	defer c.Disconnect()
+
+	if _, ok := c.SessionInfo(); ok {
+		t.Error("expected no session info before offer")
+	}
+
+	offers := make(chan SessionInfo, 1)
+	c.OnOffer(func(info SessionInfo) { offers <- info })
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	var info SessionInfo
+	select {
+	case info = <-offers:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for offer")
+	}
+
+	if info.Version != "2021.2.3" || info.SessionID != "fake-session-id" || info.ConnectionID != "fake-connection-id" || info.ClientID != "fake-client-id" {
+		t.Errorf("unexpected session info: %+v", info)
+	}
+	if info.AudioMid != "0" || info.VideoMid != "1" || !info.Simulcast {
+		t.Errorf("unexpected mid or simulcast: %+v", info)
+	}
+	if len(info.Encodings) != 2 || info.Encodings[0].Rid != "r0" || !*info.Encodings[0].Active || info.Encodings[0].ScaleResolutionDownBy != 4 || *info.Encodings[1].Active || info.Encodings[1].MaxBitrate != 500000 {
+		t.Errorf("unexpected encodings: %+v", info.Encodings)
+	}
+	if info.ICETransportPolicy != webrtc.ICETransportPolicyAll || info.SDP == "" || len(info.Raw) == 0 {
+		t.Errorf("unexpected session info: %+v", info)
+	}
+
+	got, ok := c.SessionInfo()
+	if !ok || got.SessionID != "fake-session-id" {
+		t.Errorf("unexpected SessionInfo(): %+v", got)
+	}
+	if c.SoraVersion() != "2021.2.3" {
+		t.Errorf("unexpected SoraVersion(): %s", c.SoraVersion())
+	}
+}
+
+// TestConcurrentAccess は go test -race で、接続中の状態を別の goroutine から読み書きしても競合しないことを確認します。
+func TestConcurrentAccess(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	c := connectAndReceive(t, s, nil)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				c.ConnectionID()
+				c.ClientID()
+				c.SessionInfo()
+				if pc := c.PeerConnection(); pc != nil {
+					pc.GetTransceivers()
+				}
+				c.OnNotify(func(event NotifyEvent) {})
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	ss := s.session(0)
+	for i := 0; i < 10; i++ {
+		if err := ss.send(map[string]interface{}{"type": "notify", "event_type": "network.status", "unstable_level": 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ss.send(map[string]interface{}{"type": "ping", "stats": true}); err != nil {
+		t.Fatal(err)
+	}
+	ss.expect("pong")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Close(ctx, ""); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestMediaKinds(t *testing.T) {
+	cases := []struct {
+		name  string
+		audio bool
+		video *Video
+		kinds []webrtc.RTPCodecType
+	}{
+		{"audio only", true, nil, []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio}},
+		{"video only", false, &Video{CodecType: VideoCodecTypeVP8}, []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo}},
+		{"audio and video", true, &Video{CodecType: VideoCodecTypeVP9}, []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+			opts := DefaultOptions()
+			opts.Multistream = true
+			opts.Audio = tc.audio
+			opts.Video = tc.video
+			c := NewConnection(s.URL(), "sora", opts)
+			defer c.Disconnect()
+
+			connected := make(chan struct{}, 1)
+			tracks := make(chan *webrtc.Track, 4)
+			c.OnConnect(func() { connected <- struct{}{} })
+			c.OnTrack(func(track *webrtc.Track) { tracks <- track })
+			if err := c.Connect(); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-connected:
+			case <-time.After(10 * time.Second):
+				t.Fatal("timeout waiting for connect")
+			}
+
+			connect := s.session(0).connect
+			if connect.Audio != tc.audio {
+				t.Errorf("unexpected audio: %v", connect.Audio)
+			}
+			if tc.video == nil && connect.Video != false {
+				t.Errorf("expected video false, but got %v", connect.Video)
+			}
+			if v, ok := connect.Video.(map[string]interface{}); tc.video != nil && (!ok || v["codec_type"] != string(tc.video.CodecType)) {
+				t.Errorf("unexpected video: %v", connect.Video)
+			}
+
+			got := map[webrtc.RTPCodecType]bool{}
+			for len(got) < len(tc.kinds) {
+				select {
+				case track := <-tracks:
+					got[track.Kind()] = true
+				case <-time.After(10 * time.Second):
+					t.Fatalf("timeout waiting for tracks, got %v", got)
+				}
+			}
+			for _, kind := range tc.kinds {
+				if !got[kind] {
+					t.Errorf("expected %s track", kind)
+				}
+			}
+
+			// 要求しなかったメディアの transceiver は作らない
+			for _, tr := range c.PeerConnection().GetTransceivers() {
+				if !got[tr.Kind()] {
+					t.Errorf("unexpected %s transceiver", tr.Kind())
+				}
+			}
+		})
+	}
+}
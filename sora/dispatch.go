@@ -0,0 +1,203 @@
+package sora
+
+import (
+	"sync"
+)
+
+const defaultDispatchQueueSize = 100
+
+// OverflowPolicy はコールバック関数のキューがいっぱいになった時の動作です。
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest はキューの一番古いイベントを捨てて新しいイベントを追加します
+	OverflowDropOldest OverflowPolicy = iota
+
+	// OverflowBlock はキューに空きができるまで待ちます。待っている間はシグナリングや RTP の受信も止まります。
+	// 切断された場合は待つのをやめてイベントを捨てます
+	OverflowBlock
+
+	// OverflowDisconnect はイベントを捨てて Sora から切断します。OnDisconnect の reason は CALLBACK-QUEUE-OVERFLOW です
+	OverflowDisconnect
+)
+
+// DispatchOptions はコールバック関数を呼び出すキューの設定です。
+// 設定すると、OnOffer と OnOpen 以外のコールバック関数は、コールバック関数ごとのキューを経由して別の goroutine から呼び出されます。
+// 同じコールバック関数の呼び出し順は保たれますが、異なるコールバック関数の間の順序は保証されません。
+type DispatchOptions struct {
+	// QueueSize はコールバック関数ごとのキューに溜められるイベントの数。0 の場合は 100
+	QueueSize int
+
+	// Overflow はキューがいっぱいになった時の動作
+	Overflow OverflowPolicy
+}
+
+// CallbackStats はコールバック関数のキューの統計情報です。
+type CallbackStats struct {
+	// Queued はキューに溜まっているイベントの数
+	Queued int
+	// Dispatched はコールバック関数を呼び出した回数
+	Dispatched uint64
+	// Dropped はキューがいっぱいで捨てたイベントの数
+	Dropped uint64
+}
+
+// Stats は Connection の統計情報です。
+type Stats struct {
+	// Callbacks はコールバック関数の名前 (OnNotify など) ごとのキューの統計情報。DispatchOptions を設定していない場合は空です
+	Callbacks map[string]CallbackStats
+
+	// DroppedEvents は Events() のバッファがいっぱいで捨てたイベントの数
+	DroppedEvents uint64
+
+	// Tracks は受信しているトラックの ID ごとの統計情報。LivenessOptions を設定していない場合は空です
+	Tracks map[string]TrackStats
+}
+
+// callbackQueue は 1 つのコールバック関数のキューです。
+// イベントがある間だけ goroutine を起動して、順番にコールバック関数を呼び出します。
+type callbackQueue struct {
+	mu      sync.Mutex
+	items   []func()
+	running bool
+	// space はキューに空きができた時に閉じます
+	space chan struct{}
+
+	dispatched uint64
+	dropped    uint64
+}
+
+// Stats は Connection の統計情報を返します。
+func (c *Connection) Stats() Stats {
+	c.eventsMu.Lock()
+	stats := Stats{
+		Callbacks:     map[string]CallbackStats{},
+		DroppedEvents: c.droppedEvents,
+	}
+	c.eventsMu.Unlock()
+	stats.Tracks = c.trackStats()
+
+	c.dispatchMu.Lock()
+	defer c.dispatchMu.Unlock()
+	for name, q := range c.queues {
+		q.mu.Lock()
+		stats.Callbacks[name] = CallbackStats{
+			Queued:     len(q.items),
+			Dispatched: q.dispatched,
+			Dropped:    q.dropped,
+		}
+		q.mu.Unlock()
+	}
+	return stats
+}
+
+// dispatch は name のコールバック関数の呼び出し f を実行します。
+// DispatchOptions が設定されている場合はキューに追加し、設定されていない場合はその場で実行します。
+func (c *Connection) dispatch(name string, f func()) {
+	opts := c.Options.Dispatch
+	if opts == nil {
+		f()
+		return
+	}
+	size := opts.QueueSize
+	if size <= 0 {
+		size = defaultDispatchQueueSize
+	}
+
+	q := c.queue(name)
+	for {
+		q.mu.Lock()
+		if len(q.items) < size {
+			break
+		}
+
+		policy := opts.Overflow
+		c.mu.Lock()
+		done := c.done
+		c.mu.Unlock()
+		if policy == OverflowBlock && done == nil {
+			// 切断後は待っても空かない可能性があるので、古いものを捨てる
+			policy = OverflowDropOldest
+		}
+
+		switch policy {
+		case OverflowBlock:
+			if q.space == nil {
+				q.space = make(chan struct{})
+			}
+			space := q.space
+			q.mu.Unlock()
+			select {
+			case <-space:
+				continue
+			case <-done:
+				q.mu.Lock()
+				q.dropped++
+				q.mu.Unlock()
+				return
+			}
+		case OverflowDisconnect:
+			q.dropped++
+			q.mu.Unlock()
+			c.trace("callback queue %s overflowed", name)
+			c.disconnect("CALLBACK-QUEUE-OVERFLOW", errorCallbackQueueOverflow)
+			return
+		default:
+			q.items[0] = nil
+			q.items = q.items[1:]
+			q.dropped++
+		}
+		break
+	}
+
+	q.items = append(q.items, f)
+	start := !q.running
+	q.running = true
+	q.mu.Unlock()
+
+	if start {
+		c.goroutine(q.run)
+	}
+}
+
+// queue は name のコールバック関数のキューを返します。
+func (c *Connection) queue(name string) *callbackQueue {
+	c.dispatchMu.Lock()
+	defer c.dispatchMu.Unlock()
+
+	if c.queues == nil {
+		c.queues = map[string]*callbackQueue{}
+	}
+	q, ok := c.queues[name]
+	if !ok {
+		q = &callbackQueue{}
+		c.queues[name] = q
+	}
+	return q
+}
+
+// run はキューが空になるまでコールバック関数を呼び出します。
+func (q *callbackQueue) run() {
+	for {
+		q.mu.Lock()
+		if len(q.items) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		f := q.items[0]
+		q.items[0] = nil
+		q.items = q.items[1:]
+		if q.space != nil {
+			close(q.space)
+			q.space = nil
+		}
+		q.mu.Unlock()
+
+		f()
+
+		q.mu.Lock()
+		q.dispatched++
+		q.mu.Unlock()
+	}
+}
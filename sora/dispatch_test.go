@@ -0,0 +1,163 @@
+package sora
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// connectWithSlowNotify は OnNotify が release を閉じるまで戻らない Connection を接続します。
+func connectWithSlowNotify(t *testing.T, s *fakeSora, opts *DispatchOptions, levels chan<- int, release <-chan struct{}) *Connection {
+	t.Helper()
+
+	c := connectAndReceive(t, s, func(c *Connection) {
+		c.Options.Dispatch = opts
+		c.OnNotify(func(event NotifyEvent) {
+			e, ok := event.(*NetworkStatusEvent)
+			if !ok {
+				return
+			}
+			<-release
+			levels <- e.UnstableLevel
+		})
+	})
+	return c
+}
+
+func sendNetworkStatus(t *testing.T, ss *fakeSession, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		if err := ss.send(map[string]interface{}{"type": "notify", "event_type": "network.status", "unstable_level": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDispatchDropOldest(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+	levels := make(chan int, 10)
+	release := make(chan struct{})
+	c := connectWithSlowNotify(t, s, &DispatchOptions{QueueSize: 2}, levels, release)
+	defer c.Disconnect()
+
+	// OnNotify が止まっていても ping に応答できる
+	ss := s.session(0)
+	sendNetworkStatus(t, ss, 6)
+	if err := ss.send(map[string]interface{}{"type": "ping"}); err != nil {
+		t.Fatal(err)
+	}
+	ss.expect("pong")
+
+	close(release)
+	// 最初のイベントは呼び出し中、残りは新しい 2 つだけがキューに残る
+	var got []int
+	for len(got) < 3 {
+		select {
+		case level := <-levels:
+			got = append(got, level)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for notify, got %v", got)
+		}
+	}
+	if got[0] != 0 || got[1] != 4 || got[2] != 5 {
+		t.Errorf("unexpected order: %v", got)
+	}
+
+	stats := c.Stats().Callbacks["OnNotify"]
+	if stats.Dropped != 3 || stats.Queued != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestDispatchDisconnect(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+	// 切断後もキューに残ったイベントは呼び出されるので、すべて受け取れる大きさにする
+	levels := make(chan int, 12)
+	release := make(chan struct{})
+	defer close(release)
+	disconnected := make(chan error, 1)
+	// キューの大きさは OnTrackPacket にも使われるので、RTP パケットで溢れない大きさにする
+	c := connectWithSlowNotify(t, s, &DispatchOptions{QueueSize: 10, Overflow: OverflowDisconnect}, levels, release)
+	c.OnDisconnect(func(reason string, err error) {
+		if reason != "CALLBACK-QUEUE-OVERFLOW" {
+			t.Errorf("unexpected reason: %s", reason)
+		}
+		disconnected <- err
+	})
+
+	// 1 つ目は呼び出し中、10 個はキューに入り、12 個目で溢れる
+	sendNetworkStatus(t, s.session(0), 12)
+	select {
+	case err := <-disconnected:
+		if err != errorCallbackQueueOverflow {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for disconnect")
+	}
+	if got := c.Stats().Callbacks["OnNotify"].Dropped; got != 1 {
+		t.Errorf("expected 1 dropped event, but got %d", got)
+	}
+}
+
+func TestDispatchBlock(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+	levels := make(chan int, 10)
+	release := make(chan struct{})
+	c := connectWithSlowNotify(t, s, &DispatchOptions{QueueSize: 1, Overflow: OverflowBlock}, levels, release)
+
+	ss := s.session(0)
+	sendNetworkStatus(t, ss, 4)
+	close(release)
+	for i := 0; i < 4; i++ {
+		select {
+		case level := <-levels:
+			if level != i {
+				t.Errorf("expected %d, but got %d", i, level)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for notify")
+		}
+	}
+	if stats := c.Stats().Callbacks["OnNotify"]; stats.Dropped != 0 || stats.Dispatched < 4 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Close(ctx, ""); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestDispatchBlockClose はキューが空くのを待っている間に Close しても止まらず、実行中のコールバック関数の終了だけを待つことを確認します。
+func TestDispatchBlockClose(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+	levels := make(chan int, 10)
+	release := make(chan struct{})
+	c := connectWithSlowNotify(t, s, &DispatchOptions{QueueSize: 1, Overflow: OverflowBlock}, levels, release)
+
+	ss := s.session(0)
+	sendNetworkStatus(t, ss, 4)
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	closed := make(chan error, 1)
+	go func() { closed <- c.Close(ctx, "") }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned while OnNotify was running: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-closed; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
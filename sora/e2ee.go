@@ -0,0 +1,660 @@
+package sora
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+	"github.com/pion/webrtc/v2/pkg/media/samplebuilder"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// E2EE は go-sora 独自の形式です。Sora JS SDK の E2EE とはフレーム形式も鍵交換も異なり、相互運用できません。
+// 同じチャネルで E2EE を使う参加者は、すべて go-sora で同じ E2EESecret を設定している必要があります。
+//
+// フレーム形式
+//
+//	+--------------------+----------------------------+-------------+------------+
+//	| 暗号化しないヘッダー | 暗号文 (AES-128-GCM + tag) | counter (8) | key ID (4) |
+//	+--------------------+----------------------------+-------------+------------+
+//
+// ヘッダーは SFU やデコーダーがフレームの種類を判別できるよう平文のまま残し、AAD として認証します。
+// 長さは VP8 のキーフレームが 10 バイト、VP8 のデルタフレームが 3 バイト、音声が 1 バイト、それ以外は 0 バイトです。
+// IV はフレーム鍵の salt と counter (8) の XOR です。counter は送信者の全トラックで共通なので、同じ鍵で IV が重なることはありません。
+// Sora が転送する時に SSRC を書き換えても復号できるよう、SSRC は IV に含めません。
+//
+// 暗号化はコーデックのフレームに対して行うので、RTP パケット化の時にフレームの中身を解釈しない VP8 と Opus だけに対応しています。
+// Connection.WriteSample は RTP パケット化する前に暗号化し、受信側は RTP パケットからフレームを組み立ててから復号して OnTrackSample に渡します。
+//
+// 鍵交換
+//
+// 参加者はそれぞれ X25519 の鍵ペアを作り、公開鍵を e2ee メッセージで Sora 経由で通知します。
+// 公開鍵には E2EESecret から導出した鍵で HMAC-SHA256 を付けるので、E2EESecret を知らない Sora は公開鍵を差し替えられません。
+// フレーム鍵は参加者ごとに、X25519 の共有鍵と E2EESecret から導出した鍵で暗号化して配ります。
+// E2EESecret を知っている参加者同士はお互いになりすませるので、E2EESecret は信頼できる参加者にだけ渡してください。
+const (
+	e2eeKeyLength     = 16
+	e2eeSaltLength    = 12
+	e2eeCounterLength = 8
+	e2eeKeyIDLength   = 4
+	e2eeTrailerLength = e2eeCounterLength + e2eeKeyIDLength
+
+	// e2eeMinSecretLength は E2EESecret の最小の長さです
+	e2eeMinSecretLength = 16
+
+	// e2eeKeyActivationDelay は更新した自分の鍵を配ってから、暗号化に使い始めるまでの時間です。
+	// 配った鍵が届く前のフレームを、他の参加者が復号できなくならないようにします
+	e2eeKeyActivationDelay = time.Second
+
+	// e2eeMaxPendingMessages は E2EE の準備ができる前に受け取った e2ee メッセージを溜めておく数です
+	e2eeMaxPendingMessages = 100
+
+	// e2eeMaxLate は受信したフレームを組み立てる時に、順番が入れ替わったパケットを待つ数です
+	e2eeMaxLate = 64
+)
+
+// frameKey は 1 つの鍵 ID に対応するフレーム暗号化鍵です。
+type frameKey struct {
+	id   uint32
+	aead cipher.AEAD
+	salt [e2eeSaltLength]byte
+}
+
+// deriveFrameKey は鍵素材から HKDF-SHA256 でフレーム暗号化鍵と salt を導出します。
+func deriveFrameKey(id uint32, material []byte) (*frameKey, error) {
+	key := make([]byte, e2eeKeyLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, material, []byte("go-sora e2ee"), []byte("key")), key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &frameKey{id: id, aead: aead}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, material, []byte("go-sora e2ee"), []byte("salt")), k.salt[:]); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *frameKey) iv(counter uint64) []byte {
+	iv := make([]byte, e2eeSaltLength)
+	binary.BigEndian.PutUint64(iv[4:12], counter)
+	for i := range iv {
+		iv[i] ^= k.salt[i]
+	}
+	return iv
+}
+
+func (k *frameKey) encrypt(frame []byte, headerLength int, counter uint64) []byte {
+	if headerLength > len(frame) {
+		headerLength = len(frame)
+	}
+	header := frame[:headerLength]
+
+	out := make([]byte, 0, len(frame)+k.aead.Overhead()+e2eeTrailerLength)
+	out = append(out, header...)
+	out = k.aead.Seal(out, k.iv(counter), frame[headerLength:], header)
+
+	var trailer [e2eeTrailerLength]byte
+	binary.BigEndian.PutUint64(trailer[0:8], counter)
+	binary.BigEndian.PutUint32(trailer[8:12], k.id)
+	return append(out, trailer[:]...)
+}
+
+// parseE2EETrailer はフレーム末尾の counter と鍵 ID を返します。
+func parseE2EETrailer(frame []byte) (counter uint64, keyID uint32, body []byte, err error) {
+	if len(frame) < e2eeTrailerLength {
+		return 0, 0, nil, errorE2EEInvalid
+	}
+	trailer := frame[len(frame)-e2eeTrailerLength:]
+	return binary.BigEndian.Uint64(trailer[0:8]), binary.BigEndian.Uint32(trailer[8:12]), frame[:len(frame)-e2eeTrailerLength], nil
+}
+
+func (k *frameKey) decrypt(body []byte, headerLength int, counter uint64) ([]byte, error) {
+	if headerLength+k.aead.Overhead() > len(body) {
+		return nil, errorE2EEInvalid
+	}
+	header := body[:headerLength]
+
+	out := make([]byte, 0, len(body)-k.aead.Overhead())
+	out = append(out, header...)
+	return k.aead.Open(out, k.iv(counter), body[headerLength:], header)
+}
+
+// e2eeDepacketizer は E2EE に対応したコーデックの RTP ペイロードからフレームを取り出す Depacketizer と、
+// フレームの先頭のパケットを判定する PartitionHeadChecker を返します。対応していないコーデックの場合は nil を返します。
+func e2eeDepacketizer(codec *webrtc.RTPCodec) (rtp.Depacketizer, rtp.PartitionHeadChecker) {
+	if codec == nil {
+		return nil, nil
+	}
+	switch {
+	case strings.EqualFold(codec.Name, webrtc.Opus):
+		return &codecs.OpusPacket{}, &codecs.OpusPartitionHeadChecker{}
+	case strings.EqualFold(codec.Name, webrtc.VP8):
+		return &codecs.VP8Packet{}, &codecs.VP8PartitionHeadChecker{}
+	}
+	return nil, nil
+}
+
+// unencryptedHeaderLength はコーデックごとに暗号化せずに残すフレーム先頭のバイト数を返します。
+func unencryptedHeaderLength(codec *webrtc.RTPCodec, frame []byte) int {
+	if codec == nil {
+		return 0
+	}
+	switch {
+	case codec.Type == webrtc.RTPCodecTypeAudio:
+		return 1
+	case strings.EqualFold(codec.Name, webrtc.VP8):
+		// VP8 のフレームタグの P ビットが 0 ならキーフレーム
+		if len(frame) > 0 && frame[0]&0x01 == 0 {
+			return 10
+		}
+		return 3
+	}
+	return 0
+}
+
+// peerKeys は参加者から受け取ったフレーム鍵です。鍵の更新中に届くフレームのために、1 つ前の鍵まで残します。
+type peerKeys struct {
+	current  *frameKey
+	previous *frameKey
+}
+
+func (p *peerKeys) add(key *frameKey) {
+	switch {
+	case p.current == nil || key.id > p.current.id:
+		p.previous = p.current
+		p.current = key
+	case key.id == p.current.id:
+		p.current = key
+	case p.previous == nil || key.id >= p.previous.id:
+		// 順番が入れ替わって届いた 1 つ前の鍵
+		p.previous = key
+	}
+}
+
+func (p *peerKeys) get(id uint32) (*frameKey, bool) {
+	for _, k := range []*frameKey{p.current, p.previous} {
+		if k != nil && k.id == id {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// e2eeSession はコネクション 1 つ分の E2EE の鍵を管理します。
+type e2eeSession struct {
+	mu sync.Mutex
+
+	connectionID string
+	privateKey   []byte
+	publicKey    []byte
+
+	// authKey は公開鍵を認証する HMAC の鍵、wrapSalt は鍵配布用の鍵を導出する salt で、どちらも E2EESecret から導出します
+	authKey  []byte
+	wrapSalt []byte
+
+	// activeKey は暗号化に使っている自分の鍵。nextKey は配ったがまだ暗号化に使っていない鍵で、nextSince に作ったものです
+	activeKey      *frameKey
+	activeMaterial []byte
+	nextKey        *frameKey
+	nextMaterial   []byte
+	nextSince      time.Time
+	counter        uint64
+
+	// 参加者ごとの公開鍵と、参加者から受け取ったフレーム鍵
+	peerPublicKeys map[string][]byte
+	remoteKeys     map[string]*peerKeys
+
+	now             func() time.Time
+	activationDelay time.Duration
+}
+
+func newE2EESession(connectionID string, secret []byte) (*e2eeSession, error) {
+	if len(secret) < e2eeMinSecretLength {
+		return nil, errorE2EESecretRequired
+	}
+
+	privateKey := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(privateKey); err != nil {
+		return nil, err
+	}
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &e2eeSession{
+		connectionID:    connectionID,
+		privateKey:      privateKey,
+		publicKey:       publicKey,
+		authKey:         make([]byte, sha256.Size),
+		wrapSalt:        make([]byte, sha256.Size),
+		peerPublicKeys:  map[string][]byte{},
+		remoteKeys:      map[string]*peerKeys{},
+		now:             time.Now,
+		activationDelay: e2eeKeyActivationDelay,
+	}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, []byte("go-sora e2ee"), []byte("auth")), s.authKey); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, []byte("go-sora e2ee"), []byte("wrap salt")), s.wrapSalt); err != nil {
+		return nil, err
+	}
+
+	// 参加した時点では誰にも配っていないので、すぐに暗号化に使う
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	s.activeKey, s.activeMaterial = s.nextKey, s.nextMaterial
+	s.nextKey, s.nextMaterial = nil, nil
+	return s, nil
+}
+
+// latestKey は最後に作った自分の鍵を返します。他の参加者にはこの鍵を配ります。呼び出し側でロックを取得してください。
+func (s *e2eeSession) latestKey() (*frameKey, []byte) {
+	if s.nextKey != nil {
+		return s.nextKey, s.nextMaterial
+	}
+	return s.activeKey, s.activeMaterial
+}
+
+// rotate は新しい鍵 ID で自分のフレーム鍵を作ります。作った鍵は activationDelay が経つまで暗号化に使いません。
+// 呼び出し側でロックを取得してください。
+func (s *e2eeSession) rotate() error {
+	material := make([]byte, e2eeKeyLength)
+	if _, err := rand.Read(material); err != nil {
+		return err
+	}
+
+	var id uint32
+	if latest, _ := s.latestKey(); latest != nil {
+		id = latest.id + 1
+	}
+	key, err := deriveFrameKey(id, material)
+	if err != nil {
+		return err
+	}
+	s.nextKey = key
+	s.nextMaterial = material
+	s.nextSince = s.now()
+	return nil
+}
+
+func (s *e2eeSession) encryptFrame(frame []byte, headerLength int) []byte {
+	s.mu.Lock()
+	if s.nextKey != nil && s.now().Sub(s.nextSince) >= s.activationDelay {
+		s.activeKey, s.activeMaterial = s.nextKey, s.nextMaterial
+		s.nextKey, s.nextMaterial = nil, nil
+	}
+	key := s.activeKey
+	s.counter++
+	counter := s.counter
+	s.mu.Unlock()
+
+	return key.encrypt(frame, headerLength, counter)
+}
+
+func (s *e2eeSession) decryptFrame(connectionID string, frame []byte, headerLength int) ([]byte, error) {
+	counter, keyID, body, err := parseE2EETrailer(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	var key *frameKey
+	ok := false
+	if keys := s.remoteKeys[connectionID]; keys != nil {
+		key, ok = keys.get(keyID)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, errorE2EEUnknownKey
+	}
+	return key.decrypt(body, headerLength, counter)
+}
+
+// WriteSample は sample を track に書き込みます。E2EE が有効な場合は、RTP パケット化する前にフレームを自分の鍵で暗号化します。
+// E2EE が有効な場合に、鍵交換を始める前 (offer を受け取る前) は errorE2EENotStarted を、VP8 と Opus 以外のトラックは errorE2EEUnsupportedCodec を返します。
+func (c *Connection) WriteSample(track *webrtc.Track, sample media.Sample) error {
+	if !c.Options.E2EE {
+		return track.WriteSample(sample)
+	}
+	data, err := c.EncryptFrame(track, sample.Data)
+	if err != nil {
+		return err
+	}
+	sample.Data = data
+	return track.WriteSample(sample)
+}
+
+// EncryptFrame は E2EE が有効な場合に、RTP パケット化する前のフレームを自分の鍵で暗号化します。
+// SetAudioLevel などのために自分で RTP パケット化して WriteRTP で送信する場合に使います。それ以外は WriteSample を使ってください。
+func (c *Connection) EncryptFrame(track *webrtc.Track, frame []byte) ([]byte, error) {
+	if !c.Options.E2EE {
+		return nil, errorE2EEDisabled
+	}
+	if depacketizer, _ := e2eeDepacketizer(track.Codec()); depacketizer == nil {
+		return nil, errorE2EEUnsupportedCodec
+	}
+	e2ee := c.e2eeSession()
+	if e2ee == nil {
+		return nil, errorE2EENotStarted
+	}
+	return e2ee.encryptFrame(frame, unencryptedHeaderLength(track.Codec(), frame)), nil
+}
+
+// e2eeFrameReader は E2EE が有効な場合に、受信したトラックの RTP パケットからフレームを組み立てて送信者の鍵で復号します。
+type e2eeFrameReader struct {
+	track   *webrtc.Track
+	builder *samplebuilder.SampleBuilder
+}
+
+// newE2EEFrameReader は track のフレームを復号する e2eeFrameReader を返します。E2EE に対応していないコーデックの場合は nil を返します。
+func newE2EEFrameReader(track *webrtc.Track) *e2eeFrameReader {
+	depacketizer, checker := e2eeDepacketizer(track.Codec())
+	if depacketizer == nil {
+		return nil
+	}
+	return &e2eeFrameReader{
+		track:   track,
+		builder: samplebuilder.New(e2eeMaxLate, depacketizer, samplebuilder.WithPartitionHeadChecker(checker)),
+	}
+}
+
+// push は packet を追加して、組み立て終わったフレームを復号して返します。
+// フレームは次のフレームのパケットが届いた時に組み立て終わります。
+// 送信者の鍵がまだ届いていないなど、復号できなかったフレームは捨てて、最後のエラーを返します。
+func (r *e2eeFrameReader) push(e2ee *e2eeSession, packet *rtp.Packet) ([]media.Sample, error) {
+	r.builder.Push(packet)
+
+	var samples []media.Sample
+	var lastErr error
+	for {
+		sample := r.builder.Pop()
+		if sample == nil {
+			return samples, lastErr
+		}
+		if e2ee == nil {
+			lastErr = errorE2EENotStarted
+			continue
+		}
+		// 送信者のコネクション ID は、Sora と同じくトラックのラベル (ストリーム ID) です
+		data, err := e2ee.decryptFrame(r.track.Label(), sample.Data, unencryptedHeaderLength(r.track.Codec(), sample.Data))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		sample.Data = data
+		samples = append(samples, *sample)
+	}
+}
+
+// e2eeMessage は E2EE の鍵交換に使うシグナリングメッセージです。Sora はチャネル内の他のコネクションに中継します。
+type e2eeMessage struct {
+	Type string    `json:"type"`
+	Data *e2eeData `json:"data"`
+}
+
+type e2eeData struct {
+	// Kind は public_key (公開鍵の通知) か key (フレーム鍵の配布)
+	Kind string `json:"kind"`
+	From string `json:"from"`
+	// To が空の場合は全員宛て
+	To        string `json:"to,omitempty"`
+	PublicKey []byte `json:"public_key,omitempty"`
+	// MAC は From, To, PublicKey に対する E2EESecret から導出した鍵での HMAC-SHA256
+	MAC   []byte `json:"mac,omitempty"`
+	KeyID uint32 `json:"key_id,omitempty"`
+	Nonce []byte `json:"nonce,omitempty"`
+	Key   []byte `json:"key,omitempty"`
+}
+
+// publicKeyMAC は from から to への公開鍵の通知に付ける HMAC を返します。
+func (s *e2eeSession) publicKeyMAC(from, to string, publicKey []byte) []byte {
+	mac := hmac.New(sha256.New, s.authKey)
+	mac.Write([]byte("public_key"))
+	mac.Write([]byte{0})
+	mac.Write([]byte(from))
+	mac.Write([]byte{0})
+	mac.Write([]byte(to))
+	mac.Write([]byte{0})
+	mac.Write(publicKey)
+	return mac.Sum(nil)
+}
+
+// announce は自分の公開鍵を to に通知するメッセージを返します。to が空の場合は全員宛てです。
+func (s *e2eeSession) announce(to string) *e2eeMessage {
+	return &e2eeMessage{
+		Type: "e2ee",
+		Data: &e2eeData{
+			Kind:      "public_key",
+			From:      s.connectionID,
+			To:        to,
+			PublicKey: s.publicKey,
+			MAC:       s.publicKeyMAC(s.connectionID, to, s.publicKey),
+		},
+	}
+}
+
+// handle は他の参加者からのメッセージを処理し、返信するメッセージを返します。
+func (s *e2eeSession) handle(data *e2eeData) ([]*e2eeMessage, error) {
+	if data == nil || data.From == s.connectionID || (data.To != "" && data.To != s.connectionID) {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch data.Kind {
+	case "public_key":
+		if len(data.PublicKey) != curve25519.PointSize {
+			return nil, errorE2EEInvalid
+		}
+		// E2EESecret を知らない Sora などが差し替えた公開鍵は使わない
+		if !hmac.Equal(data.MAC, s.publicKeyMAC(data.From, data.To, data.PublicKey)) {
+			return nil, errorE2EEUnauthenticated
+		}
+		s.peerPublicKeys[data.From] = data.PublicKey
+
+		if data.To != "" {
+			// 自分の参加通知に対する既存参加者からの返信なので、自分の鍵を渡す
+			msg, err := s.wrapLocalKey(data.From)
+			if err != nil {
+				return nil, err
+			}
+			return []*e2eeMessage{msg}, nil
+		}
+
+		// 新しい参加者には公開鍵を返し、参加前のフレームを復号できないよう鍵を更新して全員に配る
+		reply := s.announce(data.From)
+		msgs, err := s.rotateAndDistribute()
+		if err != nil {
+			return nil, err
+		}
+		return append([]*e2eeMessage{reply}, msgs...), nil
+	case "key":
+		key, err := s.unwrapKey(data)
+		if err != nil {
+			return nil, err
+		}
+		if s.remoteKeys[data.From] == nil {
+			s.remoteKeys[data.From] = &peerKeys{}
+		}
+		s.remoteKeys[data.From].add(key)
+		return nil, nil
+	}
+	return nil, nil
+}
+
+// removePeer は退出した参加者の鍵を破棄し、退出した参加者が以降のフレームを復号できないよう鍵を更新して配ります。
+// 新しい鍵は配ってから e2eeKeyActivationDelay 後に使い始めるので、その間のフレームは退出した参加者も復号できます。
+func (s *e2eeSession) removePeer(connectionID string) ([]*e2eeMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.peerPublicKeys[connectionID]; !ok {
+		return nil, nil
+	}
+	delete(s.peerPublicKeys, connectionID)
+	delete(s.remoteKeys, connectionID)
+	return s.rotateAndDistribute()
+}
+
+func (s *e2eeSession) rotateAndDistribute() ([]*e2eeMessage, error) {
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+
+	var msgs []*e2eeMessage
+	for peer := range s.peerPublicKeys {
+		msg, err := s.wrapLocalKey(peer)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// wrapKeyCipher は自分と peer の X25519 共有鍵と E2EESecret から鍵配布用の AEAD を作ります。
+func (s *e2eeSession) wrapKeyCipher(peer string) (cipher.AEAD, error) {
+	peerPublicKey, ok := s.peerPublicKeys[peer]
+	if !ok {
+		return nil, errorE2EEUnknownKey
+	}
+	shared, err := curve25519.X25519(s.privateKey, peerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, e2eeKeyLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, s.wrapSalt, []byte("wrap")), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func wrapAAD(from, to string, keyID uint32) []byte {
+	aad := make([]byte, 0, len(from)+len(to)+6)
+	aad = append(aad, from...)
+	aad = append(aad, 0)
+	aad = append(aad, to...)
+	aad = append(aad, 0)
+	var id [4]byte
+	binary.BigEndian.PutUint32(id[:], keyID)
+	return append(aad, id[:]...)
+}
+
+// wrapLocalKey は最後に作った自分の鍵を peer 宛てに暗号化したメッセージを返します。
+func (s *e2eeSession) wrapLocalKey(peer string) (*e2eeMessage, error) {
+	aead, err := s.wrapKeyCipher(peer)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	key, material := s.latestKey()
+	return &e2eeMessage{
+		Type: "e2ee",
+		Data: &e2eeData{
+			Kind:  "key",
+			From:  s.connectionID,
+			To:    peer,
+			KeyID: key.id,
+			Nonce: nonce,
+			Key:   aead.Seal(nil, nonce, material, wrapAAD(s.connectionID, peer, key.id)),
+		},
+	}, nil
+}
+
+func (s *e2eeSession) unwrapKey(data *e2eeData) (*frameKey, error) {
+	aead, err := s.wrapKeyCipher(data.From)
+	if err != nil {
+		return nil, err
+	}
+	if len(data.Nonce) != aead.NonceSize() {
+		return nil, errorE2EEInvalid
+	}
+	material, err := aead.Open(nil, data.Nonce, data.Key, wrapAAD(data.From, s.connectionID, data.KeyID))
+	if err != nil {
+		return nil, err
+	}
+	return deriveFrameKey(data.KeyID, material)
+}
+
+// startE2EE は E2EE が有効な場合に鍵交換を始め、それまでに受け取っていた e2ee メッセージを処理します。
+func (c *Connection) startE2EE() error {
+	if !c.Options.E2EE {
+		return nil
+	}
+	e2ee, err := newE2EESession(c.ConnectionID(), c.Options.E2EESecret)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.e2ee = e2ee
+	pending := c.e2eePending
+	c.e2eePending = nil
+	c.mu.Unlock()
+
+	if err := c.sendMsg(e2ee.announce("")); err != nil {
+		return err
+	}
+	for _, data := range pending {
+		msgs, err := e2ee.handle(data)
+		c.sendE2EEMessages(msgs, err)
+	}
+	return nil
+}
+
+// handleE2EEMessage は e2ee メッセージを処理します。鍵交換を始める前に受け取ったメッセージは、始めるまで溜めておきます。
+func (c *Connection) handleE2EEMessage(data *e2eeData) {
+	if !c.Options.E2EE {
+		c.trace("E2EE is disabled, ignore e2ee message")
+		return
+	}
+
+	c.mu.Lock()
+	e2ee := c.e2ee
+	if e2ee == nil {
+		if len(c.e2eePending) >= e2eeMaxPendingMessages {
+			c.trace("too many pending e2ee messages, drop the oldest")
+			c.e2eePending = c.e2eePending[1:]
+		}
+		c.e2eePending = append(c.e2eePending, data)
+	}
+	c.mu.Unlock()
+	if e2ee == nil {
+		return
+	}
+
+	msgs, err := e2ee.handle(data)
+	c.sendE2EEMessages(msgs, err)
+}
@@ -0,0 +1,503 @@
+package sora
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+)
+
+var testE2EESecret = []byte("0123456789abcdef")
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestE2EEFrameFormat は go-sora 独自のフレーム形式が変わっていないことを確認します。
+// 期待値は go-sora で生成したもので、Sora JS SDK の E2EE との互換性は確認していません。
+func TestE2EEFrameFormat(t *testing.T) {
+	material := mustDecodeHex(t, "000102030405060708090a0b0c0d0e0f")
+	key, err := deriveFrameKey(1, material)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(key.salt[:]); got != "0c908db554bd6ab7aab15ec4" {
+		t.Errorf("unexpected salt: %s", got)
+	}
+
+	cases := []struct {
+		name         string
+		headerLength int
+		frame        string
+		encrypted    string
+	}{
+		{
+			name:         "VP8 key frame",
+			headerLength: 10,
+			frame:        "9017019d012a4001f0000102030405060708",
+			encrypted:    "9017019d012a4001f000f0ad0fe0d99ec9435b5275caa40e6d46c938c029eea5089b000000000000000100000001",
+		},
+		{
+			name:         "VP8 delta frame",
+			headerLength: 3,
+			frame:        "3102000a0b0c0d",
+			encrypted:    "310200fba400e984f48683947606115f740d331f458838000000000000000100000001",
+		},
+		{
+			name:         "Opus",
+			headerLength: 1,
+			frame:        "fc112233",
+			encrypted:    "fce08d3f94e7b535a73496ab4c3343c1b8dba6a0000000000000000100000001",
+		},
+	}
+
+	for _, c := range cases {
+		frame := mustDecodeHex(t, c.frame)
+		encrypted := key.encrypt(frame, c.headerLength, 1)
+		if got := hex.EncodeToString(encrypted); got != c.encrypted {
+			t.Errorf("%s: expected %s, but got %s", c.name, c.encrypted, got)
+		}
+
+		counter, keyID, body, err := parseE2EETrailer(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counter != 1 || keyID != 1 {
+			t.Errorf("%s: unexpected trailer: counter=%d, keyID=%d", c.name, counter, keyID)
+		}
+		decrypted, err := key.decrypt(body, c.headerLength, counter)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if !bytes.Equal(decrypted, frame) {
+			t.Errorf("%s: expected %x, but got %x", c.name, frame, decrypted)
+		}
+	}
+}
+
+func TestUnencryptedHeaderLength(t *testing.T) {
+	vp8 := webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, 90000)
+	vp9 := webrtc.NewRTPVP9Codec(webrtc.DefaultPayloadTypeVP9, 90000)
+	opus := webrtc.NewRTPOpusCodec(webrtc.DefaultPayloadTypeOpus, 48000)
+
+	cases := []struct {
+		codec    *webrtc.RTPCodec
+		frame    []byte
+		expected int
+	}{
+		{vp8, []byte{0x90}, 10},
+		{vp8, []byte{0x31}, 3},
+		{opus, []byte{0xfc}, 1},
+		{vp9, []byte{0x80}, 0},
+	}
+	for _, c := range cases {
+		if got := unencryptedHeaderLength(c.codec, c.frame); got != c.expected {
+			t.Errorf("%s %x: expected %d, but got %d", c.codec.Name, c.frame, c.expected, got)
+		}
+	}
+}
+
+// exchange は E2EE のメッセージを宛先のセッションに届け、返信がなくなるまで繰り返します。
+func exchange(t *testing.T, sessions map[string]*e2eeSession, msgs []*e2eeMessage) {
+	t.Helper()
+
+	for len(msgs) > 0 {
+		msg := msgs[0]
+		msgs = msgs[1:]
+		for id, s := range sessions {
+			if id == msg.Data.From {
+				continue
+			}
+			replies, err := s.handle(msg.Data)
+			if err != nil {
+				t.Fatalf("%s: %v", id, err)
+			}
+			msgs = append(msgs, replies...)
+		}
+	}
+}
+
+// e2eeTestSessions は時刻を進められる E2EE のセッションを作ります。
+type e2eeTestSessions struct {
+	t        *testing.T
+	now      time.Time
+	sessions map[string]*e2eeSession
+}
+
+func newE2EETestSessions(t *testing.T) *e2eeTestSessions {
+	return &e2eeTestSessions{t: t, now: time.Unix(0, 0), sessions: map[string]*e2eeSession{}}
+}
+
+func (ts *e2eeTestSessions) join(id string) *e2eeSession {
+	s, err := newE2EESession(id, testE2EESecret)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	s.now = func() time.Time { return ts.now }
+	ts.sessions[id] = s
+	exchange(ts.t, ts.sessions, []*e2eeMessage{s.announce("")})
+	return s
+}
+
+func (ts *e2eeTestSessions) leave(id string) {
+	delete(ts.sessions, id)
+	for _, s := range ts.sessions {
+		msgs, err := s.removePeer(id)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		exchange(ts.t, ts.sessions, msgs)
+	}
+}
+
+func TestE2EEKeyExchangeAndRotation(t *testing.T) {
+	ts := newE2EETestSessions(t)
+	alice := ts.join("alice")
+	bob := ts.join("bob")
+	ts.now = ts.now.Add(e2eeKeyActivationDelay)
+
+	frame := []byte{0xfc, 0x01, 0x02, 0x03}
+	encrypted := alice.encryptFrame(frame, 1)
+	decrypted, err := bob.decryptFrame("alice", encrypted, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, frame) {
+		t.Errorf("expected %x, but got %x", frame, decrypted)
+	}
+	if _, err := alice.decryptFrame("bob", bob.encryptFrame(frame, 1), 1); err != nil {
+		t.Errorf("alice failed to decrypt bob's frame: %v", err)
+	}
+
+	// 参加時に鍵が更新されるので、後から参加した carol は参加前のフレームを復号できない
+	beforeCarol := alice.encryptFrame(frame, 1)
+	carol := ts.join("carol")
+	if _, err := carol.decryptFrame("alice", beforeCarol, 1); err != errorE2EEUnknownKey {
+		t.Errorf("expected errorE2EEUnknownKey, but got %v", err)
+	}
+
+	// 新しい鍵は e2eeKeyActivationDelay が経つまで使わないので、鍵が届く前の bob も復号できる
+	pending := alice.encryptFrame(frame, 1)
+	if _, err := bob.decryptFrame("alice", pending, 1); err != nil {
+		t.Errorf("bob failed to decrypt alice's frame: %v", err)
+	}
+	if _, err := carol.decryptFrame("alice", pending, 1); err != errorE2EEUnknownKey {
+		t.Errorf("expected errorE2EEUnknownKey, but got %v", err)
+	}
+
+	ts.now = ts.now.Add(e2eeKeyActivationDelay)
+	afterCarol := alice.encryptFrame(frame, 1)
+	for _, s := range []*e2eeSession{bob, carol} {
+		if _, err := s.decryptFrame("alice", afterCarol, 1); err != nil {
+			t.Errorf("%s failed to decrypt alice's frame: %v", s.connectionID, err)
+		}
+	}
+
+	// 退出時に鍵が更新されるので、退出した bob は以降のフレームを復号できない
+	ts.leave("bob")
+	ts.now = ts.now.Add(e2eeKeyActivationDelay)
+	afterBob := alice.encryptFrame(frame, 1)
+	if _, err := bob.decryptFrame("alice", afterBob, 1); err != errorE2EEUnknownKey {
+		t.Errorf("expected errorE2EEUnknownKey, but got %v", err)
+	}
+	if _, err := carol.decryptFrame("alice", afterBob, 1); err != nil {
+		t.Errorf("carol failed to decrypt alice's frame: %v", err)
+	}
+
+	// 改ざんされたフレームは復号できない
+	afterBob[len(afterBob)-e2eeTrailerLength-1] ^= 0xff
+	if _, err := carol.decryptFrame("alice", afterBob, 1); err == nil {
+		t.Error("expected error for tampered frame")
+	}
+}
+
+func TestE2EERemoteKeysBounded(t *testing.T) {
+	ts := newE2EETestSessions(t)
+	alice := ts.join("alice")
+	bob := ts.join("bob")
+
+	frame := []byte{0xfc, 0x01, 0x02, 0x03}
+	var frames [][]byte
+	for i := 0; i < 5; i++ {
+		ts.now = ts.now.Add(e2eeKeyActivationDelay)
+		frames = append(frames, alice.encryptFrame(frame, 1))
+
+		alice.mu.Lock()
+		msgs, err := alice.rotateAndDistribute()
+		alice.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exchange(t, ts.sessions, msgs)
+	}
+
+	// 現在の鍵と 1 つ前の鍵だけを残す
+	keys := bob.remoteKeys["alice"]
+	if keys.current == nil || keys.previous == nil || keys.current.id != keys.previous.id+1 {
+		t.Fatalf("unexpected keys: %+v", keys)
+	}
+	if _, err := bob.decryptFrame("alice", frames[len(frames)-1], 1); err != nil {
+		t.Errorf("failed to decrypt the previous key's frame: %v", err)
+	}
+	if _, err := bob.decryptFrame("alice", frames[0], 1); err != errorE2EEUnknownKey {
+		t.Errorf("expected errorE2EEUnknownKey, but got %v", err)
+	}
+}
+
+func TestE2EERejectsUnauthenticatedPublicKey(t *testing.T) {
+	alice, err := newE2EESession("alice", testE2EESecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory, err := newE2EESession("mallory", []byte("fedcba9876543210"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := newE2EESession("bob", testE2EESecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// E2EESecret が異なる参加者の公開鍵
+	if _, err := alice.handle(mallory.announce("").Data); err != errorE2EEUnauthenticated {
+		t.Errorf("expected errorE2EEUnauthenticated, but got %v", err)
+	}
+
+	// Sora が差し替えた公開鍵
+	forged := bob.announce("").Data
+	forged.PublicKey = mallory.publicKey
+	if _, err := alice.handle(forged); err != errorE2EEUnauthenticated {
+		t.Errorf("expected errorE2EEUnauthenticated, but got %v", err)
+	}
+
+	// 全員宛ての通知を特定の参加者への返信に書き換えた場合
+	redirected := bob.announce("").Data
+	redirected.To = "alice"
+	if _, err := alice.handle(redirected); err != errorE2EEUnauthenticated {
+		t.Errorf("expected errorE2EEUnauthenticated, but got %v", err)
+	}
+	if len(alice.peerPublicKeys) != 0 {
+		t.Errorf("unexpected public keys: %+v", alice.peerPublicKeys)
+	}
+
+	if _, err := newE2EESession("alice", []byte("short")); err != errorE2EESecretRequired {
+		t.Errorf("expected errorE2EESecretRequired, but got %v", err)
+	}
+}
+
+func TestE2EEPendingMessages(t *testing.T) {
+	bob, err := newE2EESession("bob", testE2EESecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.E2EE = true
+	opts.E2EESecret = testE2EESecret
+	c := NewConnection("ws://127.0.0.1/signaling", "sora", opts)
+
+	// 鍵交換を始める前に届いたメッセージは溜めておく
+	c.handleE2EEMessage(bob.announce("").Data)
+	for i := 0; i < e2eeMaxPendingMessages; i++ {
+		c.handleE2EEMessage(bob.announce("").Data)
+	}
+	if len(c.e2eePending) != e2eeMaxPendingMessages {
+		t.Errorf("expected %d pending messages, but got %d", e2eeMaxPendingMessages, len(c.e2eePending))
+	}
+
+	if err := c.startE2EE(); err != nil {
+		t.Fatal(err)
+	}
+	if c.e2eePending != nil {
+		t.Errorf("unexpected pending messages: %d", len(c.e2eePending))
+	}
+	if _, ok := c.e2eeSession().peerPublicKeys["bob"]; !ok {
+		t.Error("expected bob's public key")
+	}
+
+	// E2EE が無効な場合は溜めない
+	c = NewConnection("ws://127.0.0.1/signaling", "sora", DefaultOptions())
+	c.handleE2EEMessage(bob.announce("").Data)
+	if len(c.e2eePending) != 0 {
+		t.Errorf("unexpected pending messages: %d", len(c.e2eePending))
+	}
+}
+
+func TestE2EEFrameReader(t *testing.T) {
+	ts := newE2EETestSessions(t)
+	alice := ts.join("alice")
+	bob := ts.join("bob")
+	ts.now = ts.now.Add(e2eeKeyActivationDelay)
+
+	vp8 := webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, 90000)
+	opus := webrtc.NewRTPOpusCodec(webrtc.DefaultPayloadTypeOpus, 48000)
+	cases := []struct {
+		codec  *webrtc.RTPCodec
+		frames [][]byte
+	}{
+		// MTU を超えるキーフレームは複数のパケットに分かれる
+		{vp8, [][]byte{append([]byte{0x90, 0x17, 0x01, 0x9d, 0x01, 0x2a}, bytes.Repeat([]byte{0xab}, 3000)...), {0x31, 0x02, 0x00, 0x0a}, {0x31, 0x02, 0x00, 0x0b}}},
+		{opus, [][]byte{{0xfc, 0x01}, {0xfc, 0x02}, {0xfc, 0x03}}},
+	}
+	for _, c := range cases {
+		track, err := webrtc.NewTrack(c.codec.PayloadType, 1111, "track", "alice", c.codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := newE2EEFrameReader(track)
+		if r == nil {
+			t.Fatalf("%s: expected a frame reader", c.codec.Name)
+		}
+
+		var got [][]byte
+		for _, frame := range c.frames {
+			encrypted := alice.encryptFrame(frame, unencryptedHeaderLength(c.codec, frame))
+			for _, packet := range track.Packetizer().Packetize(encrypted, 960) {
+				samples, err := r.push(bob, packet)
+				if err != nil {
+					t.Fatalf("%s: %v", c.codec.Name, err)
+				}
+				for _, sample := range samples {
+					got = append(got, sample.Data)
+				}
+			}
+		}
+
+		// フレームは次のフレームのパケットが届いた時に組み立て終わるので、最後のフレームはまだ返らない
+		if len(got) != len(c.frames)-1 {
+			t.Fatalf("%s: expected %d frames, but got %d", c.codec.Name, len(c.frames)-1, len(got))
+		}
+		for i := range got {
+			if !bytes.Equal(got[i], c.frames[i]) {
+				t.Errorf("%s: frame %d: expected %x, but got %x", c.codec.Name, i, c.frames[i], got[i])
+			}
+		}
+	}
+
+	// VP8 と Opus 以外は復号しない
+	vp9 := webrtc.NewRTPVP9Codec(webrtc.DefaultPayloadTypeVP9, 90000)
+	track, err := webrtc.NewTrack(vp9.PayloadType, 1111, "track", "alice", vp9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newE2EEFrameReader(track) != nil {
+		t.Error("expected no frame reader for VP9")
+	}
+}
+
+func TestE2EEWriteSample(t *testing.T) {
+	vp8 := webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, 90000)
+	track, err := webrtc.NewTrack(vp8.PayloadType, 1111, "track", "alice", vp8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vp9 := webrtc.NewRTPVP9Codec(webrtc.DefaultPayloadTypeVP9, 90000)
+	vp9Track, err := webrtc.NewTrack(vp9.PayloadType, 2222, "track", "alice", vp9)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.E2EE = true
+	opts.E2EESecret = testE2EESecret
+	c := NewConnection("ws://127.0.0.1/signaling", "sora", opts)
+	sample := media.Sample{Data: []byte{0x31, 0x02, 0x00, 0x0a}, Samples: 960}
+
+	// 鍵交換を始める前は平文で送信しない
+	if err := c.WriteSample(track, sample); err != errorE2EENotStarted {
+		t.Errorf("expected errorE2EENotStarted, but got %v", err)
+	}
+	if err := c.startE2EE(); err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := c.EncryptFrame(track, sample.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encrypted) <= len(sample.Data) || !bytes.Equal(encrypted[:3], sample.Data[:3]) {
+		t.Errorf("unexpected encrypted frame: %x", encrypted)
+	}
+	if err := c.WriteSample(vp9Track, sample); err != errorE2EEUnsupportedCodec {
+		t.Errorf("expected errorE2EEUnsupportedCodec, but got %v", err)
+	}
+
+	c = NewConnection("ws://127.0.0.1/signaling", "sora", DefaultOptions())
+	if _, err := c.EncryptFrame(track, sample.Data); err != errorE2EEDisabled {
+		t.Errorf("expected errorE2EEDisabled, but got %v", err)
+	}
+}
+
+// TestE2EEReceive は E2EE の配信者のフレームを、鍵交換の後に復号して OnTrackSample に渡すことを確認します。
+func TestE2EEReceive(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+	publisher, err := newE2EESession("publisher-1", testE2EESecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.activationDelay = 0
+	s.e2ee = map[string]*e2eeSession{"publisher-1": publisher}
+
+	samples := make(chan media.Sample, 100)
+	c := connectAndReceive(t, s, func(c *Connection) {
+		c.Options.E2EE = true
+		c.Options.E2EESecret = testE2EESecret
+		c.Options.Video = &Video{CodecType: VideoCodecTypeVP8}
+		c.OnTrackSample(func(track *webrtc.Track, sample media.Sample) {
+			if track.Label() != "publisher-1" {
+				t.Errorf("unexpected track: %s", track.Label())
+			}
+			select {
+			case samples <- sample:
+			default:
+			}
+		})
+	})
+	defer c.Disconnect()
+
+	// Sora の代わりに、クライアントの公開鍵を配信者に渡して返信を送る
+	ss := s.session(0)
+	b, err := json.Marshal(ss.expect("e2ee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg e2eeMessage
+	if err := json.Unmarshal(b, &msg); err != nil {
+		t.Fatal(err)
+	}
+	replies, err := publisher.handle(msg.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, reply := range replies {
+		if err := ss.send(reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case sample := <-samples:
+		if !bytes.Equal(sample.Data, fakeE2EEFrame) {
+			t.Errorf("expected %x, but got %x", fakeE2EEFrame, sample.Data)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for decrypted frames")
+	}
+}
+
+func TestE2EESecretRequired(t *testing.T) {
+	opts := DefaultOptions()
+	opts.E2EE = true
+	c := NewConnection("ws://127.0.0.1/signaling", "sora", opts)
+	if err := c.Connect(); err != errorE2EESecretRequired {
+		t.Errorf("expected errorE2EESecretRequired, but got %v", err)
+	}
+}
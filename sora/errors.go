@@ -4,7 +4,32 @@ import (
 	"errors"
 )
 
+// ErrUnsupportedLocalSDPChange は OnLocalSDP で設定した関数が b=, a=fmtp, a=extmap 以外を書き換えた場合のエラーです。
+var ErrUnsupportedLocalSDPChange = errors.New("UnsupportedLocalSDPChange")
+
+var (
+	// ErrManagerClosed は Shutdown した Manager で Start を呼び出した場合のエラーです。
+	ErrManagerClosed = errors.New("ManagerClosed")
+	// ErrTooManyConnections は ManagerOptions の MaxConnectionsPerChannel を超えて Start を呼び出した場合のエラーです。
+	ErrTooManyConnections = errors.New("TooManyConnections")
+)
+
 var (
 	errorInvalidJSON        = errors.New("InvalidJSON")
 	errorInvalidMessageType = errors.New("InvalidMessageType")
+
+	errorDisconnectedBeforeConnect = errors.New("DisconnectedBeforeConnect")
+	errorClosed                    = errors.New("ConnectionClosed")
+	errorCallbackQueueOverflow     = errors.New("CallbackQueueOverflow")
+
+	errorHeaderExtensionNotNegotiated = errors.New("HeaderExtensionNotNegotiated")
+	errorInvalidHeaderExtension       = errors.New("InvalidHeaderExtension")
+
+	errorE2EEDisabled         = errors.New("E2EEDisabled")
+	errorE2EENotStarted       = errors.New("E2EENotStarted")
+	errorE2EEUnsupportedCodec = errors.New("E2EEUnsupportedCodec")
+	errorE2EESecretRequired   = errors.New("E2EESecretRequired")
+	errorE2EEUnknownKey       = errors.New("E2EEUnknownKey")
+	errorE2EEInvalid          = errors.New("E2EEInvalidMessage")
+	errorE2EEUnauthenticated  = errors.New("E2EEUnauthenticated")
 )
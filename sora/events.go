@@ -0,0 +1,308 @@
+package sora
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	defaultEventBufferSize  = 100
+	defaultPacketBufferSize = 100
+)
+
+// Event は Events() で受け取るイベントです。
+// *ConnectedEvent, *DisconnectedEvent, *TrackAddedEvent, *TrackRemovedEvent, *NotifyReceivedEvent,
+// *PushReceivedEvent, *StateChangedEvent, *StatsEvent, *ActiveSpeakerChangedEvent, *SpeakingStateChangedEvent,
+// *TrackStalledEvent, *TrackResumedEvent のいずれかです。
+type Event interface {
+	connectionEvent()
+}
+
+// ConnectedEvent は ICE の接続が完了した時のイベントです。OnConnect と同じタイミングで発生します。
+type ConnectedEvent struct{}
+
+// DisconnectedEvent は Sora との接続が切れた時のイベントです。OnDisconnect と同じタイミングで発生し、この後 Events() は閉じられます。
+// Close や Disconnect で切断した場合も、OnDisconnect は呼び出されませんが、その理由を Reason として発生します。
+type DisconnectedEvent struct {
+	Reason string
+	Err    error
+}
+
+// TrackAddedEvent はリモートのトラックを受信し始めた時のイベントです。
+type TrackAddedEvent struct {
+	Track *Track
+	// Stream はトラックが含まれる RemoteStream
+	Stream *RemoteStream
+}
+
+// TrackRemovedEvent は受信していたトラックが終了した時のイベントです。OnTrackRemoved と同じタイミングで発生します。
+type TrackRemovedEvent struct {
+	Track *Track
+}
+
+// NotifyReceivedEvent は Sora から notify メッセージを受け取った時のイベントです。
+type NotifyReceivedEvent struct {
+	Notify NotifyEvent
+}
+
+// PushReceivedEvent は Sora から push メッセージを受け取った時のイベントです。
+type PushReceivedEvent struct {
+	// Message はデコードした push メッセージ。デコードできなかった場合は nil です
+	Message *PushMessage
+	// Raw は受け取ったメッセージそのもの
+	Raw []byte
+}
+
+// StateChangedEvent は ICE の接続状態が変わった時のイベントです。
+type StateChangedEvent struct {
+	State webrtc.ICEConnectionState
+}
+
+// StatsEvent は Sora から統計情報を求められた時のイベントです。
+type StatsEvent struct {
+	// Report は Sora に送信した WebRTC の統計情報
+	Report webrtc.StatsReport
+	// Stats は go-sora の統計情報
+	Stats Stats
+}
+
+// ActiveSpeakerChangedEvent はアクティブスピーカーが変わった時のイベントです。OnActiveSpeakerChanged と同じタイミングで発生します。
+type ActiveSpeakerChangedEvent struct {
+	ConnectionID string
+}
+
+// SpeakingStateChangedEvent は参加者が話し始めた時と話し終えた時のイベントです。OnSpeakingStateChanged と同じタイミングで発生します。
+type SpeakingStateChangedEvent struct {
+	ConnectionID string
+	Speaking     bool
+}
+
+// TrackStalledEvent は受信しているトラックが止まったと判定した時のイベントです。OnTrackStalled と同じタイミングで発生します。
+type TrackStalledEvent struct {
+	Track  *Track
+	Reason StallReason
+}
+
+// TrackResumedEvent は止まっていたトラックが再開した時のイベントです。OnTrackResumed と同じタイミングで発生します。
+type TrackResumedEvent struct {
+	Track  *Track
+	Reason StallReason
+	// Duration は止まっていた時間
+	Duration time.Duration
+}
+
+func (*ConnectedEvent) connectionEvent()            {}
+func (*DisconnectedEvent) connectionEvent()         {}
+func (*TrackAddedEvent) connectionEvent()           {}
+func (*TrackRemovedEvent) connectionEvent()         {}
+func (*NotifyReceivedEvent) connectionEvent()       {}
+func (*PushReceivedEvent) connectionEvent()         {}
+func (*StateChangedEvent) connectionEvent()         {}
+func (*StatsEvent) connectionEvent()                {}
+func (*ActiveSpeakerChangedEvent) connectionEvent() {}
+func (*SpeakingStateChangedEvent) connectionEvent() {}
+func (*TrackStalledEvent) connectionEvent()         {}
+func (*TrackResumedEvent) connectionEvent()         {}
+
+// Track は受信しているリモートのトラックです。
+type Track struct {
+	*webrtc.Track
+
+	packets    chan *rtp.Packet
+	extensions headerExtensionIDs
+	liveness   *trackLiveness
+
+	mu      sync.Mutex
+	closed  bool
+	dropped uint64
+}
+
+func newTrack(track *webrtc.Track, size int) *Track {
+	if size <= 0 {
+		size = defaultPacketBufferSize
+	}
+	return &Track{
+		Track:   track,
+		packets: make(chan *rtp.Packet, size),
+	}
+}
+
+// Packets は受信した RTP パケットを受け取るチャネルを返します。
+// バッファがいっぱいの場合は古いパケットから捨てます。トラックの受信が終わると閉じられます。
+func (t *Track) Packets() <-chan *rtp.Packet {
+	return t.packets
+}
+
+// HeaderExtensions は Packets() で受け取った packet の RTP ヘッダー拡張の値を返します。
+func (t *Track) HeaderExtensions(packet *rtp.Packet) HeaderExtensions {
+	return t.extensions.parse(packet)
+}
+
+// DroppedPackets はバッファがいっぱいで捨てた RTP パケットの数を返します。
+func (t *Track) DroppedPackets() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dropped
+}
+
+func (t *Track) push(packet *rtp.Packet) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return
+	}
+	if sendDropOldest(t.packets, packet) {
+		t.dropped++
+	}
+}
+
+// observe は LivenessOptions を設定している場合に、受信した packet を記録します。
+func (t *Track) observe(packet *rtp.Packet) {
+	if t.liveness != nil {
+		t.liveness.observe(packet, time.Now())
+	}
+}
+
+func (t *Track) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.closed {
+		t.closed = true
+		close(t.packets)
+	}
+}
+
+// sendDropOldest は ch に v を送信します。ch がいっぱいの場合は一番古いものを捨てて、捨てたかどうかを返します。
+func sendDropOldest(ch chan *rtp.Packet, v *rtp.Packet) bool {
+	select {
+	case ch <- v:
+		return false
+	default:
+	}
+	select {
+	case <-ch:
+	default:
+	}
+	select {
+	case ch <- v:
+	default:
+	}
+	return true
+}
+
+// Events は接続のイベントを受け取るチャネルを返します。コールバック関数の代わりに select や for range で使えます。
+// バッファがいっぱいの場合は古いイベントから捨てます。接続が終わると閉じられるので、次に接続する場合は改めて呼び出してください。
+// Disconnect でコールバック関数が初期化されても、イベントは届きます。
+func (c *Connection) Events() <-chan Event {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+
+	if c.events == nil {
+		size := c.Options.EventBufferSize
+		if size <= 0 {
+			size = defaultEventBufferSize
+		}
+		c.events = make(chan Event, size)
+	}
+	return c.events
+}
+
+// emit は Events() にイベントを送信します。Events() が呼ばれていない場合は何もしません。
+func (c *Connection) emit(e Event) {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+
+	if c.events == nil {
+		return
+	}
+	select {
+	case c.events <- e:
+		return
+	default:
+	}
+	select {
+	case <-c.events:
+		c.droppedEvents++
+	default:
+	}
+	select {
+	case c.events <- e:
+	default:
+		c.droppedEvents++
+	}
+}
+
+// endEvents は final を送信してから Events() を閉じます。final が nil の場合は送信せずに閉じます。
+func (c *Connection) endEvents(final Event) {
+	if final != nil {
+		c.emit(final)
+	}
+
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+	if c.events != nil {
+		close(c.events)
+		c.events = nil
+	}
+}
+
+// endClosed は Close や Disconnect で切断した後に Events() を閉じます。
+// 接続していた場合は、サーバーから切断された場合と同じように DisconnectedEvent を送信します。
+func (c *Connection) endClosed(reason string, opened bool) {
+	if !opened {
+		c.endEvents(nil)
+		return
+	}
+	c.endEvents(&DisconnectedEvent{Reason: reason})
+}
+
+// addTrack は受信を開始したトラックを Track として登録します。
+func (c *Connection) addTrack(track *webrtc.Track) *Track {
+	t := newTrack(track, c.Options.PacketBufferSize)
+	t.extensions = c.headerExtensionIDs(track.Kind())
+	if c.Options.Liveness != nil {
+		t.liveness = newTrackLiveness(track.Kind(), *c.Options.Liveness, time.Now())
+	}
+
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+	if c.tracks == nil {
+		c.tracks = map[*webrtc.Track]*Track{}
+	}
+	c.tracks[track] = t
+	return t
+}
+
+// endTrack はトラックの受信が終わった時に Packets() を閉じます。
+func (c *Connection) endTrack(t *Track) {
+	c.eventsMu.Lock()
+	delete(c.tracks, t.Track)
+	c.eventsMu.Unlock()
+
+	t.close()
+}
+
+// lookupTrack は webrtc.Track に対応する Track を返します。
+func (c *Connection) lookupTrack(track *webrtc.Track) *Track {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+
+	if t, ok := c.tracks[track]; ok {
+		return t
+	}
+	// 受信が終わったトラックの Packets() は閉じておく
+	t := newTrack(track, 1)
+	t.close()
+	return t
+}
+
+// trackRemoved は OnTrackRemoved のコールバック関数を呼び出し、TrackRemovedEvent を送信します。
+func (c *Connection) trackRemoved(track *webrtc.Track) {
+	c.handlers().onTrackRemovedHandler(track)
+	c.emit(&TrackRemovedEvent{Track: c.lookupTrack(track)})
+}
@@ -0,0 +1,189 @@
+package sora
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// waitEvent は f が true を返すイベントを受け取るまで、Events() のイベントを読み進めます。
+func waitEvent(t *testing.T, events <-chan Event, f func(e Event) bool) Event {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatal("events closed")
+			}
+			if f(e) {
+				return e
+			}
+		case <-timeout:
+			t.Fatal("timeout waiting for event")
+			return nil
+		}
+	}
+}
+
+// expectClosed は ch が閉じられるまで読み進めます。
+func expectClosed(t *testing.T, events <-chan Event) []Event {
+	t.Helper()
+
+	var rest []Event
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return rest
+			}
+			rest = append(rest, e)
+		case <-timeout:
+			t.Fatal("events was not closed")
+			return nil
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+	opts := DefaultOptions()
+	opts.Multistream = true
+	c := NewConnection(s.URL(), "sora", opts)
+	events := c.Events()
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	var tracks []*Track
+	var connected, state bool
+	waitEvent(t, events, func(e Event) bool {
+		switch e := e.(type) {
+		case *ConnectedEvent:
+			connected = true
+		case *StateChangedEvent:
+			state = state || e.State == webrtc.ICEConnectionStateConnected
+		case *TrackAddedEvent:
+			if e.Stream == nil || e.Stream.ID() != "publisher-1" {
+				t.Errorf("unexpected stream: %+v", e.Stream)
+			}
+			tracks = append(tracks, e.Track)
+		}
+		return connected && state && len(tracks) == 2
+	})
+
+	// Disconnect でコールバック関数が初期化されても届くように、Events() にはコールバック関数と別に送られる
+	c.resetHandlers()
+
+	ss := s.session(0)
+	if err := ss.send(map[string]interface{}{"type": "notify", "event_type": "network.status", "unstable_level": 1}); err != nil {
+		t.Fatal(err)
+	}
+	e := waitEvent(t, events, func(e Event) bool { _, ok := e.(*NotifyReceivedEvent); return ok }).(*NotifyReceivedEvent)
+	if n, ok := e.Notify.(*NetworkStatusEvent); !ok || n.UnstableLevel != 1 {
+		t.Errorf("unexpected notify: %+v", e.Notify)
+	}
+
+	if err := ss.send(map[string]interface{}{"type": "push", "data": map[string]string{"hello": "world"}}); err != nil {
+		t.Fatal(err)
+	}
+	p := waitEvent(t, events, func(e Event) bool { _, ok := e.(*PushReceivedEvent); return ok }).(*PushReceivedEvent)
+	if p.Message == nil || string(p.Message.Data) != `{"hello":"world"}` || len(p.Raw) == 0 {
+		t.Errorf("unexpected push: %+v", p)
+	}
+
+	if err := ss.send(map[string]interface{}{"type": "ping", "stats": true}); err != nil {
+		t.Fatal(err)
+	}
+	stats := waitEvent(t, events, func(e Event) bool { _, ok := e.(*StatsEvent); return ok }).(*StatsEvent)
+	if len(stats.Report) == 0 {
+		t.Error("expected stats report")
+	}
+
+	for _, track := range tracks {
+		select {
+		case packet := <-track.Packets():
+			if packet.SSRC != track.SSRC() {
+				t.Errorf("unexpected SSRC: %d", packet.SSRC)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %s packets", track.Kind())
+		}
+	}
+
+	// Sora から切断されると DisconnectedEvent の後に閉じられる
+	ss.close()
+	rest := expectClosed(t, events)
+	if len(rest) == 0 {
+		t.Fatal("expected DisconnectedEvent")
+	}
+	if d, ok := rest[len(rest)-1].(*DisconnectedEvent); !ok || d.Reason != "EXIT-RECV" {
+		t.Errorf("unexpected last event: %+v", rest[len(rest)-1])
+	}
+	for _, track := range tracks {
+		for range track.Packets() {
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Close(ctx, ""); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEventsClose(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+	var events <-chan Event
+	c := connectAndReceive(t, s, func(c *Connection) {
+		events = c.Events()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Close(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	rest := expectClosed(t, events)
+	if len(rest) == 0 {
+		t.Fatal("expected DisconnectedEvent")
+	}
+	if d, ok := rest[len(rest)-1].(*DisconnectedEvent); !ok || d.Reason != "NO-ERROR" || d.Err != nil {
+		t.Errorf("unexpected last event: %+v", rest[len(rest)-1])
+	}
+
+	// 閉じた後は新しいチャネルを返す
+	if c.Events() == events {
+		t.Error("expected a new channel")
+	}
+}
+
+func TestEventsDisconnect(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+	var events <-chan Event
+	c := connectAndReceive(t, s, func(c *Connection) {
+		events = c.Events()
+	})
+
+	c.Disconnect()
+	rest := expectClosed(t, events)
+	if len(rest) == 0 {
+		t.Fatal("expected DisconnectedEvent")
+	}
+	if d, ok := rest[len(rest)-1].(*DisconnectedEvent); !ok || d.Reason != "NO-ERROR" || d.Err != nil {
+		t.Errorf("unexpected last event: %+v", rest[len(rest)-1])
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Close(ctx, ""); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
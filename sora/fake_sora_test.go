@@ -0,0 +1,526 @@
+package sora
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp"
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// fakeSora は Sora のシグナリングと WebRTC の送信側を模したテスト用サーバーです。
+type fakeSora struct {
+	t      *testing.T
+	server *httptest.Server
+
+	// offer に含めるバージョン
+	version string
+
+	// offer に追加する項目
+	offerExtra map[string]interface{}
+
+	// offer の a=extmap に追加する RTP ヘッダー拡張の URI と ID。音声のパケットには音声レベルを設定します
+	headerExtensions map[string]uint8
+
+	// 接続してきたクライアントに送信する配信者の一覧
+	publishers []fakePublisher
+
+	// rejectRemoved が true の場合、removePublisher で取り除いた m-line を recvonly ではなく port 0 で再 offer します
+	rejectRemoved bool
+
+	// holdHandshake を設定すると、閉じられるまで WebSocket のハンドシェイクに応答しません
+	holdHandshake chan struct{}
+
+	// e2ee に配信者のコネクション ID の E2EE セッションを設定すると、その配信者のフレームを暗号化して送信します
+	e2ee map[string]*e2eeSession
+
+	mu       sync.Mutex
+	sessions []*fakeSession
+}
+
+// fakePublisher は fakeSora が送信するストリームです。ストリーム ID は Sora と同じくコネクション ID になります。
+type fakePublisher struct {
+	ConnectionID string
+	Audio        bool
+	Video        bool
+}
+
+// fakeSession は fakeSora に接続した 1 クライアント分の状態です。
+type fakeSession struct {
+	sora *fakeSora
+	ws   *websocket.Conn
+	pc   *webrtc.PeerConnection
+
+	connect connectMessage
+
+	mu       sync.Mutex
+	tracks   map[string][]*webrtc.Track
+	senders  map[string][]*webrtc.RTPSender
+	messages []map[string]interface{}
+	received chan map[string]interface{}
+	sequence uint16
+	// rejected は port 0 で再 offer する m-line の mid
+	rejected map[string]bool
+	// offer は最後に再 offer した SDP
+	offer string
+	// paused が true の間はメディアを送信しません
+	paused bool
+
+	done chan struct{}
+}
+
+func newFakeSora(t *testing.T, publishers ...fakePublisher) *fakeSora {
+	t.Helper()
+
+	s := &fakeSora{
+		t:          t,
+		version:    "2020.1",
+		publishers: publishers,
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.close)
+	return s
+}
+
+func (s *fakeSora) URL() string {
+	return "ws" + strings.TrimPrefix(s.server.URL, "http") + "/signaling"
+}
+
+func (s *fakeSora) close() {
+	s.mu.Lock()
+	sessions := s.sessions
+	s.mu.Unlock()
+	for _, ss := range sessions {
+		ss.close()
+	}
+	s.server.Close()
+}
+
+// session は n 番目に接続したクライアントのセッションを待って返します。
+func (s *fakeSora) session(n int) *fakeSession {
+	s.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		if len(s.sessions) > n {
+			ss := s.sessions[n]
+			s.mu.Unlock()
+			return ss
+		}
+		s.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.t.Fatalf("session %d was not established", n)
+	return nil
+}
+
+func (s *fakeSora) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	hold := s.holdHandshake
+	s.mu.Unlock()
+	if hold != nil {
+		select {
+		case <-hold:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	ws, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		s.t.Logf("fakeSora: accept error: %v", err)
+		return
+	}
+	ws.SetReadLimit(readLimit)
+
+	ss := &fakeSession{
+		sora:     s,
+		ws:       ws,
+		tracks:   map[string][]*webrtc.Track{},
+		senders:  map[string][]*webrtc.RTPSender{},
+		rejected: map[string]bool{},
+		received: make(chan map[string]interface{}, 100),
+		done:     make(chan struct{}),
+	}
+
+	ctx := context.Background()
+	if err := wsjson.Read(ctx, ws, &ss.connect); err != nil {
+		s.t.Logf("fakeSora: failed to read connect message: %v", err)
+		ws.Close(websocket.StatusProtocolError, "")
+		return
+	}
+
+	s.mu.Lock()
+	s.sessions = append(s.sessions, ss)
+	s.mu.Unlock()
+
+	if err := ss.sendOffer(); err != nil {
+		s.t.Logf("fakeSora: failed to send offer: %v", err)
+		ws.Close(websocket.StatusInternalError, "")
+		return
+	}
+
+	go ss.writeMedia()
+	ss.readLoop()
+}
+
+// video はクライアントが connect メッセージで映像を有効にしたかどうかと、その設定を返します。
+func (ss *fakeSession) video() (bool, map[string]interface{}) {
+	switch v := ss.connect.Video.(type) {
+	case map[string]interface{}:
+		return true, v
+	case bool:
+		return v, nil
+	}
+	return false, nil
+}
+
+func (ss *fakeSession) videoCodec() (uint8, *webrtc.RTPCodec) {
+	if _, v := ss.video(); v != nil && v["codec_type"] == string(VideoCodecTypeVP8) {
+		return webrtc.DefaultPayloadTypeVP8, webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, 90000)
+	}
+	return webrtc.DefaultPayloadTypeVP9, webrtc.NewRTPVP9Codec(webrtc.DefaultPayloadTypeVP9, 90000)
+}
+
+func (ss *fakeSession) sendOffer() error {
+	m := webrtc.MediaEngine{}
+	m.RegisterDefaultCodecs()
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+	ss.pc = pc
+
+	if ss.connect.Role != SendOnlyRole {
+		for _, p := range ss.sora.publishers {
+			if err := ss.addPublisher(p); err != nil {
+				return err
+			}
+		}
+	}
+	if ss.connect.Role != RecvOnlyRole {
+		direction := webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}
+		if ss.connect.Audio {
+			if _, err := pc.AddTransceiver(webrtc.RTPCodecTypeAudio, direction); err != nil {
+				return err
+			}
+		}
+		if enabled, _ := ss.video(); enabled {
+			if _, err := pc.AddTransceiver(webrtc.RTPCodecTypeVideo, direction); err != nil {
+				return err
+			}
+		}
+	}
+
+	sdp, err := ss.createOffer()
+	if err != nil {
+		return err
+	}
+
+	offer := map[string]interface{}{
+		"type":          "offer",
+		"version":       ss.sora.version,
+		"client_id":     "fake-client-id",
+		"connection_id": "fake-connection-id",
+		"config": map[string]interface{}{
+			"iceServers":         []interface{}{},
+			"iceTransportPolicy": "all",
+		},
+		"sdp": sdp,
+	}
+	for k, v := range ss.sora.offerExtra {
+		offer[k] = v
+	}
+	return ss.send(offer)
+}
+
+func (ss *fakeSession) createOffer() (string, error) {
+	offer, err := ss.pc.CreateOffer(nil)
+	if err != nil {
+		return "", err
+	}
+	if err := ss.pc.SetLocalDescription(offer); err != nil {
+		return "", err
+	}
+	return transformSDP(ss.pc.LocalDescription().SDP, SDPTransforms(ss.addHeaderExtensions, ss.rejectMedia))
+}
+
+// lastOffer は最後に再 offer した SDP を返します。
+func (ss *fakeSession) lastOffer() string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.offer
+}
+
+// rejectMedia は取り除いた配信者の m-line の port を 0 にします。
+func (ss *fakeSession) rejectMedia(sd *sdp.SessionDescription) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	for _, md := range sd.MediaDescriptions {
+		if mid, ok := md.Attribute("mid"); ok && ss.rejected[mid] {
+			md.MediaName.Port.Value = 0
+		}
+	}
+	return nil
+}
+
+// addHeaderExtensions は pion/webrtc v2 が offer に含めない a=extmap を追加します。
+func (ss *fakeSession) addHeaderExtensions(sd *sdp.SessionDescription) error {
+	for _, md := range sd.MediaDescriptions {
+		if md.MediaName.Media != "audio" && md.MediaName.Media != "video" {
+			continue
+		}
+		for uri, id := range ss.sora.headerExtensions {
+			md.Attributes = append(md.Attributes, sdp.Attribute{Key: "extmap", Value: fmt.Sprintf("%d %s", id, uri)})
+		}
+	}
+	return nil
+}
+
+func (ss *fakeSession) addPublisher(p fakePublisher) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	// Sora と同じく、クライアントが受信しないメディアは送信しない
+	if p.Audio && ss.connect.Audio {
+		track, err := ss.pc.NewTrack(webrtc.DefaultPayloadTypeOpus, rand.Uint32(), "audio-"+p.ConnectionID, p.ConnectionID)
+		if err != nil {
+			return err
+		}
+		sender, err := ss.pc.AddTrack(track)
+		if err != nil {
+			return err
+		}
+		ss.tracks[p.ConnectionID] = append(ss.tracks[p.ConnectionID], track)
+		ss.senders[p.ConnectionID] = append(ss.senders[p.ConnectionID], sender)
+	}
+	if enabled, _ := ss.video(); p.Video && enabled {
+		pt, _ := ss.videoCodec()
+		track, err := ss.pc.NewTrack(pt, rand.Uint32(), "video-"+p.ConnectionID, p.ConnectionID)
+		if err != nil {
+			return err
+		}
+		sender, err := ss.pc.AddTrack(track)
+		if err != nil {
+			return err
+		}
+		ss.tracks[p.ConnectionID] = append(ss.tracks[p.ConnectionID], track)
+		ss.senders[p.ConnectionID] = append(ss.senders[p.ConnectionID], sender)
+	}
+	return nil
+}
+
+// removePublisher は配信者のトラックを取り除き、update で再 offer します。
+func (ss *fakeSession) removePublisher(connectionID string) error {
+	ss.mu.Lock()
+	senders := ss.senders[connectionID]
+	delete(ss.senders, connectionID)
+	delete(ss.tracks, connectionID)
+	if ss.sora.rejectRemoved {
+		for _, t := range ss.pc.GetTransceivers() {
+			for _, sender := range senders {
+				if t.Sender() == sender {
+					ss.rejected[t.Mid()] = true
+				}
+			}
+		}
+	}
+	ss.mu.Unlock()
+
+	for _, sender := range senders {
+		if err := ss.pc.RemoveTrack(sender); err != nil {
+			return err
+		}
+	}
+	return ss.reoffer(ss.sora.reofferType())
+}
+
+// reofferType は version に応じた再 offer のメッセージ名を返します。2022.1 以降の Sora は re-offer を使います。
+func (s *fakeSora) reofferType() string {
+	if year, release, ok := parseSoraVersion(s.version); ok && (year > 2022 || (year == 2022 && release >= 1)) {
+		return "re-offer"
+	}
+	return "update"
+}
+
+func (ss *fakeSession) reoffer(msgType string) error {
+	sdp, err := ss.createOffer()
+	if err != nil {
+		return err
+	}
+	ss.mu.Lock()
+	ss.offer = sdp
+	ss.mu.Unlock()
+	return ss.send(map[string]interface{}{
+		"type": msgType,
+		"sdp":  sdp,
+	})
+}
+
+func (ss *fakeSession) send(v interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+	return wsjson.Write(ctx, ss.ws, v)
+}
+
+func (ss *fakeSession) readLoop() {
+	defer ss.close()
+
+	for {
+		var msg map[string]interface{}
+		if err := wsjson.Read(context.Background(), ss.ws, &msg); err != nil {
+			return
+		}
+
+		ss.mu.Lock()
+		ss.messages = append(ss.messages, msg)
+		ss.mu.Unlock()
+		select {
+		case ss.received <- msg:
+		default:
+		}
+
+		switch msg["type"] {
+		case "answer", "update", "re-answer":
+			sdp, _ := msg["sdp"].(string)
+			if err := ss.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp}); err != nil {
+				ss.sora.t.Logf("fakeSora: failed to set answer: %v", err)
+			}
+		case "candidate":
+			candidate, _ := msg["candidate"].(string)
+			if err := ss.pc.AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate}); err != nil {
+				ss.sora.t.Logf("fakeSora: failed to add candidate: %v", err)
+			}
+		case "disconnect":
+			return
+		}
+	}
+}
+
+// expect は指定した type のメッセージをクライアントから受信するまで待ちます。
+func (ss *fakeSession) expect(msgType string) map[string]interface{} {
+	t := ss.sora.t
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case msg := <-ss.received:
+			if msg["type"] == msgType {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("fakeSora: did not receive %q message", msgType)
+			return nil
+		}
+	}
+}
+
+// fakeE2EEFrame は E2EE を設定した配信者が暗号化して送信するフレームです。VP8 のデルタフレームとして扱われます。
+var fakeE2EEFrame = []byte{0x31, 0x02, 0x00, 0x0a, 0x0b, 0x0c, 0x0d}
+
+// writeMedia は送信中の全トラックにダミーの RTP パケットを書き込み続けます。
+func (ss *fakeSession) writeMedia() {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ss.done:
+			return
+		case <-ticker.C:
+		}
+
+		ss.mu.Lock()
+		if ss.paused {
+			ss.mu.Unlock()
+			continue
+		}
+		for connectionID, tracks := range ss.tracks {
+			for _, track := range tracks {
+				samples := uint32(960)
+				if track.Kind() == webrtc.RTPCodecTypeVideo {
+					samples = 1800
+				}
+				if id, ok := ss.sora.headerExtensions[HeaderExtensionAudioLevel]; ok && track.Kind() == webrtc.RTPCodecTypeAudio {
+					ss.writeAudioLevel(track, id, samples)
+					continue
+				}
+				if e2ee, ok := ss.sora.e2ee[connectionID]; ok {
+					frame := e2ee.encryptFrame(fakeE2EEFrame, unencryptedHeaderLength(track.Codec(), fakeE2EEFrame))
+					track.WriteSample(media.Sample{Data: frame, Samples: samples})
+					continue
+				}
+				track.WriteSample(media.Sample{Data: []byte{0x00, 0x01, 0x02, 0x03}, Samples: samples})
+			}
+		}
+		ss.mu.Unlock()
+	}
+}
+
+// writeAudioLevel は音声レベル 30 -dBov の RTP ヘッダー拡張を付けたパケットを書き込みます。
+func (ss *fakeSession) writeAudioLevel(track *webrtc.Track, id uint8, samples uint32) {
+	ss.sequence++
+	packet := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    track.PayloadType(),
+			SequenceNumber: ss.sequence,
+			Timestamp:      uint32(ss.sequence) * samples,
+			SSRC:           track.SSRC(),
+		},
+		Payload: []byte{0x00, 0x01, 0x02, 0x03},
+	}
+	level, _ := (&rtp.AudioLevelExtension{Level: 30, Voice: true}).Marshal()
+	packet.SetExtension(id, level)
+	track.WriteRTP(packet)
+}
+
+// pause はメディアの送信を止めるか再開します。配信者のネットワークが切れた状態を模します。
+func (ss *fakeSession) pause(paused bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.paused = paused
+}
+
+func (ss *fakeSession) close() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	select {
+	case <-ss.done:
+		return
+	default:
+	}
+	close(ss.done)
+	if ss.pc != nil {
+		ss.pc.Close()
+	}
+	ss.ws.Close(websocket.StatusNormalClosure, "")
+}
+
+func (ss *fakeSession) decode(msg map[string]interface{}, v interface{}) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		ss.sora.t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		ss.sora.t.Fatal(err)
+	}
+}
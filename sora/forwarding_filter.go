@@ -0,0 +1,145 @@
+package sora
+
+import (
+	"fmt"
+)
+
+// ForwardingFilterAction は転送フィルターの条件に一致した時の動作です。
+type ForwardingFilterAction string
+
+const (
+	// ForwardingFilterActionBlock は条件に一致したストリームを転送しません
+	ForwardingFilterActionBlock ForwardingFilterAction = "block"
+
+	// ForwardingFilterActionAllow は条件に一致したストリームだけを転送します
+	ForwardingFilterActionAllow ForwardingFilterAction = "allow"
+)
+
+// ForwardingFilterField は転送フィルターの条件で比較する送信元の項目です。
+type ForwardingFilterField string
+
+const (
+	ForwardingFilterFieldConnectionID ForwardingFilterField = "connection_id"
+	ForwardingFilterFieldClientID     ForwardingFilterField = "client_id"
+	// ForwardingFilterFieldKind は audio または video と比較します
+	ForwardingFilterFieldKind ForwardingFilterField = "kind"
+)
+
+// ForwardingFilterOperator は転送フィルターの条件の比較方法です。
+type ForwardingFilterOperator string
+
+const (
+	ForwardingFilterOperatorIsIn    ForwardingFilterOperator = "is_in"
+	ForwardingFilterOperatorIsNotIn ForwardingFilterOperator = "is_not_in"
+)
+
+// ForwardingFilterRule は転送フィルターの条件です。Field の値が Values に含まれるかどうかを Operator で判定します。
+type ForwardingFilterRule struct {
+	Field    ForwardingFilterField    `json:"field"`
+	Operator ForwardingFilterOperator `json:"operator"`
+	Values   []string                 `json:"values"`
+}
+
+// ForwardingFilter は Sora が転送するストリームを送信元ごとに絞り込む転送フィルターです。
+// Rules の内側の条件がすべて一致するものを、外側のいずれかに一致したものとして Action を適用します。
+type ForwardingFilter struct {
+	// Action は条件に一致した時の動作。空の場合は Sora の既定値の block になります
+	Action ForwardingFilterAction `json:"action,omitempty"`
+
+	Rules [][]ForwardingFilterRule `json:"rules"`
+}
+
+// Validate は Sora に送信する前に転送フィルターの内容を確認します。
+func (f *ForwardingFilter) Validate() error {
+	switch f.Action {
+	case "", ForwardingFilterActionBlock, ForwardingFilterActionAllow:
+	default:
+		return fmt.Errorf("invalid forwarding filter action '%s'", f.Action)
+	}
+
+	if len(f.Rules) == 0 {
+		return fmt.Errorf("forwarding filter has no rules")
+	}
+	for i, rules := range f.Rules {
+		if len(rules) == 0 {
+			return fmt.Errorf("forwarding filter rules[%d] is empty", i)
+		}
+		for j, rule := range rules {
+			if err := rule.validate(); err != nil {
+				return fmt.Errorf("forwarding filter rules[%d][%d]: %w", i, j, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r ForwardingFilterRule) validate() error {
+	switch r.Field {
+	case ForwardingFilterFieldConnectionID, ForwardingFilterFieldClientID, ForwardingFilterFieldKind:
+	default:
+		return fmt.Errorf("invalid field '%s'", r.Field)
+	}
+	switch r.Operator {
+	case ForwardingFilterOperatorIsIn, ForwardingFilterOperatorIsNotIn:
+	default:
+		return fmt.Errorf("invalid operator '%s'", r.Operator)
+	}
+
+	if len(r.Values) == 0 {
+		return fmt.Errorf("values is empty")
+	}
+	for _, v := range r.Values {
+		if v == "" {
+			return fmt.Errorf("values contains an empty string")
+		}
+		if r.Field == ForwardingFilterFieldKind && v != "audio" && v != "video" {
+			return fmt.Errorf("invalid kind '%s'", v)
+		}
+	}
+	return nil
+}
+
+// ForwardOnlyClientIDs は指定したクライアント ID のストリームだけを受信する転送フィルターを返します。
+func ForwardOnlyClientIDs(clientIDs ...string) *ForwardingFilter {
+	return &ForwardingFilter{
+		Action: ForwardingFilterActionBlock,
+		Rules: [][]ForwardingFilterRule{
+			{{Field: ForwardingFilterFieldClientID, Operator: ForwardingFilterOperatorIsNotIn, Values: clientIDs}},
+		},
+	}
+}
+
+// ForwardOnlyConnectionIDs は指定したコネクション ID のストリームだけを受信する転送フィルターを返します。
+func ForwardOnlyConnectionIDs(connectionIDs ...string) *ForwardingFilter {
+	return &ForwardingFilter{
+		Action: ForwardingFilterActionBlock,
+		Rules: [][]ForwardingFilterRule{
+			{{Field: ForwardingFilterFieldConnectionID, Operator: ForwardingFilterOperatorIsNotIn, Values: connectionIDs}},
+		},
+	}
+}
+
+// BlockClientIDs は指定したクライアント ID のストリームを受信しない転送フィルターを返します。
+func BlockClientIDs(clientIDs ...string) *ForwardingFilter {
+	return &ForwardingFilter{
+		Action: ForwardingFilterActionBlock,
+		Rules: [][]ForwardingFilterRule{
+			{{Field: ForwardingFilterFieldClientID, Operator: ForwardingFilterOperatorIsIn, Values: clientIDs}},
+		},
+	}
+}
+
+// ForwardAudioOnly は音声だけを受信する転送フィルターを返します。
+// exceptClientIDs を指定すると、そのクライアント ID からは映像も受信します。
+func ForwardAudioOnly(exceptClientIDs ...string) *ForwardingFilter {
+	rule := []ForwardingFilterRule{
+		{Field: ForwardingFilterFieldKind, Operator: ForwardingFilterOperatorIsIn, Values: []string{"video"}},
+	}
+	if len(exceptClientIDs) > 0 {
+		rule = append(rule, ForwardingFilterRule{Field: ForwardingFilterFieldClientID, Operator: ForwardingFilterOperatorIsNotIn, Values: exceptClientIDs})
+	}
+	return &ForwardingFilter{
+		Action: ForwardingFilterActionBlock,
+		Rules:  [][]ForwardingFilterRule{rule},
+	}
+}
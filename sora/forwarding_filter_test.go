@@ -0,0 +1,125 @@
+package sora
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestForwardingFilterValidate(t *testing.T) {
+	rule := ForwardingFilterRule{Field: ForwardingFilterFieldClientID, Operator: ForwardingFilterOperatorIsIn, Values: []string{"alice"}}
+	cases := []struct {
+		name   string
+		filter ForwardingFilter
+		valid  bool
+	}{
+		{"default action", ForwardingFilter{Rules: [][]ForwardingFilterRule{{rule}}}, true},
+		{"allow", ForwardingFilter{Action: ForwardingFilterActionAllow, Rules: [][]ForwardingFilterRule{{rule}, {rule}}}, true},
+		{"invalid action", ForwardingFilter{Action: "deny", Rules: [][]ForwardingFilterRule{{rule}}}, false},
+		{"no rules", ForwardingFilter{}, false},
+		{"empty rules", ForwardingFilter{Rules: [][]ForwardingFilterRule{{}}}, false},
+		{"invalid field", ForwardingFilter{Rules: [][]ForwardingFilterRule{{{Field: "role", Operator: ForwardingFilterOperatorIsIn, Values: []string{"sendonly"}}}}}, false},
+		{"invalid operator", ForwardingFilter{Rules: [][]ForwardingFilterRule{{{Field: ForwardingFilterFieldClientID, Operator: "eq", Values: []string{"alice"}}}}}, false},
+		{"no values", ForwardingFilter{Rules: [][]ForwardingFilterRule{{{Field: ForwardingFilterFieldClientID, Operator: ForwardingFilterOperatorIsIn}}}}, false},
+		{"empty value", ForwardingFilter{Rules: [][]ForwardingFilterRule{{{Field: ForwardingFilterFieldClientID, Operator: ForwardingFilterOperatorIsIn, Values: []string{""}}}}}, false},
+		{"invalid kind", ForwardingFilter{Rules: [][]ForwardingFilterRule{{{Field: ForwardingFilterFieldKind, Operator: ForwardingFilterOperatorIsIn, Values: []string{"data"}}}}}, false},
+		{"helper", *ForwardAudioOnly("alice"), true},
+		{"helper without values", *ForwardOnlyClientIDs(), false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.filter.Validate()
+			if tc.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestForwardingFilterHelpers(t *testing.T) {
+	cases := []struct {
+		name   string
+		filter *ForwardingFilter
+		json   string
+	}{
+		{
+			"ForwardOnlyClientIDs",
+			ForwardOnlyClientIDs("alice", "bob"),
+			`{"action":"block","rules":[[{"field":"client_id","operator":"is_not_in","values":["alice","bob"]}]]}`,
+		},
+		{
+			"ForwardOnlyConnectionIDs",
+			ForwardOnlyConnectionIDs("conn-1"),
+			`{"action":"block","rules":[[{"field":"connection_id","operator":"is_not_in","values":["conn-1"]}]]}`,
+		},
+		{
+			"BlockClientIDs",
+			BlockClientIDs("mallory"),
+			`{"action":"block","rules":[[{"field":"client_id","operator":"is_in","values":["mallory"]}]]}`,
+		},
+		{
+			"ForwardAudioOnly",
+			ForwardAudioOnly(),
+			`{"action":"block","rules":[[{"field":"kind","operator":"is_in","values":["video"]}]]}`,
+		},
+		{
+			"ForwardAudioOnly except",
+			ForwardAudioOnly("presenter"),
+			`{"action":"block","rules":[[{"field":"kind","operator":"is_in","values":["video"]},{"field":"client_id","operator":"is_not_in","values":["presenter"]}]]}`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := json.Marshal(tc.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.json {
+				t.Errorf("unexpected json:\n got: %s\nwant: %s", b, tc.json)
+			}
+		})
+	}
+}
+
+func TestForwardingFilterConnect(t *testing.T) {
+	s := newFakeSora(t)
+
+	opts := DefaultOptions()
+	opts.Role = RecvOnlyRole
+	opts.Multistream = true
+	opts.ForwardingFilter = ForwardOnlyClientIDs("alice")
+	c := NewConnection(s.URL(), "sora", opts)
+	defer c.Disconnect()
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := s.session(0).connect.ForwardingFilter
+	if !reflect.DeepEqual(got, opts.ForwardingFilter) {
+		t.Errorf("unexpected forwarding_filter: %+v", got)
+	}
+}
+
+func TestForwardingFilterConnectInvalid(t *testing.T) {
+	s := newFakeSora(t)
+
+	opts := DefaultOptions()
+	opts.ForwardingFilter = &ForwardingFilter{Action: "deny"}
+	c := NewConnection(s.URL(), "sora", opts)
+	if err := c.Connect(); err == nil {
+		c.Disconnect()
+		t.Fatal("expected error")
+	}
+
+	// 不正な転送フィルターは Sora に接続する前にエラーになる
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sessions) != 0 {
+		t.Errorf("unexpected sessions: %d", len(s.sessions))
+	}
+}
@@ -0,0 +1,255 @@
+package sora
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp"
+	"github.com/pion/webrtc/v2"
+)
+
+// RTP ヘッダー拡張の URI です。ConnectionOptions.HeaderExtensions に指定します。
+const (
+	HeaderExtensionAudioLevel       = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+	HeaderExtensionAbsSendTime      = "http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time"
+	HeaderExtensionTransportCC      = "http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01"
+	HeaderExtensionVideoOrientation = "urn:3gpp:video-orientation"
+	HeaderExtensionMID              = "urn:ietf:params:rtp-hdrext:sdes:mid"
+	HeaderExtensionRID              = "urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id"
+	HeaderExtensionRepairedRID      = "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id"
+)
+
+// DefaultHeaderExtensions は ConnectionOptions.HeaderExtensions が nil の場合に使う RTP ヘッダー拡張を返します。
+// 受信した値を読むだけで、pion/webrtc v2 の送受信の動作を変えない audio-level と video-orientation だけを含みます。
+// abs-send-time, transport-cc, mid, rid などは Sora の帯域推定やパケットの扱いが変わるので、必要な場合は明示的に指定してください。
+func DefaultHeaderExtensions() []string {
+	return []string{
+		HeaderExtensionAudioLevel,
+		HeaderExtensionVideoOrientation,
+	}
+}
+
+// VideoOrientation は映像の向き (urn:3gpp:video-orientation) です。
+type VideoOrientation struct {
+	// Rotation は時計回りの回転角度。0, 90, 180, 270 のいずれかです
+	Rotation uint16
+	// Flip は左右反転しているかどうか
+	Flip bool
+	// Camera は背面カメラかどうか
+	Camera bool
+}
+
+// Marshal は 1 バイトの video-orientation の値を返します。
+func (o VideoOrientation) Marshal() []byte {
+	b := byte(o.Rotation/90) & 0x03
+	if o.Flip {
+		b |= 0x04
+	}
+	if o.Camera {
+		b |= 0x08
+	}
+	return []byte{b}
+}
+
+// Unmarshal は video-orientation の値をパースします。
+func (o *VideoOrientation) Unmarshal(data []byte) error {
+	if len(data) < 1 {
+		return errorInvalidHeaderExtension
+	}
+	o.Rotation = uint16(data[0]&0x03) * 90
+	o.Flip = data[0]&0x04 != 0
+	o.Camera = data[0]&0x08 != 0
+	return nil
+}
+
+// HeaderExtensions は受信した RTP パケットの、ネゴシエーションした RTP ヘッダー拡張の値です。
+// パケットに含まれていないものは nil または空文字列です。
+type HeaderExtensions struct {
+	AudioLevel       *rtp.AudioLevelExtension
+	AbsSendTime      *rtp.AbsSendTimeExtension
+	TransportCC      *rtp.TransportCCExtension
+	VideoOrientation *VideoOrientation
+	MID              string
+	RID              string
+	RepairedRID      string
+}
+
+// headerExtensionIDs はネゴシエーションした RTP ヘッダー拡張の URI と ID の対応です。
+type headerExtensionIDs map[string]uint8
+
+// parse は packet から RTP ヘッダー拡張の値を取り出します。
+func (ids headerExtensionIDs) parse(packet *rtp.Packet) HeaderExtensions {
+	var e HeaderExtensions
+	if packet == nil || !packet.Extension {
+		return e
+	}
+
+	payload := func(uri string) []byte {
+		id, ok := ids[uri]
+		if !ok {
+			return nil
+		}
+		return packet.GetExtension(id)
+	}
+
+	if b := payload(HeaderExtensionAudioLevel); b != nil {
+		v := &rtp.AudioLevelExtension{}
+		if v.Unmarshal(b) == nil {
+			e.AudioLevel = v
+		}
+	}
+	if b := payload(HeaderExtensionAbsSendTime); b != nil {
+		v := &rtp.AbsSendTimeExtension{}
+		if v.Unmarshal(b) == nil {
+			e.AbsSendTime = v
+		}
+	}
+	if b := payload(HeaderExtensionTransportCC); b != nil {
+		v := &rtp.TransportCCExtension{}
+		if v.Unmarshal(b) == nil {
+			e.TransportCC = v
+		}
+	}
+	if b := payload(HeaderExtensionVideoOrientation); b != nil {
+		v := &VideoOrientation{}
+		if v.Unmarshal(b) == nil {
+			e.VideoOrientation = v
+		}
+	}
+	e.MID = string(payload(HeaderExtensionMID))
+	e.RID = string(payload(HeaderExtensionRID))
+	e.RepairedRID = string(payload(HeaderExtensionRepairedRID))
+	return e
+}
+
+// parseHeaderExtensionIDs は offer の a=extmap から、enabled に含まれる RTP ヘッダー拡張の ID をメディアの種類ごとに返します。
+func parseHeaderExtensionIDs(raw string, enabled []string) (map[webrtc.RTPCodecType]headerExtensionIDs, error) {
+	sd := sdp.SessionDescription{}
+	if err := sd.Unmarshal(raw); err != nil {
+		return nil, err
+	}
+
+	result := map[webrtc.RTPCodecType]headerExtensionIDs{}
+	for _, md := range sd.MediaDescriptions {
+		kind := webrtc.NewRTPCodecType(md.MediaName.Media)
+		if kind == 0 {
+			continue
+		}
+		for _, a := range md.Attributes {
+			if a.Key != "extmap" {
+				continue
+			}
+			fields := strings.Fields(a.Value)
+			if len(fields) < 2 || !containsString(enabled, fields[1]) {
+				continue
+			}
+			// a=extmap:<id>/<direction> <uri> の形式もある
+			id, err := strconv.ParseUint(strings.SplitN(fields[0], "/", 2)[0], 10, 8)
+			if err != nil || id == 0 {
+				continue
+			}
+			if result[kind] == nil {
+				result[kind] = headerExtensionIDs{}
+			}
+			result[kind][fields[1]] = uint8(id)
+		}
+	}
+	return result, nil
+}
+
+// updateHeaderExtensions は offer からネゴシエーションする RTP ヘッダー拡張を決めます。
+func (c *Connection) updateHeaderExtensions(offer string) error {
+	enabled := c.Options.HeaderExtensions
+	if enabled == nil {
+		enabled = DefaultHeaderExtensions()
+	}
+	extensions, err := parseHeaderExtensionIDs(offer, enabled)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.extensions = extensions
+	return nil
+}
+
+// headerExtensionIDs は kind のネゴシエーションした RTP ヘッダー拡張を返します。
+func (c *Connection) headerExtensionIDs(kind webrtc.RTPCodecType) headerExtensionIDs {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.extensions[kind]
+}
+
+// addHeaderExtensions は answer のメディアに、ネゴシエーションした RTP ヘッダー拡張の a=extmap を追加します。
+// pion/webrtc v2 は a=extmap を answer に含めないので、Sora に送信する answer に追加します。
+func (c *Connection) addHeaderExtensions(sd *sdp.SessionDescription) error {
+	for _, md := range sd.MediaDescriptions {
+		kind := webrtc.NewRTPCodecType(md.MediaName.Media)
+		if kind == 0 || md.MediaName.Port.Value == 0 {
+			continue
+		}
+
+		ids := c.headerExtensionIDs(kind)
+		for _, uri := range sortedHeaderExtensions(ids) {
+			exists := false
+			for _, a := range md.Attributes {
+				if fields := strings.Fields(a.Value); a.Key == "extmap" && len(fields) >= 2 && fields[1] == uri {
+					exists = true
+				}
+			}
+			if !exists {
+				md.Attributes = append(md.Attributes, sdp.Attribute{Key: "extmap", Value: strconv.Itoa(int(ids[uri])) + " " + uri})
+			}
+		}
+	}
+	return nil
+}
+
+// sortedHeaderExtensions は ID の順に並べた URI を返します。
+func sortedHeaderExtensions(ids headerExtensionIDs) []string {
+	uris := make([]string, 0, len(ids))
+	for uri := range ids {
+		uris = append(uris, uri)
+	}
+	sort.Slice(uris, func(i, j int) bool { return ids[uris[i]] < ids[uris[j]] })
+	return uris
+}
+
+// HeaderExtensions は受信した packet の RTP ヘッダー拡張の値を返します。OnTrackPacket の中で使えます。
+func (c *Connection) HeaderExtensions(track *webrtc.Track, packet *rtp.Packet) HeaderExtensions {
+	return c.headerExtensionIDs(track.Kind()).parse(packet)
+}
+
+// HeaderExtensionID は kind のメディアでネゴシエーションした uri の RTP ヘッダー拡張の ID を返します。
+func (c *Connection) HeaderExtensionID(kind webrtc.RTPCodecType, uri string) (uint8, bool) {
+	id, ok := c.headerExtensionIDs(kind)[uri]
+	return id, ok
+}
+
+// SetAudioLevel は送信する音声の packet に音声レベル (ssrc-audio-level) を設定します。
+// level は 0 から 127 の -dBov で、voice は音声を含むかどうかです。
+// WriteSample ではパケットを書き換えられないので、パケット化してから設定して WriteRTP で送信してください。
+func (c *Connection) SetAudioLevel(packet *rtp.Packet, level uint8, voice bool) error {
+	id, ok := c.HeaderExtensionID(webrtc.RTPCodecTypeAudio, HeaderExtensionAudioLevel)
+	if !ok {
+		return errorHeaderExtensionNotNegotiated
+	}
+	payload, err := (&rtp.AudioLevelExtension{Level: level, Voice: voice}).Marshal()
+	if err != nil {
+		return err
+	}
+	return packet.SetExtension(id, payload)
+}
+
+// SetVideoOrientation は送信する映像の packet に映像の向き (video-orientation) を設定します。
+// 送信側では、キーフレームの最後のパケットなど向きが変わった時のパケットに設定します。
+func (c *Connection) SetVideoOrientation(packet *rtp.Packet, orientation VideoOrientation) error {
+	id, ok := c.HeaderExtensionID(webrtc.RTPCodecTypeVideo, HeaderExtensionVideoOrientation)
+	if !ok {
+		return errorHeaderExtensionNotNegotiated
+	}
+	return packet.SetExtension(id, orientation.Marshal())
+}
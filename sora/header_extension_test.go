@@ -0,0 +1,185 @@
+package sora
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+func TestParseHeaderExtensionIDs(t *testing.T) {
+	offer := readSDP(t, "offer.sdp")
+
+	got, err := parseHeaderExtensionIDs(offer, DefaultHeaderExtensions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[webrtc.RTPCodecType]headerExtensionIDs{
+		webrtc.RTPCodecTypeAudio: {HeaderExtensionAudioLevel: 1},
+		webrtc.RTPCodecTypeVideo: {HeaderExtensionVideoOrientation: 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected ids: %v", got)
+	}
+
+	// abs-send-time は指定した場合だけネゴシエーションする
+	got, err = parseHeaderExtensionIDs(offer, []string{HeaderExtensionAbsSendTime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[webrtc.RTPCodecType]headerExtensionIDs{
+		webrtc.RTPCodecTypeAudio: {HeaderExtensionAbsSendTime: 2},
+		webrtc.RTPCodecTypeVideo: {HeaderExtensionAbsSendTime: 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected ids: %v", got)
+	}
+
+	// transport-cc は指定した場合だけネゴシエーションする
+	got, err = parseHeaderExtensionIDs(offer, []string{HeaderExtensionTransportCC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[webrtc.RTPCodecTypeVideo][HeaderExtensionTransportCC] != 3 || len(got[webrtc.RTPCodecTypeVideo]) != 1 {
+		t.Errorf("unexpected ids: %v", got)
+	}
+
+	got, err = parseHeaderExtensionIDs("v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=extmap:5/recvonly urn:ietf:params:rtp-hdrext:ssrc-audio-level\r\n", DefaultHeaderExtensions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[webrtc.RTPCodecTypeAudio][HeaderExtensionAudioLevel] != 5 {
+		t.Errorf("unexpected ids: %v", got)
+	}
+}
+
+func TestHeaderExtensionsParse(t *testing.T) {
+	ids := headerExtensionIDs{
+		HeaderExtensionAudioLevel:       1,
+		HeaderExtensionAbsSendTime:      2,
+		HeaderExtensionVideoOrientation: 4,
+		HeaderExtensionMID:              5,
+	}
+
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 111, SSRC: 1}, Payload: []byte{0x00}}
+	level, _ := (&rtp.AudioLevelExtension{Level: 42, Voice: true}).Marshal()
+	absSendTime, _ := (&rtp.AbsSendTimeExtension{Timestamp: 0x123456}).Marshal()
+	for id, payload := range map[uint8][]byte{
+		1: level,
+		2: absSendTime,
+		4: VideoOrientation{Rotation: 270, Flip: true}.Marshal(),
+		5: []byte("1"),
+	} {
+		if err := packet.SetExtension(id, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 受信したパケットと同じく、バイト列からパースしたものを使う
+	raw, err := packet.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := &rtp.Packet{}
+	if err := received.Unmarshal(raw); err != nil {
+		t.Fatal(err)
+	}
+
+	e := ids.parse(received)
+	if e.AudioLevel == nil || e.AudioLevel.Level != 42 || !e.AudioLevel.Voice {
+		t.Errorf("unexpected audio level: %+v", e.AudioLevel)
+	}
+	if e.AbsSendTime == nil || e.AbsSendTime.Timestamp != 0x123456 {
+		t.Errorf("unexpected abs-send-time: %+v", e.AbsSendTime)
+	}
+	if e.VideoOrientation == nil || *e.VideoOrientation != (VideoOrientation{Rotation: 270, Flip: true}) {
+		t.Errorf("unexpected video orientation: %+v", e.VideoOrientation)
+	}
+	if e.MID != "1" || e.RID != "" || e.TransportCC != nil {
+		t.Errorf("unexpected extensions: %+v", e)
+	}
+
+	// ネゴシエーションしていない ID は無視する
+	if e := (headerExtensionIDs{}).parse(received); e.AudioLevel != nil || e.MID != "" {
+		t.Errorf("unexpected extensions: %+v", e)
+	}
+}
+
+func TestSetHeaderExtensions(t *testing.T) {
+	c := NewConnection("ws://127.0.0.1/signaling", "sora", nil)
+
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2}}
+	if err := c.SetAudioLevel(packet, 10, true); err != errorHeaderExtensionNotNegotiated {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	c.extensions = map[webrtc.RTPCodecType]headerExtensionIDs{
+		webrtc.RTPCodecTypeAudio: {HeaderExtensionAudioLevel: 1},
+		webrtc.RTPCodecTypeVideo: {HeaderExtensionVideoOrientation: 4},
+	}
+	if err := c.SetAudioLevel(packet, 10, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetAudioLevel(packet, 128, true); err == nil {
+		t.Error("expected error for level 128")
+	}
+	if err := c.SetVideoOrientation(packet, VideoOrientation{Rotation: 90, Camera: true}); err != nil {
+		t.Fatal(err)
+	}
+	if b := packet.GetExtension(1); len(b) != 1 || b[0] != 0x80|10 {
+		t.Errorf("unexpected audio level: %v", b)
+	}
+	if b := packet.GetExtension(4); len(b) != 1 || b[0] != 0x09 {
+		t.Errorf("unexpected video orientation: %v", b)
+	}
+}
+
+func TestHeaderExtensionsNegotiation(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+	s.headerExtensions = map[string]uint8{
+		HeaderExtensionAudioLevel:  1,
+		HeaderExtensionAbsSendTime: 2,
+		HeaderExtensionTransportCC: 3,
+	}
+
+	opts := DefaultOptions()
+	opts.Multistream = true
+	c := NewConnection(s.URL(), "sora", opts)
+	defer c.Disconnect()
+
+	levels := make(chan *rtp.AudioLevelExtension, 1)
+	c.OnTrackPacket(func(track *webrtc.Track, packet *rtp.Packet) {
+		if e := c.HeaderExtensions(track, packet); e.AudioLevel != nil {
+			select {
+			case levels <- e.AudioLevel:
+			default:
+			}
+		}
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	// answer には既定でネゴシエーションするものだけが含まれる
+	answer, _ := s.session(0).expect("answer")["sdp"].(string)
+	if !strings.Contains(answer, "a=extmap:1 "+HeaderExtensionAudioLevel+"\r\n") {
+		t.Errorf("expected audio level extmap in answer:\n%s", answer)
+	}
+	for _, uri := range []string{HeaderExtensionAbsSendTime, HeaderExtensionTransportCC} {
+		if strings.Contains(answer, uri) {
+			t.Errorf("unexpected %s extmap in answer:\n%s", uri, answer)
+		}
+	}
+
+	select {
+	case level := <-levels:
+		if level.Level != 30 || !level.Voice {
+			t.Errorf("unexpected audio level: %+v", level)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for audio level")
+	}
+}
@@ -0,0 +1,298 @@
+package sora
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	defaultReconnectUnstableLevel = 2
+	defaultMaxReconnects          = 3
+	defaultReconnectResetAfter    = time.Minute
+)
+
+// ICEOptions はクライアント側で適用する ICE の設定です。
+// offer で Sora から通知された iceServers と iceTransportPolicy に対して適用します。
+type ICEOptions struct {
+	// RelayOnly を true にすると TURN サーバー経由の候補だけを使います
+	RelayOnly bool
+
+	// TURNTCPOnly を true にすると TCP で接続する TURN サーバーだけを使います。RelayOnly も有効になります
+	TURNTCPOnly bool
+
+	// TURNTLSOnly を true にすると TLS で接続する TURN サーバーだけを使います。RelayOnly も有効になります
+	TURNTLSOnly bool
+
+	// CandidateFilter は ICE 候補を使うかどうかを返します。
+	// false を返したリモートの候補は offer の SDP から取り除き、ローカルの候補は Sora に送りません
+	CandidateFilter func(candidate webrtc.ICECandidate) bool
+
+	// ReconnectOnUnstable を true にすると、network.status で不安定と通知された時に Sora に接続し直します。
+	// pion/webrtc v2 は ICE restart に対応していないため、ICE restart ではなく新しい WebSocket と PeerConnection でシグナリングからやり直します。
+	// コネクション ID は変わり、受信していたトラック、ストリーム、参加者はすべて取り除かれたものとして通知してから、改めて追加されたものとして通知します
+	ReconnectOnUnstable bool
+
+	// ReconnectUnstableLevel は接続し直す unstable_level の下限。0 の場合は 2
+	ReconnectUnstableLevel int
+
+	// MaxReconnects は続けて接続し直す回数の上限。0 の場合は 3
+	MaxReconnects int
+
+	// ReconnectResetAfter は最後に接続し直してから、接続し直した回数を 0 に戻すまでの時間。0 の場合は 1 分
+	ReconnectResetAfter time.Duration
+}
+
+// iceOptions は ConnectionOptions.ICE に Metadata の turn_tcp_only, turn_tls_only を反映した設定を返します。
+func (c *Connection) iceOptions() ICEOptions {
+	var o ICEOptions
+	if c.Options.ICE != nil {
+		o = *c.Options.ICE
+	}
+	if m := c.Options.Metadata; m != nil && metadataValue(c.Options.RawMetadata) == nil {
+		o.TURNTCPOnly = o.TURNTCPOnly || m.TurnTCPOnly
+		o.TURNTLSOnly = o.TURNTLSOnly || m.TurnTLSOnly
+	}
+	if o.TURNTCPOnly || o.TURNTLSOnly {
+		o.RelayOnly = true
+	}
+	if o.ReconnectUnstableLevel <= 0 {
+		o.ReconnectUnstableLevel = defaultReconnectUnstableLevel
+	}
+	if o.MaxReconnects <= 0 {
+		o.MaxReconnects = defaultMaxReconnects
+	}
+	if o.ReconnectResetAfter <= 0 {
+		o.ReconnectResetAfter = defaultReconnectResetAfter
+	}
+	return o
+}
+
+// apply は offer の iceServers と iceTransportPolicy に ICE の設定を適用します。
+func (o ICEOptions) apply(servers []webrtc.ICEServer, policy webrtc.ICETransportPolicy) ([]webrtc.ICEServer, webrtc.ICETransportPolicy, error) {
+	if o.RelayOnly {
+		policy = webrtc.ICETransportPolicyRelay
+	}
+	if !o.TURNTCPOnly && !o.TURNTLSOnly {
+		return servers, policy, nil
+	}
+
+	var filtered []webrtc.ICEServer
+	for _, server := range servers {
+		var urls []string
+		for _, u := range server.URLs {
+			if o.allowTURNURL(u) {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) == 0 {
+			continue
+		}
+		server.URLs = urls
+		filtered = append(filtered, server)
+	}
+
+	if len(filtered) == 0 {
+		return nil, policy, fmt.Errorf("no TURN server available (turn_tcp_only: %t, turn_tls_only: %t)", o.TURNTCPOnly, o.TURNTLSOnly)
+	}
+	return filtered, policy, nil
+}
+
+// allowTURNURL は TURN の URL が TCP、TLS のみの設定で使えるかを返します。
+// turns: は transport の指定がなければ TLS、turn: は transport=tcp の場合だけ TCP で接続します。
+func (o ICEOptions) allowTURNURL(u string) bool {
+	scheme := u
+	if i := strings.Index(u, ":"); i >= 0 {
+		scheme = u[:i]
+	}
+	transport := "udp"
+	if i := strings.Index(u, "?transport="); i >= 0 {
+		transport = strings.ToLower(u[i+len("?transport="):])
+	} else if scheme == "turns" {
+		transport = "tcp"
+	}
+
+	switch scheme {
+	case "turns":
+		return transport == "tcp"
+	case "turn":
+		return o.TURNTCPOnly && !o.TURNTLSOnly && transport == "tcp"
+	}
+	return false
+}
+
+// allowCandidate は CandidateFilter で候補を使うかどうかを返します。
+func (o ICEOptions) allowCandidate(candidate webrtc.ICECandidate) bool {
+	if o.CandidateFilter == nil {
+		return true
+	}
+	return o.CandidateFilter(candidate)
+}
+
+// filterCandidates は SDP から CandidateFilter で除外された a=candidate 行を取り除きます。
+func (o ICEOptions) filterCandidates(sdp string) string {
+	if o.CandidateFilter == nil {
+		return sdp
+	}
+
+	lines := strings.SplitAfter(sdp, "\n")
+	filtered := lines[:0]
+	for _, line := range lines {
+		value := strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(value, "a=candidate:") {
+			candidate, err := parseICECandidate(strings.TrimPrefix(value, "a=candidate:"))
+			if err == nil && !o.CandidateFilter(candidate) {
+				continue
+			}
+		}
+		filtered = append(filtered, line)
+	}
+	return strings.Join(filtered, "")
+}
+
+// parseICECandidate は a=candidate の値を webrtc.ICECandidate に変換します。
+// <foundation> <component> <protocol> <priority> <address> <port> typ <type> [raddr <address>] [rport <port>] ...
+func parseICECandidate(value string) (webrtc.ICECandidate, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 8 || fields[6] != "typ" {
+		return webrtc.ICECandidate{}, fmt.Errorf("invalid candidate '%s'", value)
+	}
+
+	component, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return webrtc.ICECandidate{}, err
+	}
+	protocol, err := webrtc.NewICEProtocol(fields[2])
+	if err != nil {
+		return webrtc.ICECandidate{}, err
+	}
+	priority, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return webrtc.ICECandidate{}, err
+	}
+	port, err := strconv.ParseUint(fields[5], 10, 16)
+	if err != nil {
+		return webrtc.ICECandidate{}, err
+	}
+	typ, err := webrtc.NewICECandidateType(fields[7])
+	if err != nil {
+		return webrtc.ICECandidate{}, err
+	}
+
+	candidate := webrtc.ICECandidate{
+		Foundation: fields[0],
+		Component:  uint16(component),
+		Protocol:   protocol,
+		Priority:   uint32(priority),
+		Address:    fields[4],
+		Port:       uint16(port),
+		Typ:        typ,
+	}
+	for i := 8; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "raddr":
+			candidate.RelatedAddress = fields[i+1]
+		case "rport":
+			if p, err := strconv.ParseUint(fields[i+1], 10, 16); err == nil {
+				candidate.RelatedPort = uint16(p)
+			}
+		}
+	}
+	return candidate, nil
+}
+
+// shouldReconnect は network.status の unstable_level で Sora に接続し直すかどうかを返します。
+// 最後に接続し直してから ReconnectResetAfter が経っている場合は、接続し直した回数を 0 に戻します。
+func (c *Connection) shouldReconnect(unstableLevel int) bool {
+	o := c.iceOptions()
+	if !o.ReconnectOnUnstable || unstableLevel < o.ReconnectUnstableLevel {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reconnects > 0 && time.Since(c.lastReconnect) >= o.ReconnectResetAfter {
+		c.reconnects = 0
+	}
+	return c.reconnects < o.MaxReconnects
+}
+
+// reconnect は WebSocket と PeerConnection を閉じて、シグナリングから Sora に接続し直します。
+// シグナリングの goroutine を止めないよう、別の goroutine で呼び出します。
+// done は接続し直すと判断した時のシグナリングのもので、その後に切断したか、すでに接続し直していた場合は何もしません。
+// 登録されたコールバック関数はそのまま使い、接続済みのトラック、ストリーム、参加者は取り除かれたものとして通知します。
+func (c *Connection) reconnect(done chan struct{}) error {
+	c.closeMu.Lock()
+	c.mu.Lock()
+	current := c.done == done
+	if current {
+		c.reconnects++
+		c.lastReconnect = time.Now()
+	}
+	reconnects := c.reconnects
+	closes := c.closes
+	c.mu.Unlock()
+	if !current {
+		c.closeMu.Unlock()
+		return nil
+	}
+	c.trace("reconnect (%d)", reconnects)
+	c.closeTransport("RECONNECT")
+	c.closeMu.Unlock()
+
+	c.streamsMu.Lock()
+	streams := c.streams
+	c.streams = map[string]*RemoteStream{}
+	c.streamsMu.Unlock()
+	for _, s := range streams {
+		for _, track := range s.Tracks() {
+			c.trackRemoved(track)
+		}
+		c.handlers().onStreamRemovedHandler(s)
+	}
+	for _, p := range c.roster.Participants() {
+		if _, ok := c.roster.leave(p.ConnectionID); ok {
+			c.handlers().onParticipantLeftHandler(p)
+		}
+		c.removeSpeaker(p.ConnectionID)
+	}
+
+	c.mu.Lock()
+	closed := c.closes != closes
+	if !closed {
+		c.connectionID = ""
+		c.clientID = ""
+		c.connectionState = webrtc.ICEConnectionStateNew
+		c.e2ee = nil
+		c.e2eePending = nil
+		c.sessionInfo = nil
+	}
+	c.mu.Unlock()
+	if closed {
+		// 接続し直している間に Close か Disconnect された
+		c.trace("closed while reconnecting")
+		return nil
+	}
+	// ネットワークを待つ間 closeMu を持っていると Close が待たされるので、close の回数で切断を検出します
+	err := c.signaling(closes)
+	if errors.Is(err, errorClosed) {
+		c.trace("closed while reconnecting")
+		return nil
+	}
+
+	if err != nil {
+		onDisconnect := c.handlers().onDisconnectHandler
+
+		// 接続し直す前に閉じているので、disconnect ではなく直接 OnDisconnect を呼び出します
+		c.close("RECONNECT-ERROR")
+		c.endEvents(&DisconnectedEvent{Reason: "RECONNECT-ERROR", Err: err})
+		c.resetHandlers()
+		c.onDisconnect(onDisconnect, "RECONNECT-ERROR", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package sora
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+func TestICEOptionsApply(t *testing.T) {
+	servers := []webrtc.ICEServer{
+		{URLs: []string{"stun:sora.example.com:3478"}},
+		{
+			URLs: []string{
+				"turn:sora.example.com:3478?transport=udp",
+				"turn:sora.example.com:3478?transport=tcp",
+				"turns:sora.example.com:5349?transport=tcp",
+			},
+			Username:   "user",
+			Credential: "pass",
+		},
+	}
+
+	cases := []struct {
+		name     string
+		options  ICEOptions
+		urls     []string
+		policy   webrtc.ICETransportPolicy
+		hasError bool
+	}{
+		{
+			name:   "default",
+			urls:   []string{"stun:sora.example.com:3478", "turn:sora.example.com:3478?transport=udp", "turn:sora.example.com:3478?transport=tcp", "turns:sora.example.com:5349?transport=tcp"},
+			policy: webrtc.ICETransportPolicyAll,
+		},
+		{
+			name:    "relay only",
+			options: ICEOptions{RelayOnly: true},
+			urls:    []string{"stun:sora.example.com:3478", "turn:sora.example.com:3478?transport=udp", "turn:sora.example.com:3478?transport=tcp", "turns:sora.example.com:5349?transport=tcp"},
+			policy:  webrtc.ICETransportPolicyRelay,
+		},
+		{
+			name:    "TCP only",
+			options: ICEOptions{TURNTCPOnly: true, RelayOnly: true},
+			urls:    []string{"turn:sora.example.com:3478?transport=tcp", "turns:sora.example.com:5349?transport=tcp"},
+			policy:  webrtc.ICETransportPolicyRelay,
+		},
+		{
+			name:    "TLS only",
+			options: ICEOptions{TURNTLSOnly: true, RelayOnly: true},
+			urls:    []string{"turns:sora.example.com:5349?transport=tcp"},
+			policy:  webrtc.ICETransportPolicyRelay,
+		},
+	}
+
+	for _, c := range cases {
+		got, policy, err := c.options.apply(servers, webrtc.ICETransportPolicyAll)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		var urls []string
+		for _, s := range got {
+			urls = append(urls, s.URLs...)
+			if s.Username != "" && s.Username != "user" {
+				t.Errorf("%s: unexpected username: %s", c.name, s.Username)
+			}
+		}
+		if !reflect.DeepEqual(urls, c.urls) {
+			t.Errorf("%s: expected %v, but got %v", c.name, c.urls, urls)
+		}
+		if policy != c.policy {
+			t.Errorf("%s: expected %s, but got %s", c.name, c.policy, policy)
+		}
+	}
+
+	if _, _, err := (ICEOptions{TURNTLSOnly: true}).apply(servers[:1], webrtc.ICETransportPolicyAll); err == nil {
+		t.Error("expected error when no TURN server is available")
+	}
+}
+
+func TestICEOptionsFromMetadata(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Metadata = &Metadata{TurnTCPOnly: true}
+	c := NewConnection("ws://localhost/signaling", "sora", opts)
+
+	o := c.iceOptions()
+	if !o.TURNTCPOnly || o.TURNTLSOnly || !o.RelayOnly {
+		t.Errorf("unexpected ICE options: %+v", o)
+	}
+}
+
+func TestFilterCandidates(t *testing.T) {
+	sdp := "v=0\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+		"a=candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host\r\n" +
+		"a=candidate:2 1 tcp 1671430143 192.0.2.1 9 typ host tcptype passive\r\n" +
+		"a=candidate:3 1 udp 16777215 203.0.113.1 60000 typ relay raddr 192.0.2.1 rport 50000\r\n" +
+		"a=end-of-candidates\r\n"
+
+	var seen []webrtc.ICECandidate
+	o := ICEOptions{
+		CandidateFilter: func(c webrtc.ICECandidate) bool {
+			seen = append(seen, c)
+			return c.Protocol == webrtc.ICEProtocolUDP && c.Typ == webrtc.ICECandidateTypeRelay
+		},
+	}
+
+	got := o.filterCandidates(sdp)
+	expected := "v=0\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+		"a=candidate:3 1 udp 16777215 203.0.113.1 60000 typ relay raddr 192.0.2.1 rport 50000\r\n" +
+		"a=end-of-candidates\r\n"
+	if got != expected {
+		t.Errorf("expected %q, but got %q", expected, got)
+	}
+
+	if len(seen) != 3 {
+		t.Fatalf("expected 3 candidates, but got %d", len(seen))
+	}
+	relay := webrtc.ICECandidate{
+		Foundation:     "3",
+		Priority:       16777215,
+		Address:        "203.0.113.1",
+		Protocol:       webrtc.ICEProtocolUDP,
+		Port:           60000,
+		Typ:            webrtc.ICECandidateTypeRelay,
+		Component:      1,
+		RelatedAddress: "192.0.2.1",
+		RelatedPort:    50000,
+	}
+	if seen[2] != relay {
+		t.Errorf("expected %+v, but got %+v", relay, seen[2])
+	}
+}
+
+func TestReconnectOnUnstableNetwork(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+	opts := DefaultOptions()
+	opts.Multistream = true
+	opts.ICE = &ICEOptions{ReconnectOnUnstable: true, MaxReconnects: 1}
+	c := NewConnection(s.URL(), "sora", opts)
+	defer c.Disconnect()
+
+	connected := make(chan struct{}, 2)
+	tracks := make(chan *webrtc.Track, 4)
+	c.OnTrack(func(track *webrtc.Track) { tracks <- track })
+	removed := make(chan *webrtc.Track, 4)
+	disconnected := make(chan string, 1)
+	c.OnConnect(func() { connected <- struct{}{} })
+	c.OnTrackRemoved(func(track *webrtc.Track) { removed <- track })
+	c.OnDisconnect(func(reason string, err error) { disconnected <- reason })
+
+	waitConnected := func() {
+		t.Helper()
+		select {
+		case <-connected:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for connect")
+		}
+	}
+
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	waitConnected()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-tracks:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for tracks")
+		}
+	}
+
+	// unstable_level が下限に届かない場合は接続し直さない
+	ss := s.session(0)
+	if err := ss.send(map[string]interface{}{"type": "notify", "event_type": "network.status", "unstable_level": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.send(map[string]interface{}{"type": "notify", "event_type": "network.status", "unstable_level": 3}); err != nil {
+		t.Fatal(err)
+	}
+	ss.expect("disconnect")
+
+	// 新しい接続でシグナリングからやり直し、以前のトラックは取り除かれたものとして通知される
+	if s.session(1) == nil {
+		t.Fatal("expected a new session")
+	}
+	waitConnected()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-removed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for track removal")
+		}
+	}
+	select {
+	case reason := <-disconnected:
+		t.Fatalf("unexpected disconnect: %s", reason)
+	default:
+	}
+
+	// MaxReconnects を超えて接続し直さない
+	if err := s.session(1).send(map[string]interface{}{"type": "notify", "event_type": "network.status", "unstable_level": 3}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	s.mu.Lock()
+	sessions := len(s.sessions)
+	s.mu.Unlock()
+	if sessions != 2 {
+		t.Errorf("expected 2 sessions, but got %d", sessions)
+	}
+	if !strings.HasPrefix(c.ConnectionID(), "fake-") {
+		t.Errorf("unexpected connection ID: %s", c.ConnectionID())
+	}
+}
+
+func TestCloseWhileReconnecting(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+	hold := make(chan struct{})
+	t.Cleanup(func() { close(hold) })
+
+	opts := DefaultOptions()
+	opts.Multistream = true
+	opts.ICE = &ICEOptions{ReconnectOnUnstable: true, MaxReconnects: 1}
+	c := NewConnection(s.URL(), "sora", opts)
+	connected := make(chan struct{}, 1)
+	c.OnConnect(func() { connected <- struct{}{} })
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for connect")
+	}
+
+	// 接続し直す WebSocket のハンドシェイクが終わらない間に Close する
+	s.mu.Lock()
+	s.holdHandshake = hold
+	s.mu.Unlock()
+	ss := s.session(0)
+	if err := ss.send(map[string]interface{}{"type": "notify", "event_type": "network.status", "unstable_level": 3}); err != nil {
+		t.Fatal(err)
+	}
+	ss.expect("disconnect")
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout/2)
+	defer cancel()
+	if err := c.Close(ctx, ""); err != nil {
+		t.Fatalf("Close was blocked by reconnecting: %v", err)
+	}
+	if c.websocket() != nil || c.PeerConnection() != nil {
+		t.Error("expected no connection after Close")
+	}
+}
+
+func TestShouldReconnect(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ICE = &ICEOptions{ReconnectOnUnstable: true, MaxReconnects: 1, ReconnectResetAfter: time.Minute}
+	c := NewConnection("ws://127.0.0.1/signaling", "sora", opts)
+
+	if c.shouldReconnect(1) {
+		t.Error("expected no reconnect below ReconnectUnstableLevel")
+	}
+	if !c.shouldReconnect(2) {
+		t.Error("expected reconnect")
+	}
+
+	c.reconnects = 1
+	c.lastReconnect = time.Now()
+	if c.shouldReconnect(3) {
+		t.Error("expected no reconnect over MaxReconnects")
+	}
+
+	// ReconnectResetAfter の間接続し直さなかった場合は、回数を 0 に戻す
+	c.lastReconnect = time.Now().Add(-time.Minute)
+	if !c.shouldReconnect(3) {
+		t.Error("expected reconnect after ReconnectResetAfter")
+	}
+	if c.reconnects != 0 {
+		t.Errorf("expected reconnects to be reset, but got %d", c.reconnects)
+	}
+}
@@ -0,0 +1,275 @@
+package sora
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	defaultStallTimeout     = 2 * time.Second
+	defaultFreezeTimeout    = time.Second
+	defaultSilenceTimeout   = time.Second
+	defaultLivenessInterval = 250 * time.Millisecond
+
+	// dtxPayloadSize は Opus の DTX で送られるパケットのペイロードの最大サイズです。
+	// libwebrtc は 2 バイト以下のフレームを DTX として扱い、400ms ごとに 1 つだけ送信します
+	dtxPayloadSize = 2
+)
+
+// StallReason はトラックが止まったと判定した理由です。
+type StallReason string
+
+const (
+	// StallReasonNoPackets は StallTimeout の間 RTP パケットが届いていないことを表します
+	StallReasonNoPackets StallReason = "no-packets"
+
+	// StallReasonVideoFrozen は映像のパケットは届いているが、FreezeTimeout の間フレームが揃っていないことを表します
+	StallReasonVideoFrozen StallReason = "video-frozen"
+
+	// StallReasonAudioDTX は音声の DTX のパケットだけが SilenceTimeout の間届いていることを表します。ミュートや無音の場合も含みます
+	StallReasonAudioDTX StallReason = "audio-dtx"
+)
+
+// LivenessOptions は受信しているトラックが止まっていないかを監視する設定です。
+// 配信者のネットワークが切れても Track の ReadRTP は待ち続けるだけなので、一定時間パケットが届かない場合などに OnTrackStalled を呼び出します。
+type LivenessOptions struct {
+	// StallTimeout は RTP パケットが届かない場合に止まったと判定するまでの時間。0 の場合は 2 秒
+	// DTX の音声は 400ms ごとにしかパケットが届かないので、それより長くしてください
+	StallTimeout time.Duration
+
+	// FreezeTimeout は映像のフレームが揃わない場合に止まったと判定するまでの時間。0 の場合は 1 秒
+	// マーカービットが立ったパケットを受信した時にフレームが揃ったとみなします
+	FreezeTimeout time.Duration
+
+	// SilenceTimeout は音声が DTX のパケットだけになった場合に止まったと判定するまでの時間。0 の場合は 1 秒
+	SilenceTimeout time.Duration
+
+	// Interval はトラックを確認する間隔。0 の場合は 250ms
+	Interval time.Duration
+}
+
+func (o LivenessOptions) withDefaults() LivenessOptions {
+	if o.StallTimeout <= 0 {
+		o.StallTimeout = defaultStallTimeout
+	}
+	if o.FreezeTimeout <= 0 {
+		o.FreezeTimeout = defaultFreezeTimeout
+	}
+	if o.SilenceTimeout <= 0 {
+		o.SilenceTimeout = defaultSilenceTimeout
+	}
+	if o.Interval <= 0 {
+		o.Interval = defaultLivenessInterval
+	}
+	return o
+}
+
+// TrackStats は受信しているトラックの統計情報です。
+type TrackStats struct {
+	// StreamID はトラックが含まれるストリームの ID で、Sora では配信者のコネクション ID です
+	StreamID string
+	Kind     webrtc.RTPCodecType
+
+	// Packets は受信した RTP パケットの数
+	Packets uint64
+	// Frames は受信した映像のフレームの数。音声の場合は 0 です
+	Frames uint64
+	// LastPacket は最後に RTP パケットを受信した時刻
+	LastPacket time.Time
+
+	// Stalled は止まっていると判定しているかどうかで、StallReason はその理由
+	Stalled     bool
+	StallReason StallReason
+	// Stalls は止まったと判定した回数
+	Stalls uint64
+	// StalledDuration は止まっていた時間の合計。止まっている間は現在までの時間を含みます
+	StalledDuration time.Duration
+}
+
+// livenessChange はトラックが止まったか、再開したかの変化です。
+type livenessChange struct {
+	stalled bool
+	reason  StallReason
+	// duration は再開した場合に、止まっていた時間
+	duration time.Duration
+}
+
+// trackLiveness は 1 つのトラックの受信状況を記録して、止まっているかどうかを判定します。
+type trackLiveness struct {
+	opts LivenessOptions
+	kind webrtc.RTPCodecType
+
+	mu         sync.Mutex
+	packets    uint64
+	frames     uint64
+	lastPacket time.Time
+	// lastFrame は映像のフレームが揃った時刻
+	lastFrame time.Time
+	// lastVoice と lastDTX は音声の通常のパケットと DTX のパケットを受信した時刻
+	lastVoice time.Time
+	lastDTX   time.Time
+
+	reason       StallReason
+	stalledSince time.Time
+	stalls       uint64
+	stalledTotal time.Duration
+}
+
+// newTrackLiveness は now に受信を開始したトラックの trackLiveness を返します。
+func newTrackLiveness(kind webrtc.RTPCodecType, opts LivenessOptions, now time.Time) *trackLiveness {
+	return &trackLiveness{
+		opts:       opts.withDefaults(),
+		kind:       kind,
+		lastPacket: now,
+		lastFrame:  now,
+		lastVoice:  now,
+	}
+}
+
+// observe は now に受信した packet を記録します。
+func (l *trackLiveness) observe(packet *rtp.Packet, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.packets++
+	l.lastPacket = now
+	switch l.kind {
+	case webrtc.RTPCodecTypeVideo:
+		if packet.Marker {
+			l.frames++
+			l.lastFrame = now
+		}
+	case webrtc.RTPCodecTypeAudio:
+		if len(packet.Payload) <= dtxPayloadSize {
+			l.lastDTX = now
+		} else {
+			l.lastVoice = now
+		}
+	}
+}
+
+// check は now の時点で止まっているかどうかを判定し、変化があった場合に返します。
+// 止まっている間に理由が変わった場合は、新しい理由で止まったとして返します。
+func (l *trackLiveness) check(now time.Time) *livenessChange {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var reason StallReason
+	switch {
+	case now.Sub(l.lastPacket) >= l.opts.StallTimeout:
+		reason = StallReasonNoPackets
+	case l.kind == webrtc.RTPCodecTypeVideo && l.lastPacket.After(l.lastFrame) && now.Sub(l.lastFrame) >= l.opts.FreezeTimeout:
+		reason = StallReasonVideoFrozen
+	case l.kind == webrtc.RTPCodecTypeAudio && l.lastDTX.After(l.lastVoice) && now.Sub(l.lastVoice) >= l.opts.SilenceTimeout:
+		reason = StallReasonAudioDTX
+	}
+
+	if reason == l.reason {
+		return nil
+	}
+	previous := l.reason
+	l.reason = reason
+	if reason != "" {
+		if previous == "" {
+			l.stalledSince = now
+			l.stalls++
+		}
+		return &livenessChange{stalled: true, reason: reason}
+	}
+
+	d := now.Sub(l.stalledSince)
+	l.stalledTotal += d
+	l.stalledSince = time.Time{}
+	return &livenessChange{reason: previous, duration: d}
+}
+
+// stats は now の時点の統計情報を返します。
+func (l *trackLiveness) stats(now time.Time) TrackStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := TrackStats{
+		Kind:            l.kind,
+		Packets:         l.packets,
+		Frames:          l.frames,
+		LastPacket:      l.lastPacket,
+		Stalled:         l.reason != "",
+		StallReason:     l.reason,
+		Stalls:          l.stalls,
+		StalledDuration: l.stalledTotal,
+	}
+	if s.Stalled {
+		s.StalledDuration += now.Sub(l.stalledSince)
+	}
+	return s
+}
+
+// startLiveness は LivenessOptions が設定されている場合に、done が閉じられるまで受信しているトラックを監視します。
+func (c *Connection) startLiveness(done chan struct{}) {
+	if c.Options.Liveness == nil {
+		return
+	}
+	opts := c.Options.Liveness.withDefaults()
+
+	c.goroutine(func() {
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				c.checkLiveness(now)
+			}
+		}
+	})
+}
+
+// checkLiveness は受信しているすべてのトラックを判定して、変化があればコールバック関数を呼び出します。
+func (c *Connection) checkLiveness(now time.Time) {
+	c.eventsMu.Lock()
+	tracks := make([]*Track, 0, len(c.tracks))
+	for _, t := range c.tracks {
+		if t.liveness != nil {
+			tracks = append(tracks, t)
+		}
+	}
+	c.eventsMu.Unlock()
+
+	for _, t := range tracks {
+		change := t.liveness.check(now)
+		if change == nil {
+			continue
+		}
+		if change.stalled {
+			c.trace("track stalled: %s (%s)", t.ID(), change.reason)
+			c.handlers().onTrackStalledHandler(t.Track, change.reason)
+			c.emit(&TrackStalledEvent{Track: t, Reason: change.reason})
+		} else {
+			c.trace("track resumed: %s (%s, %s)", t.ID(), change.reason, change.duration)
+			c.handlers().onTrackResumedHandler(t.Track, change.reason, change.duration)
+			c.emit(&TrackResumedEvent{Track: t, Reason: change.reason, Duration: change.duration})
+		}
+	}
+}
+
+// trackStats は LivenessOptions を設定している場合に、受信しているトラックの ID ごとの統計情報を返します。
+func (c *Connection) trackStats() map[string]TrackStats {
+	now := time.Now()
+	stats := map[string]TrackStats{}
+
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+	for track, t := range c.tracks {
+		if t.liveness == nil {
+			continue
+		}
+		s := t.liveness.stats(now)
+		s.StreamID = track.Label()
+		stats[track.ID()] = s
+	}
+	return stats
+}
@@ -0,0 +1,166 @@
+package sora
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+func TestTrackLivenessVideo(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newTrackLiveness(webrtc.RTPCodecTypeVideo, LivenessOptions{StallTimeout: time.Second, FreezeTimeout: 500 * time.Millisecond}, now)
+
+	// 20ms ごとにパケットを受信し、frame パケットごとにフレームが揃う
+	receive := func(d time.Duration, frame int) {
+		for i := 1; i <= int(d/(20*time.Millisecond)); i++ {
+			now = now.Add(20 * time.Millisecond)
+			l.observe(&rtp.Packet{Header: rtp.Header{Marker: frame > 0 && i%frame == 0}, Payload: []byte{0x00, 0x01, 0x02, 0x03}}, now)
+		}
+	}
+
+	receive(time.Second, 3)
+	if change := l.check(now); change != nil {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+
+	// パケットは届いているがフレームが揃わない
+	receive(600*time.Millisecond, 0)
+	if change := l.check(now); change == nil || !change.stalled || change.reason != StallReasonVideoFrozen {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+	if change := l.check(now); change != nil {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+
+	// パケットも届かなくなると理由が変わる
+	now = now.Add(time.Second)
+	if change := l.check(now); change == nil || !change.stalled || change.reason != StallReasonNoPackets {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+
+	// フレームが揃うと再開する
+	receive(100*time.Millisecond, 1)
+	change := l.check(now)
+	if change == nil || change.stalled || change.reason != StallReasonNoPackets || change.duration != 1100*time.Millisecond {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+
+	s := l.stats(now)
+	if s.Stalled || s.Stalls != 1 || s.StalledDuration != 1100*time.Millisecond || s.Packets != 85 || s.Frames != 21 || s.LastPacket != now {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
+
+func TestTrackLivenessAudio(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newTrackLiveness(webrtc.RTPCodecTypeAudio, LivenessOptions{}, now)
+
+	voice := &rtp.Packet{Payload: []byte{0x00, 0x01, 0x02, 0x03}}
+	dtx := &rtp.Packet{Payload: []byte{0x00}}
+
+	for i := 0; i < 50; i++ {
+		now = now.Add(20 * time.Millisecond)
+		l.observe(voice, now)
+	}
+	if change := l.check(now); change != nil {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+
+	// DTX では 400ms ごとにしかパケットが届かないが、パケットが届かないとは判定しない
+	for i := 0; i < 3; i++ {
+		now = now.Add(400 * time.Millisecond)
+		l.observe(dtx, now)
+	}
+	if change := l.check(now); change == nil || !change.stalled || change.reason != StallReasonAudioDTX {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+	if s := l.stats(now.Add(100 * time.Millisecond)); !s.Stalled || s.StallReason != StallReasonAudioDTX || s.StalledDuration != 100*time.Millisecond {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	now = now.Add(20 * time.Millisecond)
+	l.observe(voice, now)
+	if change := l.check(now); change == nil || change.stalled || change.reason != StallReasonAudioDTX {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+
+	// DTX のパケットがないまま途切れた場合は DTX ではない
+	now = now.Add(1500 * time.Millisecond)
+	if change := l.check(now); change != nil {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if change := l.check(now); change == nil || !change.stalled || change.reason != StallReasonNoPackets {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+}
+
+func TestTrackStalled(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Video: true})
+
+	opts := DefaultOptions()
+	opts.Multistream = true
+	opts.Audio = false
+	opts.Liveness = &LivenessOptions{StallTimeout: 300 * time.Millisecond, Interval: 50 * time.Millisecond}
+	c := NewConnection(s.URL(), "sora", opts)
+	defer c.Disconnect()
+
+	stalled := make(chan StallReason, 10)
+	resumed := make(chan time.Duration, 10)
+	c.OnTrackStalled(func(track *webrtc.Track, reason StallReason) {
+		stalled <- reason
+	})
+	c.OnTrackResumed(func(track *webrtc.Track, reason StallReason, d time.Duration) {
+		resumed <- d
+	})
+	events := c.Events()
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	e := waitEvent(t, events, func(e Event) bool { _, ok := e.(*TrackAddedEvent); return ok })
+	track := e.(*TrackAddedEvent).Track
+
+	// フレームを受信してから送信を止める
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().Tracks[track.ID()].Frames == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for frames")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ss := s.session(0)
+	ss.pause(true)
+	select {
+	case reason := <-stalled:
+		if reason != StallReasonNoPackets {
+			t.Errorf("unexpected reason: %s", reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for OnTrackStalled")
+	}
+
+	stats := c.Stats().Tracks[track.ID()]
+	if !stats.Stalled || stats.StallReason != StallReasonNoPackets || stats.StreamID != "publisher-1" || stats.Kind != webrtc.RTPCodecTypeVideo || stats.Frames == 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	ss.pause(false)
+	select {
+	case d := <-resumed:
+		if d <= 0 {
+			t.Errorf("unexpected stalled duration: %s", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for OnTrackResumed")
+	}
+	e = waitEvent(t, events, func(e Event) bool { _, ok := e.(*TrackResumedEvent); return ok })
+	if e.(*TrackResumedEvent).Track != track {
+		t.Errorf("unexpected track: %+v", e)
+	}
+	if stats := c.Stats().Tracks[track.ID()]; stats.Stalled || stats.Stalls != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
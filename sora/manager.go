@@ -0,0 +1,434 @@
+package sora
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRestartBackoff    = time.Second
+	defaultRestartMaxBackoff = 30 * time.Second
+)
+
+// ManagerOptions は Manager の設定です。
+type ManagerOptions struct {
+	// MaxConnections は同時に管理するコネクション数の上限。0 の場合は上限なし
+	// 上限に達している場合、Start は空きができるまで待ちます
+	MaxConnections int
+
+	// MaxConnectionsPerChannel は 1 つのチャネルに同時に接続するコネクション数の上限。0 の場合は上限なし
+	// 上限に達している場合、Start はエラーを返します
+	MaxConnectionsPerChannel int
+}
+
+// RestartPolicy は切断された時の再接続の設定です。
+type RestartPolicy struct {
+	// MaxRestarts は続けて再接続する回数の上限。0 の場合は再接続しません。負の値の場合は上限なし
+	// 接続に成功すると回数はリセットされます
+	MaxRestarts int
+
+	// Backoff は最初の再接続までの待ち時間。再接続のたびに 2 倍になります。0 の場合は 1 秒
+	Backoff time.Duration
+
+	// MaxBackoff は再接続までの待ち時間の上限。0 の場合は 30 秒
+	MaxBackoff time.Duration
+}
+
+func (p RestartPolicy) backoff() (time.Duration, time.Duration) {
+	backoff, maxBackoff := p.Backoff, p.MaxBackoff
+	if backoff <= 0 {
+		backoff = defaultRestartBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRestartMaxBackoff
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff, maxBackoff
+}
+
+// ChannelConfig は Manager で接続するチャネルの設定です。
+type ChannelConfig struct {
+	// 接続する Channel ID
+	ChannelID string
+
+	// Options はコネクションの設定。接続のたびにコピーして使います。nil の場合は DefaultOptions() を使います
+	Options *ConnectionOptions
+
+	// Setup は接続のたびに、Connect を呼び出す前に呼ばれます。コールバック関数の設定に使います
+	Setup func(c *Connection)
+
+	// Restart は切断された時の再接続の設定
+	Restart RestartPolicy
+}
+
+// ManagerEventType は Manager が通知するイベントの種類です。
+type ManagerEventType string
+
+const (
+	// ManagerEventConnected は接続した時のイベント
+	ManagerEventConnected ManagerEventType = "connected"
+
+	// ManagerEventDisconnected は切断された時のイベント
+	ManagerEventDisconnected ManagerEventType = "disconnected"
+
+	// ManagerEventRestarting は再接続を待っている時のイベント
+	ManagerEventRestarting ManagerEventType = "restarting"
+
+	// ManagerEventStopped は再接続をやめて、管理が終了した時のイベント
+	ManagerEventStopped ManagerEventType = "stopped"
+)
+
+// ManagerEvent は Manager が管理するすべてのコネクションのイベントです。
+type ManagerEvent struct {
+	Type         ManagerEventType
+	ChannelID    string
+	ConnectionID string
+
+	// Reason, Err は切断の理由
+	Reason string
+	Err    error
+
+	// Attempt は続けて再接続した回数
+	Attempt int
+}
+
+// Manager は複数のチャネルへの接続を管理します。
+// 同時に接続するコネクション数を制限し、切断されたコネクションを RestartPolicy に従って再接続します。
+type Manager struct {
+	soraURL string
+	options ManagerOptions
+
+	slots chan struct{}
+
+	mu       sync.Mutex
+	closed   bool
+	channels map[string][]*ManagedConnection
+
+	onEventHandler func(event ManagerEvent)
+	callbackMu     sync.Mutex
+
+	wg sync.WaitGroup
+}
+
+// NewManager は soraURL に接続する Manager を生成して返します。
+func NewManager(soraURL string, options *ManagerOptions) *Manager {
+	m := &Manager{
+		soraURL:        soraURL,
+		channels:       map[string][]*ManagedConnection{},
+		onEventHandler: func(event ManagerEvent) {},
+	}
+	if options != nil {
+		m.options = *options
+	}
+	if m.options.MaxConnections > 0 {
+		m.slots = make(chan struct{}, m.options.MaxConnections)
+	}
+	return m
+}
+
+// OnEvent は管理するコネクションのイベント発生時のコールバック関数を設定します。
+func (m *Manager) OnEvent(f func(event ManagerEvent)) {
+	m.callbackMu.Lock()
+	defer m.callbackMu.Unlock()
+	m.onEventHandler = f
+}
+
+func (m *Manager) emit(event ManagerEvent) {
+	m.callbackMu.Lock()
+	f := m.onEventHandler
+	m.callbackMu.Unlock()
+	f(event)
+}
+
+// Start は config のチャネルに接続し、Stop または Shutdown が呼ばれるまで管理します。
+// MaxConnections に達している場合は空きができるか ctx が終了するまで待ちます。
+// Shutdown した後は ErrManagerClosed を、MaxConnectionsPerChannel を超える場合は ErrTooManyConnections を返します。
+func (m *Manager) Start(ctx context.Context, config ChannelConfig) (*ManagedConnection, error) {
+	if m.slots != nil {
+		select {
+		case m.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		m.releaseSlot()
+		return nil, ErrManagerClosed
+	}
+	if n := m.options.MaxConnectionsPerChannel; n > 0 && len(m.channels[config.ChannelID]) >= n {
+		m.releaseSlot()
+		return nil, ErrTooManyConnections
+	}
+
+	mc := &ManagedConnection{
+		manager: m,
+		config:  config,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	m.channels[config.ChannelID] = append(m.channels[config.ChannelID], mc)
+
+	m.wg.Add(1)
+	go mc.run()
+	return mc, nil
+}
+
+// Stop は channelID のチャネルに接続しているコネクションをすべて切断し、管理を終了します。
+func (m *Manager) Stop(channelID string) {
+	for _, mc := range m.Connections(channelID) {
+		mc.Stop()
+	}
+}
+
+// Connections は channelID のチャネルで管理しているコネクションを返します。
+func (m *Manager) Connections(channelID string) []*ManagedConnection {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mcs := make([]*ManagedConnection, len(m.channels[channelID]))
+	copy(mcs, m.channels[channelID])
+	return mcs
+}
+
+// ChannelIDs は管理しているコネクションがあるチャネルの Channel ID を返します。
+func (m *Manager) ChannelIDs() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]string, 0, len(m.channels))
+	for id := range m.channels {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Len は管理しているコネクションの数を返します。
+func (m *Manager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for _, mcs := range m.channels {
+		n += len(mcs)
+	}
+	return n
+}
+
+// Shutdown はすべてのコネクションを切断し、Manager の goroutine とコネクションのシグナリングの goroutine が終了するのを待ちます。
+// ctx が終了した場合は待つのをやめて ctx.Err() を返します。Shutdown 後の Start はエラーになります。
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.closed = true
+	var mcs []*ManagedConnection
+	for _, cs := range m.channels {
+		mcs = append(mcs, cs...)
+	}
+	m.mu.Unlock()
+
+	for _, mc := range mcs {
+		mc.Stop()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Manager) remove(mc *ManagedConnection) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mcs := m.channels[mc.config.ChannelID]
+	for i, c := range mcs {
+		if c == mc {
+			mcs = append(mcs[:i], mcs[i+1:]...)
+			break
+		}
+	}
+	if len(mcs) == 0 {
+		delete(m.channels, mc.config.ChannelID)
+	} else {
+		m.channels[mc.config.ChannelID] = mcs
+	}
+	m.releaseSlot()
+}
+
+func (m *Manager) releaseSlot() {
+	if m.slots != nil {
+		<-m.slots
+	}
+}
+
+// ManagedConnection は Manager が管理する 1 つのコネクションです。
+// 再接続のたびに新しい Connection を生成します。
+type ManagedConnection struct {
+	manager *Manager
+	config  ChannelConfig
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu   sync.Mutex
+	conn *Connection
+}
+
+// ChannelID は接続しているチャネルの Channel ID を返します。
+func (mc *ManagedConnection) ChannelID() string {
+	return mc.config.ChannelID
+}
+
+// Connection は現在の Connection を返します。再接続を待っている間は nil を返します。
+func (mc *ManagedConnection) Connection() *Connection {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.conn
+}
+
+// Stop は切断して再接続をやめます。
+func (mc *ManagedConnection) Stop() {
+	mc.stopOnce.Do(func() {
+		close(mc.stop)
+	})
+}
+
+// Done は管理が終了すると閉じられる channel を返します。
+func (mc *ManagedConnection) Done() <-chan struct{} {
+	return mc.done
+}
+
+func (mc *ManagedConnection) setConnection(c *Connection) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.conn = c
+}
+
+func (mc *ManagedConnection) stopped() bool {
+	select {
+	case <-mc.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (mc *ManagedConnection) run() {
+	m := mc.manager
+	defer func() {
+		m.remove(mc)
+		close(mc.done)
+		m.wg.Done()
+	}()
+
+	backoff, maxBackoff := mc.config.Restart.backoff()
+	initialBackoff := backoff
+	attempt := 0
+
+	for {
+		connected, reason, err := mc.connectOnce(attempt)
+		if connected {
+			attempt = 0
+			backoff = initialBackoff
+		}
+
+		policy := mc.config.Restart
+		if mc.stopped() || (policy.MaxRestarts >= 0 && attempt >= policy.MaxRestarts) {
+			m.emit(ManagerEvent{Type: ManagerEventStopped, ChannelID: mc.config.ChannelID, Reason: reason, Err: err, Attempt: attempt})
+			return
+		}
+
+		attempt++
+		m.emit(ManagerEvent{Type: ManagerEventRestarting, ChannelID: mc.config.ChannelID, Reason: reason, Err: err, Attempt: attempt})
+
+		select {
+		case <-time.After(backoff):
+		case <-mc.stop:
+			m.emit(ManagerEvent{Type: ManagerEventStopped, ChannelID: mc.config.ChannelID, Reason: reason, Err: err, Attempt: attempt})
+			return
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// connectOnce は接続して、切断されるか Stop が呼ばれるまで待ちます。
+// 接続に成功したかどうかと、切断の理由を返します。
+func (mc *ManagedConnection) connectOnce(attempt int) (bool, string, error) {
+	m := mc.manager
+
+	var options ConnectionOptions
+	if mc.config.Options != nil {
+		options = *mc.config.Options
+	} else {
+		options = *DefaultOptions()
+	}
+	c := NewConnection(m.soraURL, mc.config.ChannelID, &options)
+
+	type ended struct {
+		reason string
+		err    error
+	}
+	endedCh := make(chan ended, 1)
+	var connected int32
+	var connectionID atomic.Value
+	connectionID.Store("")
+
+	// Setup で設定されるコールバック関数とは別に登録するので、Setup の中で OnConnect, OnDisconnect を設定し直しても影響しません
+	c.addConnectHook(func() {
+		atomic.StoreInt32(&connected, 1)
+		connectionID.Store(c.ConnectionID())
+		m.emit(ManagerEvent{Type: ManagerEventConnected, ChannelID: mc.config.ChannelID, ConnectionID: c.ConnectionID(), Attempt: attempt})
+	})
+	c.addDisconnectHook(func(reason string, err error) {
+		select {
+		case endedCh <- ended{reason, err}:
+		default:
+		}
+	})
+	if mc.config.Setup != nil {
+		mc.config.Setup(c)
+	}
+
+	mc.setConnection(c)
+	defer mc.setConnection(nil)
+
+	if mc.stopped() {
+		return false, "STOPPED", nil
+	}
+	if err := c.Connect(); err != nil {
+		m.emit(ManagerEvent{Type: ManagerEventDisconnected, ChannelID: mc.config.ChannelID, Reason: "CONNECT-ERROR", Err: err, Attempt: attempt})
+		c.Close(context.Background(), "")
+		return false, "CONNECT-ERROR", err
+	}
+
+	var e ended
+	select {
+	case e = <-endedCh:
+	case <-mc.stop:
+		c.Close(context.Background(), "")
+		e = ended{reason: "STOPPED"}
+	}
+	c.wait(context.Background())
+
+	m.emit(ManagerEvent{Type: ManagerEventDisconnected, ChannelID: mc.config.ChannelID, ConnectionID: connectionID.Load().(string), Reason: e.reason, Err: e.err, Attempt: attempt})
+	return atomic.LoadInt32(&connected) == 1, e.reason, e.err
+}
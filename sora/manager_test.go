@@ -0,0 +1,237 @@
+package sora
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type managerEvents struct {
+	mu     sync.Mutex
+	events []ManagerEvent
+	ch     chan ManagerEvent
+}
+
+func newManagerEvents(m *Manager) *managerEvents {
+	e := &managerEvents{ch: make(chan ManagerEvent, 100)}
+	m.OnEvent(func(event ManagerEvent) {
+		e.mu.Lock()
+		e.events = append(e.events, event)
+		e.mu.Unlock()
+		e.ch <- event
+	})
+	return e
+}
+
+// wait は t のイベントを受け取るまで待ちます。
+func (e *managerEvents) wait(t *testing.T, typ ManagerEventType) ManagerEvent {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event := <-e.ch:
+			if event.Type == typ {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %s event", typ)
+		}
+	}
+}
+
+func TestManagerRestart(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+	m := NewManager(s.URL(), nil)
+	events := newManagerEvents(m)
+
+	var mu sync.Mutex
+	setups := 0
+	mc, err := m.Start(context.Background(), ChannelConfig{
+		ChannelID: "sora",
+		Setup: func(c *Connection) {
+			mu.Lock()
+			setups++
+			mu.Unlock()
+		},
+		Restart: RestartPolicy{MaxRestarts: 1, Backoff: 10 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e := events.wait(t, ManagerEventConnected); e.ChannelID != "sora" || e.ConnectionID != "fake-connection-id" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+
+	// Sora から切断されると再接続する
+	s.session(0).close()
+	if e := events.wait(t, ManagerEventDisconnected); e.Reason != "EXIT-RECV" || e.ConnectionID != "fake-connection-id" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	if e := events.wait(t, ManagerEventRestarting); e.Attempt != 1 {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	events.wait(t, ManagerEventConnected)
+	if s.session(1) == nil {
+		t.Fatal("expected a new session")
+	}
+	if mc.Connection() == nil {
+		t.Error("expected current connection")
+	}
+
+	// 接続に成功すると再接続の回数がリセットされるので、もう一度再接続する
+	s.session(1).close()
+	if e := events.wait(t, ManagerEventRestarting); e.Attempt != 1 {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	events.wait(t, ManagerEventConnected)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if e := events.wait(t, ManagerEventStopped); e.Reason != "STOPPED" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	select {
+	case <-mc.Done():
+	default:
+		t.Error("expected managed connection to be done")
+	}
+	if m.Len() != 0 {
+		t.Errorf("expected no connections, but got %d", m.Len())
+	}
+
+	mu.Lock()
+	if setups != 3 {
+		t.Errorf("expected Setup to be called 3 times, but got %d", setups)
+	}
+	mu.Unlock()
+
+	if _, err := m.Start(context.Background(), ChannelConfig{ChannelID: "sora"}); !errors.Is(err, ErrManagerClosed) {
+		t.Errorf("expected ErrManagerClosed, but got %v", err)
+	}
+}
+
+func TestManagerNoRestart(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+	m := NewManager(s.URL(), nil)
+	events := newManagerEvents(m)
+
+	mc, err := m.Start(context.Background(), ChannelConfig{ChannelID: "sora"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events.wait(t, ManagerEventConnected)
+
+	s.session(0).close()
+	if e := events.wait(t, ManagerEventStopped); e.Reason != "EXIT-RECV" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	<-mc.Done()
+	if m.Len() != 0 {
+		t.Errorf("expected no connections, but got %d", m.Len())
+	}
+}
+
+func TestManagerLimits(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+	m := NewManager(s.URL(), &ManagerOptions{MaxConnections: 2, MaxConnectionsPerChannel: 1})
+	defer m.Shutdown(context.Background())
+
+	a, err := m.Start(context.Background(), ChannelConfig{ChannelID: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Start(context.Background(), ChannelConfig{ChannelID: "a"}); !errors.Is(err, ErrTooManyConnections) {
+		t.Errorf("expected ErrTooManyConnections, but got %v", err)
+	}
+	if _, err := m.Start(context.Background(), ChannelConfig{ChannelID: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 上限に達しているので空きができるまで待つ
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := m.Start(ctx, ChannelConfig{ChannelID: "c"}); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, but got %v", err)
+	}
+
+	started := make(chan error, 1)
+	go func() {
+		_, err := m.Start(context.Background(), ChannelConfig{ChannelID: "c"})
+		started <- err
+	}()
+	m.Stop("a")
+	<-a.Done()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for a free slot")
+	}
+	if got := m.Connections("c"); len(got) != 1 || got[0].ChannelID() != "c" {
+		t.Errorf("unexpected connections: %v", got)
+	}
+}
+
+func TestManagerSetupCallbacksDispatched(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+	m := NewManager(s.URL(), nil)
+	events := newManagerEvents(m)
+
+	opts := DefaultOptions()
+	opts.Dispatch = &DispatchOptions{}
+	connected := make(chan *Connection, 1)
+	disconnected := make(chan string, 1)
+	_, err := m.Start(context.Background(), ChannelConfig{
+		ChannelID: "sora",
+		Options:   opts,
+		Setup: func(c *Connection) {
+			c.OnConnect(func() { connected <- c })
+			c.OnDisconnect(func(reason string, err error) { disconnected <- reason })
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events.wait(t, ManagerEventConnected)
+	var c *Connection
+	select {
+	case c = <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for OnConnect")
+	}
+	// Setup で設定したコールバック関数は Manager に包まれず、そのままキューを経由して呼び出される
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().Callbacks["OnConnect"].Dispatched != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected OnConnect stats: %+v", c.Stats().Callbacks["OnConnect"])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.session(0).close()
+	select {
+	case reason := <-disconnected:
+		if reason != "EXIT-RECV" {
+			t.Errorf("unexpected reason: %s", reason)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for OnDisconnect")
+	}
+	events.wait(t, ManagerEventDisconnected)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,152 @@
+package sora
+
+import (
+	"encoding/json"
+)
+
+// NotifyEvent は Sora から受け取った notify メッセージを event_type ごとの型に変換したものです。
+// 実装は sora パッケージ内の型に限られます。event_type に応じて型スイッチで判別してください。
+type NotifyEvent interface {
+	// NotifyEventType は notify メッセージの event_type を返します。
+	NotifyEventType() string
+
+	notifyEvent()
+}
+
+// ConnectionCreatedEvent は event_type が connection.created の notify イベント
+type ConnectionCreatedEvent struct {
+	SignalingNotifyMessage
+}
+
+// ConnectionUpdatedEvent は event_type が connection.updated の notify イベント
+type ConnectionUpdatedEvent struct {
+	SignalingNotifyMessage
+}
+
+// ConnectionDestroyedEvent は event_type が connection.destroyed の notify イベント
+type ConnectionDestroyedEvent struct {
+	SignalingNotifyMessage
+}
+
+// SpotlightChangedEvent は event_type が spotlight.changed の notify イベント
+type SpotlightChangedEvent struct {
+	SpotlightNotifyMessage
+}
+
+// SpotlightFocusedEvent は event_type が spotlight.focused の notify イベント
+type SpotlightFocusedEvent struct {
+	SpotlightNotifyMessage
+}
+
+// SpotlightUnfocusedEvent は event_type が spotlight.unfocused の notify イベント
+type SpotlightUnfocusedEvent struct {
+	SpotlightNotifyMessage
+}
+
+// NetworkStatusEvent は event_type が network.status の notify イベント
+type NetworkStatusEvent struct {
+	NetworkNotifyMessage
+}
+
+// RecordingStartedEvent は event_type が recording.started の notify イベント
+type RecordingStartedEvent struct {
+	RecordingNotifyMessage
+}
+
+// RecordingStoppedEvent は event_type が recording.stopped の notify イベント
+type RecordingStoppedEvent struct {
+	RecordingNotifyMessage
+}
+
+// AudioMuteChangedEvent は event_type が audio.muted または audio.unmuted の notify イベント
+type AudioMuteChangedEvent struct {
+	MuteNotifyMessage
+}
+
+// VideoMuteChangedEvent は event_type が video.muted または video.unmuted の notify イベント
+type VideoMuteChangedEvent struct {
+	MuteNotifyMessage
+}
+
+// UnknownNotifyEvent は go-sora が知らない event_type の notify イベント
+// 新しいバージョンの Sora が追加したイベントを受け取った場合も、Raw から内容を取り出せます。
+// 知っている event_type でも、型に変換できなかった場合はこのイベントになります。
+//
+// ICE の接続状態は Sora から notify されないので、notify イベントの型はありません。
+// ICE の接続状態の変化は OnConnect や Events() の *StateChangedEvent で、ネットワークの状態は *NetworkStatusEvent で受け取れます。
+type UnknownNotifyEvent struct {
+	EventType string
+	Raw       json.RawMessage
+}
+
+func (e *ConnectionCreatedEvent) NotifyEventType() string   { return e.EventType }
+func (e *ConnectionUpdatedEvent) NotifyEventType() string   { return e.EventType }
+func (e *ConnectionDestroyedEvent) NotifyEventType() string { return e.EventType }
+func (e *SpotlightChangedEvent) NotifyEventType() string    { return e.EventType }
+func (e *SpotlightFocusedEvent) NotifyEventType() string    { return e.EventType }
+func (e *SpotlightUnfocusedEvent) NotifyEventType() string  { return e.EventType }
+func (e *NetworkStatusEvent) NotifyEventType() string       { return e.EventType }
+func (e *RecordingStartedEvent) NotifyEventType() string    { return e.EventType }
+func (e *RecordingStoppedEvent) NotifyEventType() string    { return e.EventType }
+func (e *AudioMuteChangedEvent) NotifyEventType() string    { return e.EventType }
+func (e *VideoMuteChangedEvent) NotifyEventType() string    { return e.EventType }
+func (e *UnknownNotifyEvent) NotifyEventType() string       { return e.EventType }
+
+func (*ConnectionCreatedEvent) notifyEvent()   {}
+func (*ConnectionUpdatedEvent) notifyEvent()   {}
+func (*ConnectionDestroyedEvent) notifyEvent() {}
+func (*SpotlightChangedEvent) notifyEvent()    {}
+func (*SpotlightFocusedEvent) notifyEvent()    {}
+func (*SpotlightUnfocusedEvent) notifyEvent()  {}
+func (*NetworkStatusEvent) notifyEvent()       {}
+func (*RecordingStartedEvent) notifyEvent()    {}
+func (*RecordingStoppedEvent) notifyEvent()    {}
+func (*AudioMuteChangedEvent) notifyEvent()    {}
+func (*VideoMuteChangedEvent) notifyEvent()    {}
+func (*UnknownNotifyEvent) notifyEvent()       {}
+
+// parseNotifyEvent は notify メッセージを event_type に対応する NotifyEvent に変換します。
+// 変換できなかった場合は、エラーと一緒に *UnknownNotifyEvent を返します。
+func parseNotifyEvent(eventType string, rawMessage []byte) (NotifyEvent, error) {
+	var event NotifyEvent
+	unknown := func() *UnknownNotifyEvent {
+		raw := make(json.RawMessage, len(rawMessage))
+		copy(raw, rawMessage)
+		return &UnknownNotifyEvent{EventType: eventType, Raw: raw}
+	}
+
+	switch eventType {
+	case "connection.created":
+		event = &ConnectionCreatedEvent{}
+	case "connection.updated":
+		event = &ConnectionUpdatedEvent{}
+	case "connection.destroyed":
+		event = &ConnectionDestroyedEvent{}
+	case "spotlight.changed":
+		event = &SpotlightChangedEvent{}
+	case "spotlight.focused":
+		event = &SpotlightFocusedEvent{}
+	case "spotlight.unfocused":
+		event = &SpotlightUnfocusedEvent{}
+	case "network.status":
+		event = &NetworkStatusEvent{}
+	case "recording.started":
+		event = &RecordingStartedEvent{}
+	case "recording.stopped":
+		event = &RecordingStoppedEvent{}
+	case "audio.muted", "audio.unmuted":
+		event = &AudioMuteChangedEvent{}
+	case "video.muted", "video.unmuted":
+		event = &VideoMuteChangedEvent{}
+	default:
+		return unknown(), nil
+	}
+
+	if err := json.Unmarshal(rawMessage, event); err != nil {
+		return unknown(), err
+	}
+	if m, ok := event.(interface{ decodeMetadata() }); ok {
+		m.decodeMetadata()
+	}
+	return event, nil
+}
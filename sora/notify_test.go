@@ -0,0 +1,170 @@
+package sora
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseNotifyEvent(t *testing.T) {
+	cases := []struct {
+		eventType string
+		expected  string
+	}{
+		{"connection.created", "*sora.ConnectionCreatedEvent"},
+		{"connection.updated", "*sora.ConnectionUpdatedEvent"},
+		{"connection.destroyed", "*sora.ConnectionDestroyedEvent"},
+		{"spotlight.changed", "*sora.SpotlightChangedEvent"},
+		{"spotlight.focused", "*sora.SpotlightFocusedEvent"},
+		{"spotlight.unfocused", "*sora.SpotlightUnfocusedEvent"},
+		{"network.status", "*sora.NetworkStatusEvent"},
+		{"recording.started", "*sora.RecordingStartedEvent"},
+		{"recording.stopped", "*sora.RecordingStoppedEvent"},
+		{"audio.muted", "*sora.AudioMuteChangedEvent"},
+		{"video.unmuted", "*sora.VideoMuteChangedEvent"},
+		{"future.event", "*sora.UnknownNotifyEvent"},
+	}
+
+	for _, c := range cases {
+		raw := fmt.Sprintf(`{"type":"notify","event_type":"%s"}`, c.eventType)
+		event, err := parseNotifyEvent(c.eventType, []byte(raw))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.eventType, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", event); got != c.expected {
+			t.Errorf("%s: expected %s, but got %s", c.eventType, c.expected, got)
+		}
+		if event.NotifyEventType() != c.eventType {
+			t.Errorf("%s: expected event type %s, but got %s", c.eventType, c.eventType, event.NotifyEventType())
+		}
+	}
+}
+
+func TestParseNotifyEventConnectionExtras(t *testing.T) {
+	raw := []byte(`{
+		"type": "notify",
+		"event_type": "connection.created",
+		"connection_id": "C1",
+		"session_id": "S1",
+		"turn_transport_type": "tcp",
+		"authn_metadata": {"user": "alice"},
+		"channel_sendrecv_connections": 2
+	}`)
+
+	event, err := parseNotifyEvent("connection.created", raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := event.(*ConnectionCreatedEvent)
+	if !ok {
+		t.Fatalf("expected *ConnectionCreatedEvent, but got %T", event)
+	}
+	if e.ConnectionID != "C1" || e.SessionID != "S1" || e.TurnTransportType != "tcp" || e.ChannelSendrecvConnections != 2 {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	if m, ok := e.AuthnMetadata.(map[string]interface{}); !ok || m["user"] != "alice" {
+		t.Errorf("unexpected authn_metadata: %+v", e.AuthnMetadata)
+	}
+}
+
+func TestParseNotifyEventUnknownKeepsRaw(t *testing.T) {
+	raw := []byte(`{"type":"notify","event_type":"future.event","value":1}`)
+
+	event, err := parseNotifyEvent("future.event", raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := event.(*UnknownNotifyEvent)
+	if !ok {
+		t.Fatalf("expected *UnknownNotifyEvent, but got %T", event)
+	}
+	if string(e.Raw) != string(raw) {
+		t.Errorf("expected raw message %s, but got %s", raw, e.Raw)
+	}
+}
+
+func TestParseNotifyEventMetadata(t *testing.T) {
+	// signaling_notify_metadata には object 以外も指定できる
+	cases := []struct {
+		metadata string
+		expected map[string]interface{}
+	}{
+		{`{"name": "alice"}`, map[string]interface{}{"name": "alice"}},
+		{`"alice"`, nil},
+		{`["a", "b"]`, nil},
+		{`1`, nil},
+		{`null`, nil},
+	}
+	for _, c := range cases {
+		raw := []byte(`{"type":"notify","event_type":"connection.created","connection_id":"C1","metadata":` + c.metadata + `}`)
+		event, err := parseNotifyEvent("connection.created", raw)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.metadata, err)
+			continue
+		}
+		e, ok := event.(*ConnectionCreatedEvent)
+		if !ok || e.ConnectionID != "C1" {
+			t.Errorf("%s: unexpected event: %+v", c.metadata, event)
+			continue
+		}
+		if !reflect.DeepEqual(e.Metadata, c.expected) {
+			t.Errorf("%s: unexpected metadata: %#v", c.metadata, e.Metadata)
+		}
+		if string(e.RawMetadata) != c.metadata {
+			t.Errorf("%s: unexpected raw metadata: %s", c.metadata, e.RawMetadata)
+		}
+	}
+}
+
+func TestParseNotifyEventInvalid(t *testing.T) {
+	raw := []byte(`{"type":"notify","event_type":"connection.created","connection_id":1}`)
+
+	event, err := parseNotifyEvent("connection.created", raw)
+	if err == nil {
+		t.Error("expected error")
+	}
+	e, ok := event.(*UnknownNotifyEvent)
+	if !ok {
+		t.Fatalf("expected *UnknownNotifyEvent, but got %T", event)
+	}
+	if e.EventType != "connection.created" || string(e.Raw) != string(raw) {
+		t.Errorf("unexpected event: %+v", e)
+	}
+}
+
+func TestInvalidNotifyKeepsConnection(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+	opts := DefaultOptions()
+	opts.Multistream = true
+	c := NewConnection(s.URL(), "sora", opts)
+	defer c.Disconnect()
+
+	events := c.Events()
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	ss := s.session(0)
+	for _, msg := range []map[string]interface{}{
+		{"type": "notify", "event_type": "connection.created", "connection_id": 1},
+		{"type": "notify", "event_type": "connection.created", "connection_id": "C1", "metadata": []string{"a"}},
+	} {
+		if err := ss.send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e := waitEvent(t, events, func(e Event) bool { _, ok := e.(*NotifyReceivedEvent); return ok })
+	if n, ok := e.(*NotifyReceivedEvent).Notify.(*UnknownNotifyEvent); !ok || n.EventType != "connection.created" {
+		t.Errorf("unexpected notify: %+v", e)
+	}
+	e = waitEvent(t, events, func(e Event) bool { _, ok := e.(*NotifyReceivedEvent); return ok })
+	if n, ok := e.(*NotifyReceivedEvent).Notify.(*ConnectionCreatedEvent); !ok || n.ConnectionID != "C1" {
+		t.Errorf("unexpected notify: %+v", e)
+	}
+	if _, ok := c.Roster().Participant("C1"); !ok {
+		t.Error("expected C1 in roster")
+	}
+}
@@ -1,5 +1,7 @@
 package sora
 
+import "go.opentelemetry.io/otel/trace"
+
 // ConnectionOptions は Sora 接続設定です。
 type ConnectionOptions struct {
 	// Sora の URL
@@ -14,7 +16,7 @@ type ConnectionOptions struct {
 	// クライアント ID は、sora.conf で allow_client_id_assignment を true に設定した場合のみ指定することが可能です
 	ClientID string
 
-	// Video の設定
+	// Video の設定。nil の場合は映像を送受信しません
 	Video *Video
 
 	// Audio の設定
@@ -29,6 +31,58 @@ type ConnectionOptions struct {
 	// Metadata
 	Metadata *Metadata
 
+	// RawMetadata は connect メッセージの metadata として認証 Webhook に渡す任意の値です。
+	// JSON にエンコードできる値や json.RawMessage を指定できます。nil でない場合は Metadata より優先します
+	RawMetadata interface{}
+
+	// SignalingNotifyMetadata は connect メッセージの signaling_notify_metadata として、
+	// 他の参加者へのシグナリング通知に含める値です。JSON にエンコードできる任意の値や json.RawMessage を指定できます
+	SignalingNotifyMetadata interface{}
+
+	// ForwardingFilter を設定すると、Sora が転送するストリームを送信元のクライアント ID やメディアの種類で絞り込みます。
+	// ForwardOnlyClientIDs や ForwardAudioOnly でよく使う設定を作れます
+	ForwardingFilter *ForwardingFilter
+
+	// HeaderExtensions は offer に含まれていればネゴシエーションする RTP ヘッダー拡張の URI。
+	// nil の場合は受信専用の DefaultHeaderExtensions() で、空の場合はネゴシエーションしません
+	HeaderExtensions []string
+
+	// ActiveSpeaker を設定すると、受信した音声の音声レベルから話者を検出して OnActiveSpeakerChanged と OnSpeakingStateChanged を呼び出します
+	ActiveSpeaker *ActiveSpeakerOptions
+
+	// Liveness を設定すると、受信しているトラックが止まっていないかを監視して OnTrackStalled と OnTrackResumed を呼び出します。
+	// トラックごとの状態は Stats().Tracks で確認できます
+	Liveness *LivenessOptions
+
+	// ICE はクライアント側で適用する ICE の設定
+	// RawMetadata を指定せず、Metadata の TurnTCPOnly, TurnTLSOnly が true の場合も、それぞれ TURNTCPOnly, TURNTLSOnly として適用します
+	ICE *ICEOptions
+
+	// E2EE を有効にするかどうかのフラグ
+	// 有効にすると、鍵を e2ee メッセージで他の参加者と交換し、参加者の入退室のたびに自分の鍵を更新します。
+	// Connection.WriteSample で送信するフレームは RTP パケット化する前に暗号化し、受信したフレームは復号して OnTrackSample に渡します。
+	// 対応しているコーデックは VP8 と Opus です。
+	// go-sora 独自の形式なので、Sora JS SDK の E2EE とは相互運用できません
+	E2EE bool
+
+	// E2EESecret は E2EE の公開鍵を認証する事前共有鍵で、E2EE が有効な場合は 16 バイト以上必要です。
+	// 同じチャネルの参加者全員に同じ値を設定してください。Sora は E2EESecret を知らないので、鍵を差し替えられません
+	E2EESecret []byte
+
+	// Dispatch を設定すると、コールバック関数をコールバック関数ごとのキューから別の goroutine で呼び出します。
+	// コールバック関数の処理が遅くても、シグナリングや RTP の受信が止まらなくなります。nil の場合はその場で呼び出します
+	Dispatch *DispatchOptions
+
+	// EventBufferSize は Events() のバッファの大きさ。0 の場合は 100
+	EventBufferSize int
+
+	// PacketBufferSize は Track.Packets() のバッファの大きさ。0 の場合は 100
+	PacketBufferSize int
+
 	// Debug 出力をするかどうかのフラグ
 	Debug bool
+
+	// TracerProvider を指定すると、シグナリングの各段階を OpenTelemetry の span として記録します。
+	// nil の場合は記録しません
+	TracerProvider trace.TracerProvider
 }
@@ -0,0 +1,61 @@
+package sora
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// PushMessage は Sora から受け取った push メッセージ
+// https://sora-doc.shiguredo.jp/api_push
+type PushMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Decode は push メッセージの data を v にデコードします。
+func (m *PushMessage) Decode(v interface{}) error {
+	return json.Unmarshal(m.Data, v)
+}
+
+// pushDataHandler は OnPushData で登録された func(T) または func(*T) を呼び出します。
+type pushDataHandler struct {
+	fn      reflect.Value
+	argType reflect.Type
+}
+
+func newPushDataHandler(f interface{}) (*pushDataHandler, error) {
+	fn := reflect.ValueOf(f)
+	if fn.Kind() != reflect.Func {
+		return nil, fmt.Errorf("OnPushData requires a function, but got %T", f)
+	}
+
+	ft := fn.Type()
+	if ft.NumIn() != 1 || ft.NumOut() != 0 || ft.IsVariadic() {
+		return nil, fmt.Errorf("OnPushData requires func(T) or func(*T), but got %s", ft)
+	}
+
+	return &pushDataHandler{
+		fn:      fn,
+		argType: ft.In(0),
+	}, nil
+}
+
+func (h *pushDataHandler) call(data json.RawMessage) error {
+	var v reflect.Value
+	if h.argType.Kind() == reflect.Ptr {
+		v = reflect.New(h.argType.Elem())
+	} else {
+		v = reflect.New(h.argType)
+	}
+
+	if err := json.Unmarshal(data, v.Interface()); err != nil {
+		return err
+	}
+
+	if h.argType.Kind() != reflect.Ptr {
+		v = v.Elem()
+	}
+	h.fn.Call([]reflect.Value{v})
+	return nil
+}
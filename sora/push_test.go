@@ -0,0 +1,79 @@
+package sora
+
+import (
+	"testing"
+)
+
+type testPushPayload struct {
+	Kind  string `json:"kind"`
+	Value int    `json:"value"`
+}
+
+func TestOnPushData(t *testing.T) {
+	c := NewConnection("ws://localhost/signaling", "sora", nil)
+
+	var byValue testPushPayload
+	if err := c.OnPushData(func(p testPushPayload) { byValue = p }); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.handleMessage([]byte(`{"type":"push","data":{"kind":"counter","value":3}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if byValue.Kind != "counter" || byValue.Value != 3 {
+		t.Errorf("unexpected payload: %+v", byValue)
+	}
+
+	var byPointer *testPushPayload
+	if err := c.OnPushData(func(p *testPushPayload) { byPointer = p }); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.handleMessage([]byte(`{"type":"push","data":{"kind":"counter","value":4}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if byPointer == nil || byPointer.Value != 4 {
+		t.Errorf("unexpected payload: %+v", byPointer)
+	}
+}
+
+func TestOnPushDataDecodeError(t *testing.T) {
+	c := NewConnection("ws://localhost/signaling", "sora", nil)
+
+	called := false
+	if err := c.OnPushData(func(p testPushPayload) { called = true }); err != nil {
+		t.Fatal(err)
+	}
+	var pushErr error
+	var pushMsg *PushMessage
+	c.OnPushError(func(message *PushMessage, err error) {
+		pushMsg = message
+		pushErr = err
+	})
+
+	// デコードに失敗してもシグナリングは継続する
+	if err := c.handleMessage([]byte(`{"type":"push","data":{"kind":1}}`)); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if called {
+		t.Error("OnPushData handler must not be called on decode error")
+	}
+	if pushErr == nil || pushMsg == nil || string(pushMsg.Data) != `{"kind":1}` {
+		t.Errorf("unexpected OnPushError call: message=%+v, err=%v", pushMsg, pushErr)
+	}
+}
+
+func TestOnPushDataInvalidHandler(t *testing.T) {
+	c := NewConnection("ws://localhost/signaling", "sora", nil)
+
+	invalids := []interface{}{
+		nil,
+		"not a function",
+		func() {},
+		func(a, b int) {},
+		func(p testPushPayload) error { return nil },
+	}
+	for _, f := range invalids {
+		if err := c.OnPushData(f); err == nil {
+			t.Errorf("expected error for %T", f)
+		}
+	}
+}
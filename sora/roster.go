@@ -0,0 +1,195 @@
+package sora
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// Participant はチャネルに接続しているコネクションの情報です。
+type Participant struct {
+	ConnectionID string
+	ClientID     string
+	Role         Role
+	Audio        bool
+	Video        bool
+	Metadata     interface{}
+
+	// JoinedAt は参加を検知した時刻です。
+	// 自分より先に接続していたコネクションは、自分が参加した時刻になります。
+	JoinedAt time.Time
+}
+
+// Roster はシグナリング通知から組み立てた、チャネルの参加者一覧です。
+type Roster struct {
+	mu           sync.RWMutex
+	participants map[string]*Participant
+}
+
+func newRoster() *Roster {
+	return &Roster{
+		participants: map[string]*Participant{},
+	}
+}
+
+// Participants は参加者の一覧を参加順に返します。
+func (r *Roster) Participants() []Participant {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ps := make([]Participant, 0, len(r.participants))
+	for _, p := range r.participants {
+		ps = append(ps, *p)
+	}
+	sort.SliceStable(ps, func(i, j int) bool {
+		if ps[i].JoinedAt.Equal(ps[j].JoinedAt) {
+			return ps[i].ConnectionID < ps[j].ConnectionID
+		}
+		return ps[i].JoinedAt.Before(ps[j].JoinedAt)
+	})
+	return ps
+}
+
+// Participant はコネクション ID に対応する参加者を返します。
+func (r *Roster) Participant(connectionID string) (Participant, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	p, ok := r.participants[connectionID]
+	if !ok {
+		return Participant{}, false
+	}
+	return *p, true
+}
+
+// ParticipantByTrack はリモートトラックを送信している参加者を返します。
+// Sora はストリーム ID に送信元のコネクション ID を設定するため、track.Label() から参加者を引きます。
+func (r *Roster) ParticipantByTrack(track *webrtc.Track) (Participant, bool) {
+	return r.Participant(track.Label())
+}
+
+// Len は参加者数を返します。
+func (r *Roster) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.participants)
+}
+
+func (r *Roster) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.participants = map[string]*Participant{}
+}
+
+// join は参加者を追加します。すでに存在する場合は false を返します。
+func (r *Roster) join(p Participant) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.participants[p.ConnectionID]; ok {
+		return false
+	}
+	r.participants[p.ConnectionID] = &p
+	return true
+}
+
+// update は参加者の情報を更新します。参加を検知していなかった場合は追加して false を返します。
+func (r *Roster) update(p Participant) (Participant, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, ok := r.participants[p.ConnectionID]
+	if !ok {
+		r.participants[p.ConnectionID] = &p
+		return p, false
+	}
+	if p.ClientID != "" {
+		current.ClientID = p.ClientID
+	}
+	if p.Role != "" {
+		current.Role = p.Role
+	}
+	current.Audio = p.Audio
+	current.Video = p.Video
+	if p.Metadata != nil {
+		current.Metadata = p.Metadata
+	}
+	return *current, true
+}
+
+func (r *Roster) leave(connectionID string) (Participant, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.participants[connectionID]
+	if !ok {
+		return Participant{}, false
+	}
+	delete(r.participants, connectionID)
+	return *p, true
+}
+
+func participantFromNotify(m *SignalingNotifyMessage, now time.Time) Participant {
+	p := Participant{
+		ConnectionID: m.ConnectionID,
+		ClientID:     m.ClientID,
+		Role:         Role(m.Role),
+		Audio:        m.Audio,
+		Video:        m.Video,
+		JoinedAt:     now,
+	}
+	if len(m.RawMetadata) > 0 {
+		var metadata interface{}
+		if err := json.Unmarshal(m.RawMetadata, &metadata); err == nil && metadata != nil {
+			p.Metadata = metadata
+		}
+	}
+	return p
+}
+
+// updateRoster は notify イベントを Roster に反映し、参加者のコールバック関数を呼び出します。
+func (c *Connection) updateRoster(event NotifyEvent) {
+	now := time.Now()
+	self := c.ConnectionID()
+
+	switch e := event.(type) {
+	case *ConnectionCreatedEvent:
+		if e.ConnectionID == self {
+			// 自分の参加時には、すでに接続しているコネクションが metadata_list で通知される
+			for _, m := range e.MetadataList {
+				connectionID, _ := m["connection_id"].(string)
+				if connectionID == "" || connectionID == self {
+					continue
+				}
+				clientID, _ := m["client_id"].(string)
+				p := Participant{
+					ConnectionID: connectionID,
+					ClientID:     clientID,
+					Metadata:     m["metadata"],
+					JoinedAt:     now,
+				}
+				if c.roster.join(p) {
+					c.handlers().onParticipantJoinedHandler(p)
+				}
+			}
+		}
+		p := participantFromNotify(&e.SignalingNotifyMessage, now)
+		if c.roster.join(p) {
+			c.handlers().onParticipantJoinedHandler(p)
+		}
+	case *ConnectionUpdatedEvent:
+		p, existed := c.roster.update(participantFromNotify(&e.SignalingNotifyMessage, now))
+		if existed {
+			c.handlers().onParticipantUpdatedHandler(p)
+		} else {
+			c.handlers().onParticipantJoinedHandler(p)
+		}
+	case *ConnectionDestroyedEvent:
+		if p, ok := c.roster.leave(e.ConnectionID); ok {
+			c.handlers().onParticipantLeftHandler(p)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package sora
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v2"
+)
+
+func TestRosterFromSignalingNotify(t *testing.T) {
+	c := NewConnection("ws://localhost/signaling", "sora", nil)
+	c.connectionID = "self"
+
+	var joined, left, updated []string
+	c.OnParticipantJoined(func(p Participant) { joined = append(joined, p.ConnectionID) })
+	c.OnParticipantLeft(func(p Participant) { left = append(left, p.ConnectionID) })
+	c.OnParticipantUpdated(func(p Participant) { updated = append(updated, p.ConnectionID) })
+
+	messages := []string{
+		`{"type":"notify","event_type":"connection.created","role":"recvonly","connection_id":"self","client_id":"me",
+		  "metadata_list":[
+		    {"connection_id":"A","client_id":"alice","metadata":{"name":"Alice"}},
+		    {"connection_id":"self","client_id":"me"}
+		  ]}`,
+		`{"type":"notify","event_type":"connection.created","role":"sendonly","connection_id":"B","client_id":"bob","audio":true,"video":true}`,
+		`{"type":"notify","event_type":"connection.updated","role":"sendonly","connection_id":"B","client_id":"bob","audio":true,"video":false,"minutes":1}`,
+		`{"type":"notify","event_type":"connection.destroyed","role":"sendonly","connection_id":"A","client_id":"alice"}`,
+	}
+	for _, m := range messages {
+		if err := c.handleMessage([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := joined; len(got) != 3 || got[0] != "A" || got[1] != "self" || got[2] != "B" {
+		t.Errorf("unexpected joined: %v", got)
+	}
+	if got := updated; len(got) != 1 || got[0] != "B" {
+		t.Errorf("unexpected updated: %v", got)
+	}
+	if got := left; len(got) != 1 || got[0] != "A" {
+		t.Errorf("unexpected left: %v", got)
+	}
+
+	roster := c.Roster()
+	if roster.Len() != 2 {
+		t.Fatalf("expected 2 participants, but got %d", roster.Len())
+	}
+	b, ok := roster.Participant("B")
+	if !ok {
+		t.Fatal("participant B not found")
+	}
+	if b.ClientID != "bob" || b.Role != SendOnlyRole || !b.Audio || b.Video || b.JoinedAt.IsZero() {
+		t.Errorf("unexpected participant: %+v", b)
+	}
+
+	codec := webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, 90000)
+	track, err := webrtc.NewTrack(webrtc.DefaultPayloadTypeVP8, 1, "video-B", "B", codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := roster.ParticipantByTrack(track); !ok || p.ConnectionID != "B" {
+		t.Errorf("expected participant B for track, but got %+v", p)
+	}
+}
@@ -0,0 +1,346 @@
+package sora
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp"
+	"github.com/pion/webrtc/v2"
+)
+
+// SDPTransform はパースした SDP を書き換える関数です。OnRemoteSDP と OnLocalSDP に設定します。
+type SDPTransform func(sd *sdp.SessionDescription) error
+
+// OpusParams は SetOpusParams で設定する Opus の fmtp です。
+type OpusParams struct {
+	// Stereo を true にすると stereo=1 と sprop-stereo=1 を設定します
+	Stereo bool
+
+	// MaxAverageBitrate は maxaveragebitrate に設定するビットレート (bps)。0 の場合は変更しません
+	MaxAverageBitrate uint32
+}
+
+// SDPTransforms は transforms を順番に適用する SDPTransform を返します。
+func SDPTransforms(transforms ...SDPTransform) SDPTransform {
+	return func(sd *sdp.SessionDescription) error {
+		for _, f := range transforms {
+			if err := f(sd); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// PreferCodecs は kind のメディアで names のコーデックが names の順番で先頭に来るように並べ替えます。
+func PreferCodecs(kind webrtc.RTPCodecType, names ...string) SDPTransform {
+	return func(sd *sdp.SessionDescription) error {
+		for _, md := range mediaDescriptions(sd, kind) {
+			codecs := codecNames(md)
+			var preferred, rest []string
+			for _, name := range names {
+				for _, format := range md.MediaName.Formats {
+					if strings.EqualFold(codecs[format], name) {
+						preferred = append(preferred, format)
+					}
+				}
+			}
+			for _, format := range md.MediaName.Formats {
+				if !containsString(preferred, format) {
+					rest = append(rest, format)
+				}
+			}
+			md.MediaName.Formats = append(preferred, rest...)
+		}
+		return nil
+	}
+}
+
+// RemoveCodecs は kind のメディアから names のコーデックを削除します。RTX などの関連するペイロードタイプも削除します。
+// コーデックが 1 つも残らない場合はエラーになります。
+func RemoveCodecs(kind webrtc.RTPCodecType, names ...string) SDPTransform {
+	return func(sd *sdp.SessionDescription) error {
+		for _, md := range mediaDescriptions(sd, kind) {
+			codecs := codecNames(md)
+			removed := map[string]bool{}
+			for _, format := range md.MediaName.Formats {
+				for _, name := range names {
+					if strings.EqualFold(codecs[format], name) {
+						removed[format] = true
+					}
+				}
+			}
+			// apt で削除するペイロードタイプを参照しているもの (RTX など) も削除する
+			for _, a := range md.Attributes {
+				if a.Key != "fmtp" {
+					continue
+				}
+				format, params := splitFormatValue(a.Value)
+				if apt, ok := parseFmtp(params)["apt"]; ok && removed[apt] {
+					removed[format] = true
+				}
+			}
+			if len(removed) == 0 {
+				continue
+			}
+
+			var formats []string
+			for _, format := range md.MediaName.Formats {
+				if !removed[format] {
+					formats = append(formats, format)
+				}
+			}
+			if len(formats) == 0 {
+				return fmt.Errorf("no %s codecs left after removing %s", kind, strings.Join(names, ", "))
+			}
+			md.MediaName.Formats = formats
+
+			attributes := md.Attributes[:0]
+			for _, a := range md.Attributes {
+				switch a.Key {
+				case "rtpmap", "fmtp", "rtcp-fb":
+					if format, _ := splitFormatValue(a.Value); removed[format] {
+						continue
+					}
+				}
+				attributes = append(attributes, a)
+			}
+			md.Attributes = attributes
+		}
+		return nil
+	}
+}
+
+// LimitBandwidth は kind のメディアの b=AS を kbps 以下にします。b=AS がない場合は追加します。
+// kind が 0 の場合はすべてのメディアに適用します。
+func LimitBandwidth(kind webrtc.RTPCodecType, kbps uint64) SDPTransform {
+	return func(sd *sdp.SessionDescription) error {
+		for _, md := range mediaDescriptions(sd, kind) {
+			found := false
+			for i, b := range md.Bandwidth {
+				if b.Type != "AS" {
+					continue
+				}
+				found = true
+				if b.Bandwidth > kbps {
+					md.Bandwidth[i].Bandwidth = kbps
+				}
+			}
+			if !found {
+				md.Bandwidth = append(md.Bandwidth, sdp.Bandwidth{Type: "AS", Bandwidth: kbps})
+			}
+		}
+		return nil
+	}
+}
+
+// StripHeaderExtensions は uris の RTP ヘッダー拡張の a=extmap を削除します。uris を指定しない場合はすべて削除します。
+func StripHeaderExtensions(uris ...string) SDPTransform {
+	strip := func(attributes []sdp.Attribute) []sdp.Attribute {
+		result := attributes[:0]
+		for _, a := range attributes {
+			if a.Key == "extmap" {
+				fields := strings.Fields(a.Value)
+				if len(uris) == 0 || (len(fields) >= 2 && containsString(uris, fields[1])) {
+					continue
+				}
+			}
+			result = append(result, a)
+		}
+		return result
+	}
+
+	return func(sd *sdp.SessionDescription) error {
+		sd.Attributes = strip(sd.Attributes)
+		for _, md := range sd.MediaDescriptions {
+			md.Attributes = strip(md.Attributes)
+		}
+		return nil
+	}
+}
+
+// SetOpusParams は Opus の a=fmtp に params を設定します。すでにあるパラメーターは残します。
+func SetOpusParams(params OpusParams) SDPTransform {
+	var set [][2]string
+	if params.Stereo {
+		set = append(set, [2]string{"stereo", "1"}, [2]string{"sprop-stereo", "1"})
+	}
+	if params.MaxAverageBitrate > 0 {
+		set = append(set, [2]string{"maxaveragebitrate", strconv.FormatUint(uint64(params.MaxAverageBitrate), 10)})
+	}
+
+	return func(sd *sdp.SessionDescription) error {
+		if len(set) == 0 {
+			return nil
+		}
+		for _, md := range mediaDescriptions(sd, webrtc.RTPCodecTypeAudio) {
+			codecs := codecNames(md)
+			for _, format := range md.MediaName.Formats {
+				if !strings.EqualFold(codecs[format], webrtc.Opus) {
+					continue
+				}
+
+				index := -1
+				for i, a := range md.Attributes {
+					if f, _ := splitFormatValue(a.Value); a.Key == "fmtp" && f == format {
+						index = i
+						break
+					}
+				}
+				if index < 0 {
+					md.Attributes = append(md.Attributes, sdp.Attribute{Key: "fmtp", Value: format + " "})
+					index = len(md.Attributes) - 1
+				}
+				_, line := splitFormatValue(md.Attributes[index].Value)
+				md.Attributes[index].Value = format + " " + setFmtpParams(line, set)
+			}
+		}
+		return nil
+	}
+}
+
+// setFmtpParams は fmtp の line に params を設定します。すでにあるキーは値を置き換え、順番は保ちます。
+func setFmtpParams(line string, params [][2]string) string {
+	var keys []string
+	values := map[string]string{}
+	for _, p := range strings.Split(line, ";") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if kv[0] == "" {
+			continue
+		}
+		keys = append(keys, kv[0])
+		if len(kv) == 2 {
+			values[kv[0]] = kv[1]
+		}
+	}
+	for _, p := range params {
+		if !containsString(keys, p[0]) {
+			keys = append(keys, p[0])
+		}
+		values[p[0]] = p[1]
+	}
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if value, ok := values[key]; ok {
+			pairs = append(pairs, key+"="+value)
+		} else {
+			pairs = append(pairs, key)
+		}
+	}
+	return strings.Join(pairs, ";")
+}
+
+// mediaDescriptions は kind のメディアを返します。kind が 0 の場合はすべてのメディアを返します。
+func mediaDescriptions(sd *sdp.SessionDescription, kind webrtc.RTPCodecType) []*sdp.MediaDescription {
+	var mds []*sdp.MediaDescription
+	for _, md := range sd.MediaDescriptions {
+		if kind == 0 || md.MediaName.Media == kind.String() {
+			mds = append(mds, md)
+		}
+	}
+	return mds
+}
+
+// codecNames は a=rtpmap からペイロードタイプとコーデック名の対応を返します。
+func codecNames(md *sdp.MediaDescription) map[string]string {
+	names := map[string]string{}
+	for _, a := range md.Attributes {
+		if a.Key != "rtpmap" {
+			continue
+		}
+		format, value := splitFormatValue(a.Value)
+		names[format] = strings.SplitN(value, "/", 2)[0]
+	}
+	return names
+}
+
+// splitFormatValue は "96 VP8/90000" のような属性の値をペイロードタイプとそれ以降に分けます。
+func splitFormatValue(value string) (string, string) {
+	kv := strings.SplitN(value, " ", 2)
+	if len(kv) < 2 {
+		return kv[0], ""
+	}
+	return kv[0], strings.TrimSpace(kv[1])
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// localSDPTransform は Sora に送信する answer に RTP ヘッダー拡張を追加して、OnLocalSDP を適用する SDPTransform を返します。
+func (c *Connection) localSDPTransform() SDPTransform {
+	transforms := []SDPTransform{c.addHeaderExtensions}
+	if f := c.handlers().onLocalSDPHandler; f != nil {
+		transforms = append(transforms, f)
+	}
+	return SDPTransforms(transforms...)
+}
+
+// localSafeSDPTransform は f が b=, a=fmtp, a=extmap 以外を書き換えた場合にエラーを返す SDPTransform を返します。
+func localSafeSDPTransform(f SDPTransform) SDPTransform {
+	return func(sd *sdp.SessionDescription) error {
+		before, err := stripLocalOnlySDP(sd)
+		if err != nil {
+			return err
+		}
+		if err := f(sd); err != nil {
+			return err
+		}
+		after, err := stripLocalOnlySDP(sd)
+		if err != nil {
+			return err
+		}
+		if before != after {
+			return fmt.Errorf("%w: only b=, a=fmtp and a=extmap can be changed", ErrUnsupportedLocalSDPChange)
+		}
+		return nil
+	}
+}
+
+// stripLocalOnlySDP は sd から b=, a=fmtp, a=extmap を取り除いた SDP を返します。
+func stripLocalOnlySDP(sd *sdp.SessionDescription) (string, error) {
+	c := sdp.SessionDescription{}
+	if err := c.Unmarshal(sd.Marshal()); err != nil {
+		return "", err
+	}
+
+	strip := func(attributes []sdp.Attribute) []sdp.Attribute {
+		var result []sdp.Attribute
+		for _, a := range attributes {
+			if a.Key != "fmtp" && a.Key != "extmap" {
+				result = append(result, a)
+			}
+		}
+		return result
+	}
+	c.Bandwidth = nil
+	c.Attributes = strip(c.Attributes)
+	for _, md := range c.MediaDescriptions {
+		md.Bandwidth = nil
+		md.Attributes = strip(md.Attributes)
+	}
+	return c.Marshal(), nil
+}
+
+// transformSDP は raw をパースして f を適用した SDP を返します。f が nil の場合は raw をそのまま返します。
+func transformSDP(raw string, f SDPTransform) (string, error) {
+	if f == nil {
+		return raw, nil
+	}
+
+	sd := sdp.SessionDescription{}
+	if err := sd.Unmarshal(raw); err != nil {
+		return "", err
+	}
+	if err := f(&sd); err != nil {
+		return "", err
+	}
+	return sd.Marshal(), nil
+}
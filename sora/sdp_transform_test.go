@@ -0,0 +1,166 @@
+package sora
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/sdp"
+	"github.com/pion/webrtc/v2"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+func readSDP(t *testing.T, name string) string {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "sdp", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestSDPTransforms(t *testing.T) {
+	offer := readSDP(t, "offer.sdp")
+
+	// 何も書き換えない場合は元の SDP と同じになる
+	if got, err := transformSDP(offer, SDPTransforms()); err != nil || got != offer {
+		t.Fatalf("round trip changed the SDP (err: %v):\n%s", err, got)
+	}
+
+	cases := []struct {
+		golden    string
+		transform SDPTransform
+	}{
+		{"prefer_codecs.golden", PreferCodecs(webrtc.RTPCodecTypeVideo, "H264", "VP9")},
+		{"remove_codecs.golden", RemoveCodecs(webrtc.RTPCodecTypeVideo, "VP8", "h264")},
+		{"limit_bandwidth.golden", LimitBandwidth(0, 500)},
+		{"strip_header_extensions.golden", StripHeaderExtensions("urn:3gpp:video-orientation", "urn:ietf:params:rtp-hdrext:ssrc-audio-level")},
+		{"strip_all_header_extensions.golden", StripHeaderExtensions()},
+		{"opus_params.golden", SetOpusParams(OpusParams{Stereo: true, MaxAverageBitrate: 128000})},
+		{"chain.golden", SDPTransforms(RemoveCodecs(webrtc.RTPCodecTypeAudio, "ISAC"), PreferCodecs(webrtc.RTPCodecTypeAudio, "PCMA"), LimitBandwidth(webrtc.RTPCodecTypeAudio, 32))},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.golden, func(t *testing.T) {
+			got, err := transformSDP(offer, tc.transform)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join("testdata", "sdp", tc.golden)
+			if *updateGolden {
+				if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if want := readSDP(t, tc.golden); got != want {
+				t.Errorf("mismatch with %s:\n%s", path, got)
+			}
+
+			// 書き換えた SDP は pion でそのまま使える
+			if _, err := populateFromSDP(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: got}); err != nil {
+				t.Errorf("failed to parse transformed SDP: %v", err)
+			}
+		})
+	}
+}
+
+func TestRemoveAllCodecs(t *testing.T) {
+	_, err := transformSDP(readSDP(t, "offer.sdp"), RemoveCodecs(webrtc.RTPCodecTypeAudio, "opus", "ISAC", "PCMU", "PCMA"))
+	if err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestOnSDP(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+	opts := DefaultOptions()
+	opts.Multistream = true
+	c := NewConnection(s.URL(), "sora", opts)
+	defer c.Disconnect()
+
+	remote := make(chan *sdp.SessionDescription, 1)
+	c.OnRemoteSDP(SDPTransforms(
+		RemoveCodecs(webrtc.RTPCodecTypeVideo, "VP8"),
+		func(sd *sdp.SessionDescription) error {
+			remote <- sd
+			return nil
+		},
+	))
+	c.OnLocalSDP(SDPTransforms(
+		LimitBandwidth(webrtc.RTPCodecTypeVideo, 300),
+		SetOpusParams(OpusParams{Stereo: true}),
+	))
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case sd := <-remote:
+		for _, md := range sd.MediaDescriptions {
+			if names := codecNames(md); containsString(values(names), "VP8") {
+				t.Errorf("VP8 was not removed: %v", names)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnRemoteSDP was not called")
+	}
+
+	answer, _ := s.session(0).expect("answer")["sdp"].(string)
+	if !strings.Contains(answer, "b=AS:300\r\n") || !strings.Contains(answer, "stereo=1") {
+		t.Errorf("answer was not transformed:\n%s", answer)
+	}
+	// offer から削除したコーデックは answer にも含まれない
+	if strings.Contains(answer, "VP8/90000") {
+		t.Errorf("unexpected VP8 in answer:\n%s", answer)
+	}
+}
+
+func values(m map[string]string) []string {
+	var vs []string
+	for _, v := range m {
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+func TestLocalSafeSDPTransform(t *testing.T) {
+	cases := []struct {
+		name string
+		f    SDPTransform
+		safe bool
+	}{
+		{"LimitBandwidth", LimitBandwidth(0, 300), true},
+		{"SetOpusParams", SetOpusParams(OpusParams{Stereo: true, MaxAverageBitrate: 64000}), true},
+		{"StripHeaderExtensions", StripHeaderExtensions(), true},
+		{"PreferCodecs", PreferCodecs(webrtc.RTPCodecTypeVideo, "H264"), false},
+		{"RemoveCodecs", RemoveCodecs(webrtc.RTPCodecTypeVideo, "VP8"), false},
+		{"ice-ufrag", func(sd *sdp.SessionDescription) error {
+			for _, md := range sd.MediaDescriptions {
+				for i, a := range md.Attributes {
+					if a.Key == "ice-ufrag" {
+						md.Attributes[i].Value = "changed"
+					}
+				}
+			}
+			return nil
+		}, false},
+	}
+
+	for _, c := range cases {
+		_, err := transformSDP(readSDP(t, "offer.sdp"), localSafeSDPTransform(c.f))
+		if c.safe && err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+		if !c.safe && !errors.Is(err, ErrUnsupportedLocalSDPChange) {
+			t.Errorf("%s: expected ErrUnsupportedLocalSDPChange, but got %v", c.name, err)
+		}
+	}
+}
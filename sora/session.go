@@ -0,0 +1,108 @@
+package sora
+
+import (
+	"encoding/json"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// Encoding はサイマルキャストで送信するストリームごとの設定です。offer メッセージの encodings で通知されます。
+type Encoding struct {
+	Rid                   string  `json:"rid"`
+	Active                *bool   `json:"active,omitempty"`
+	MaxBitrate            int     `json:"maxBitrate,omitempty"`
+	MaxFramerate          float64 `json:"maxFramerate,omitempty"`
+	ScaleResolutionDownBy float64 `json:"scaleResolutionDownBy,omitempty"`
+	ScalabilityMode       string  `json:"scalabilityMode,omitempty"`
+}
+
+// SessionInfo は Sora が offer メッセージで通知した接続の情報です。
+type SessionInfo struct {
+	// Version は Sora のバージョン
+	Version string
+
+	SessionID    string
+	ConnectionID string
+	ClientID     string
+
+	// AudioMid, VideoMid は送信に使う m-line の mid。受信のみの場合は空になります
+	AudioMid string
+	VideoMid string
+
+	// Simulcast はサイマルキャストが有効かどうか
+	Simulcast bool
+	// Encodings はサイマルキャストで送信するストリームの設定
+	Encodings []Encoding
+
+	// Metadata, AuthzMetadata は認証 Webhook が返した metadata と authz_metadata
+	Metadata      json.RawMessage
+	AuthzMetadata json.RawMessage
+
+	ICEServers         []webrtc.ICEServer
+	ICETransportPolicy webrtc.ICETransportPolicy
+
+	// SDP は offer の SDP
+	SDP string
+
+	// Raw は offer メッセージそのもの
+	Raw json.RawMessage
+}
+
+func newSessionInfo(offer *offerMessage, rawMessage []byte) *SessionInfo {
+	raw := make(json.RawMessage, len(rawMessage))
+	copy(raw, rawMessage)
+
+	info := &SessionInfo{
+		Version:            offer.Version,
+		SessionID:          offer.SessionID,
+		ConnectionID:       offer.ConnectionID,
+		ClientID:           offer.ClientID,
+		AudioMid:           offer.Mid["audio"],
+		VideoMid:           offer.Mid["video"],
+		Simulcast:          offer.Simulcast,
+		Encodings:          offer.Encodings,
+		Metadata:           offer.Metadata,
+		AuthzMetadata:      offer.AuthzMetadata,
+		ICETransportPolicy: webrtc.NewICETransportPolicy(offer.Config.IceTransportPolicy),
+		SDP:                offer.Sdp,
+		Raw:                raw,
+	}
+	if offer.Config.IceServers != nil {
+		info.ICEServers = *offer.Config.IceServers
+	}
+	return info
+}
+
+// clone は slice と json.RawMessage も複製した SessionInfo を返します。
+// 返した値を呼び出し側が書き換えても、Connection が持つ SessionInfo が変わらないようにします。
+func (s *SessionInfo) clone() SessionInfo {
+	info := *s
+	if s.Encodings != nil {
+		info.Encodings = make([]Encoding, len(s.Encodings))
+		for i, e := range s.Encodings {
+			if e.Active != nil {
+				active := *e.Active
+				e.Active = &active
+			}
+			info.Encodings[i] = e
+		}
+	}
+	if s.ICEServers != nil {
+		info.ICEServers = make([]webrtc.ICEServer, len(s.ICEServers))
+		for i, server := range s.ICEServers {
+			server.URLs = append([]string(nil), server.URLs...)
+			info.ICEServers[i] = server
+		}
+	}
+	info.Metadata = cloneRawMessage(s.Metadata)
+	info.AuthzMetadata = cloneRawMessage(s.AuthzMetadata)
+	info.Raw = cloneRawMessage(s.Raw)
+	return info
+}
+
+func cloneRawMessage(m json.RawMessage) json.RawMessage {
+	if m == nil {
+		return nil
+	}
+	return append(json.RawMessage{}, m...)
+}
@@ -0,0 +1,38 @@
+package sora
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pion/webrtc/v2"
+)
+
+func TestSessionInfoClone(t *testing.T) {
+	active := true
+	info := &SessionInfo{
+		Encodings:     []Encoding{{Rid: "r0", Active: &active}},
+		ICEServers:    []webrtc.ICEServer{{URLs: []string{"turn:example.com"}}},
+		Metadata:      json.RawMessage(`{"room":"A"}`),
+		AuthzMetadata: json.RawMessage(`{"is_admin":true}`),
+		Raw:           json.RawMessage(`{"type":"offer"}`),
+	}
+
+	// 複製を書き換えても元の SessionInfo は変わらない
+	c := info.clone()
+	c.Encodings[0].Rid = "r1"
+	*c.Encodings[0].Active = false
+	c.ICEServers[0].URLs[0] = "turn:other.example.com"
+	c.Metadata[2] = 'X'
+	c.AuthzMetadata[2] = 'X'
+	c.Raw[2] = 'X'
+
+	if info.Encodings[0].Rid != "r0" || !*info.Encodings[0].Active {
+		t.Errorf("encodings were modified: %+v", info.Encodings[0])
+	}
+	if info.ICEServers[0].URLs[0] != "turn:example.com" {
+		t.Errorf("ICE servers were modified: %+v", info.ICEServers)
+	}
+	if string(info.Metadata) != `{"room":"A"}` || string(info.AuthzMetadata) != `{"is_admin":true}` || string(info.Raw) != `{"type":"offer"}` {
+		t.Errorf("raw messages were modified: %s %s %s", info.Metadata, info.AuthzMetadata, info.Raw)
+	}
+}
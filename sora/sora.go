@@ -3,9 +3,11 @@ package sora
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
 )
 
 const (
@@ -33,6 +35,11 @@ func CreateVideoCodec(codecType VideoCodecType) (*webrtc.RTPCodec, error) {
 		codec = webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, 90000)
 	case VideoCodecTypeVP9:
 		codec = webrtc.NewRTPVP9Codec(webrtc.DefaultPayloadTypeVP9, 90000)
+	case VideoCodecTypeH264:
+		codec = webrtc.NewRTPH264Codec(webrtc.DefaultPayloadTypeH264, 90000)
+	case VideoCodecTypeAV1:
+		// pion/webrtc v2 には AV1 の Payloader がないので、送信する場合は WriteRTP を使ってください
+		codec = webrtc.NewRTPCodec(webrtc.RTPCodecTypeVideo, string(VideoCodecTypeAV1), 90000, 0, "", defaultPayloadTypeAV1, nil)
 	default:
 		return nil, fmt.Errorf("go-sora does not suport video codec '%s'", codecType)
 	}
@@ -59,17 +66,40 @@ func NewConnection(soraURL string, channelID string, options *ConnectionOptions)
 		pc:              nil,
 		pcConfig:        webrtc.Configuration{},
 		connectionState: webrtc.ICEConnectionStateNew,
-		answerSent:      false,
-
-		onOpenHandler:            func(pc *webrtc.PeerConnection, m webrtc.MediaEngine) {},
-		onConnectHandler:         func() {},
-		onDisconnectHandler:      func(reason string, err error) {},
-		onTrackHandler:           func(track *webrtc.Track) {},
-		onTrackPacketHandler:     func(track *webrtc.Track, packet *rtp.Packet) {},
-		onSignalingNotifyHandler: func(eventType string, message *SignalingNotifyMessage) {},
-		onSpotlightNotifyHandler: func(eventType string, message *SpotlightNotifyMessage) {},
-		onNetworkNotifyHandler:   func(eventType string, message *NetworkNotifyMessage) {},
-		onPushHandler:            func(message []byte) {},
+
+		roster:  newRoster(),
+		streams: map[string]*RemoteStream{},
+
+		callbacks: connectionHandlers{
+			onOfferHandler:           func(info SessionInfo) {},
+			onOpenHandler:            func(pc *webrtc.PeerConnection, m webrtc.MediaEngine) {},
+			onConnectHandler:         func() {},
+			onDisconnectHandler:      func(reason string, err error) {},
+			onTrackHandler:           func(track *webrtc.Track) {},
+			onTrackPacketHandler:     func(track *webrtc.Track, packet *rtp.Packet) {},
+			onTrackSampleHandler:     func(track *webrtc.Track, sample media.Sample) {},
+			onSignalingNotifyHandler: func(eventType string, message *SignalingNotifyMessage) {},
+			onSpotlightNotifyHandler: func(eventType string, message *SpotlightNotifyMessage) {},
+			onNetworkNotifyHandler:   func(eventType string, message *NetworkNotifyMessage) {},
+			onNotifyHandler:          func(event NotifyEvent) {},
+			onPushHandler:            func(message []byte) {},
+			onPushMessageHandler:     func(message *PushMessage) {},
+			onPushErrorHandler:       func(message *PushMessage, err error) {},
+
+			onParticipantJoinedHandler:  func(p Participant) {},
+			onParticipantLeftHandler:    func(p Participant) {},
+			onParticipantUpdatedHandler: func(p Participant) {},
+
+			onStreamAddedHandler:   func(stream *RemoteStream) {},
+			onStreamRemovedHandler: func(stream *RemoteStream) {},
+			onTrackRemovedHandler:  func(track *webrtc.Track) {},
+
+			onActiveSpeakerChangedHandler: func(connectionID string) {},
+			onSpeakingStateChangedHandler: func(connectionID string, speaking bool) {},
+
+			onTrackStalledHandler: func(track *webrtc.Track, reason StallReason) {},
+			onTrackResumedHandler: func(track *webrtc.Track, reason StallReason, stalled time.Duration) {},
+		},
 	}
 
 	return c
@@ -0,0 +1,297 @@
+package sora
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/sdp"
+	"github.com/pion/webrtc/v2"
+)
+
+// RemoteStream は同じ MediaStream に属するリモートトラックのまとまりです。
+// Sora のマルチストリームでは MediaStream ID が送信元のコネクション ID になるため、1 参加者分の音声と映像をまとめて扱えます。
+type RemoteStream struct {
+	id string
+
+	mu     sync.RWMutex
+	tracks []*webrtc.Track
+}
+
+func newRemoteStream(id string) *RemoteStream {
+	return &RemoteStream{id: id}
+}
+
+// ID は MediaStream ID を返します。
+func (s *RemoteStream) ID() string {
+	return s.id
+}
+
+// ConnectionID は送信元のコネクション ID を返します。
+func (s *RemoteStream) ConnectionID() string {
+	return s.id
+}
+
+// Tracks はストリームに属するトラックを返します。
+func (s *RemoteStream) Tracks() []*webrtc.Track {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tracks := make([]*webrtc.Track, len(s.tracks))
+	copy(tracks, s.tracks)
+	return tracks
+}
+
+// AudioTracks はストリームに属する音声トラックを返します。
+func (s *RemoteStream) AudioTracks() []*webrtc.Track {
+	return s.tracksByKind(webrtc.RTPCodecTypeAudio)
+}
+
+// VideoTracks はストリームに属する映像トラックを返します。
+func (s *RemoteStream) VideoTracks() []*webrtc.Track {
+	return s.tracksByKind(webrtc.RTPCodecTypeVideo)
+}
+
+func (s *RemoteStream) tracksByKind(kind webrtc.RTPCodecType) []*webrtc.Track {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tracks []*webrtc.Track
+	for _, t := range s.tracks {
+		if t.Kind() == kind {
+			tracks = append(tracks, t)
+		}
+	}
+	return tracks
+}
+
+func (s *RemoteStream) addTrack(track *webrtc.Track) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tracks = append(s.tracks, track)
+}
+
+// removeTrack はトラックを取り除き、取り除いたかどうかと残りのトラック数を返します。
+func (s *RemoteStream) removeTrack(track *webrtc.Track) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, t := range s.tracks {
+		if t == track {
+			s.tracks = append(s.tracks[:i], s.tracks[i+1:]...)
+			return true, len(s.tracks)
+		}
+	}
+	return false, len(s.tracks)
+}
+
+// addRemoteTrack はトラックを MediaStream ID ごとの RemoteStream にまとめ、トラックが含まれる RemoteStream を返します。
+// 新しい RemoteStream ができた場合は true を返します。
+func (c *Connection) addRemoteTrack(track *webrtc.Track) (*RemoteStream, bool) {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+
+	id := track.Label()
+	if s, ok := c.streams[id]; ok {
+		s.addTrack(track)
+		return s, false
+	}
+
+	s := newRemoteStream(id)
+	s.addTrack(track)
+	c.streams[id] = s
+	return s, true
+}
+
+// removeRemoteStream は RemoteStream を取り除き、含まれていたトラックも取り除かれたものとして通知してから OnStreamRemoved を呼び出します。
+func (c *Connection) removeRemoteStream(id string) {
+	c.streamsMu.Lock()
+	s, ok := c.streams[id]
+	delete(c.streams, id)
+	c.streamsMu.Unlock()
+
+	if !ok {
+		return
+	}
+	for _, track := range s.Tracks() {
+		c.trackRemoved(track)
+	}
+	c.handlers().onStreamRemovedHandler(s)
+}
+
+// removeRemoteTrack はトラックを RemoteStream から取り除き、トラックがなくなった RemoteStream も取り除きます。
+// connection.destroyed などで RemoteStream ごと取り除いたトラックは、もう一度通知しません。
+func (c *Connection) removeRemoteTrack(track *webrtc.Track) {
+	c.streamsMu.Lock()
+	s, ok := c.streams[track.Label()]
+	removed, remaining := false, 0
+	if ok {
+		removed, remaining = s.removeTrack(track)
+	}
+	empty := removed && remaining == 0
+	if empty {
+		delete(c.streams, s.id)
+	}
+	c.streamsMu.Unlock()
+
+	if !removed {
+		return
+	}
+	c.trackRemoved(track)
+	if empty {
+		c.handlers().onStreamRemovedHandler(s)
+	}
+}
+
+// receivingTracks は受信を開始しているトラックを mid ごとに返します。
+func (c *Connection) receivingTracks() map[string]*webrtc.Track {
+	tracks := map[string]*webrtc.Track{}
+	pc := c.PeerConnection()
+	if pc == nil {
+		return tracks
+	}
+
+	for _, t := range pc.GetTransceivers() {
+		if t.Receiver() == nil || t.Receiver().Track() == nil {
+			continue
+		}
+		tracks[t.Mid()] = t.Receiver().Track()
+	}
+	return tracks
+}
+
+// removeEndedTracks は update 前に受信していたトラックのうち、再 offer された SDP で送信されなくなったものを取り除きます。
+func (c *Connection) removeEndedTracks(before map[string]*webrtc.Track, sessionDescription string) error {
+	ended, err := endedTracks(before, sessionDescription)
+	if err != nil {
+		return err
+	}
+
+	for _, track := range ended {
+		c.trace("track removed: kind=%s, id=%s, label=%s", track.Kind(), track.ID(), track.Label())
+		c.removeRemoteTrack(track)
+	}
+	return nil
+}
+
+// endedTracks は mid ごとのトラックのうち、SDP の対応する m-line が送信をやめたか、別の SSRC に置き換わったものを mid 順に返します。
+func endedTracks(tracks map[string]*webrtc.Track, sessionDescription string) ([]*webrtc.Track, error) {
+	sd := sdp.SessionDescription{}
+	if err := sd.Unmarshal(sessionDescription); err != nil {
+		return nil, err
+	}
+
+	// mid ごとに送信中の SSRC を集める。SSRC が書かれていない m-line は nil にする
+	sending := map[string]map[uint32]bool{}
+	for _, md := range sd.MediaDescriptions {
+		mid, ok := md.Attribute("mid")
+		if !ok || md.MediaName.Port.Value == 0 || !isSendingMedia(md) {
+			continue
+		}
+
+		var ssrcs map[uint32]bool
+		for _, a := range md.Attributes {
+			if a.Key != "ssrc" {
+				continue
+			}
+			fields := strings.Fields(a.Value)
+			if len(fields) == 0 {
+				continue
+			}
+			ssrc, err := strconv.ParseUint(fields[0], 10, 32)
+			if err != nil {
+				continue
+			}
+			if ssrcs == nil {
+				ssrcs = map[uint32]bool{}
+			}
+			ssrcs[uint32(ssrc)] = true
+		}
+		sending[mid] = ssrcs
+	}
+
+	mids := make([]string, 0, len(tracks))
+	for mid := range tracks {
+		mids = append(mids, mid)
+	}
+	sort.Strings(mids)
+
+	var ended []*webrtc.Track
+	for _, mid := range mids {
+		track := tracks[mid]
+		ssrcs, ok := sending[mid]
+		if !ok || (ssrcs != nil && !ssrcs[track.SSRC()]) {
+			ended = append(ended, track)
+		}
+	}
+	return ended, nil
+}
+
+// pruneRemoteStreams は update で再 offer された SDP に含まれなくなった RemoteStream を取り除きます。
+func (c *Connection) pruneRemoteStreams(sessionDescription string) error {
+	active, err := remoteStreamIDs(sessionDescription)
+	if err != nil {
+		return err
+	}
+
+	c.streamsMu.Lock()
+	var removed []string
+	for id := range c.streams {
+		if !active[id] {
+			removed = append(removed, id)
+		}
+	}
+	c.streamsMu.Unlock()
+
+	for _, id := range removed {
+		c.removeRemoteStream(id)
+	}
+	return nil
+}
+
+// remoteStreamIDs は offer SDP のうち、送信側の m-line に含まれる MediaStream ID を返します。
+func remoteStreamIDs(sessionDescription string) (map[string]bool, error) {
+	sd := sdp.SessionDescription{}
+	if err := sd.Unmarshal(sessionDescription); err != nil {
+		return nil, err
+	}
+
+	ids := map[string]bool{}
+	for _, md := range sd.MediaDescriptions {
+		if md.MediaName.Media != "audio" && md.MediaName.Media != "video" {
+			continue
+		}
+		if md.MediaName.Port.Value == 0 || !isSendingMedia(md) {
+			continue
+		}
+
+		for _, a := range md.Attributes {
+			switch a.Key {
+			case "msid":
+				if fields := strings.Fields(a.Value); len(fields) > 0 {
+					ids[fields[0]] = true
+				}
+			case "ssrc":
+				// a=ssrc:<ssrc> msid:<stream id> <track id>
+				fields := strings.Fields(a.Value)
+				if len(fields) >= 2 && strings.HasPrefix(fields[1], "msid:") {
+					ids[strings.TrimPrefix(fields[1], "msid:")] = true
+				}
+			}
+		}
+	}
+	return ids, nil
+}
+
+func isSendingMedia(md *sdp.MediaDescription) bool {
+	for _, a := range md.Attributes {
+		switch a.Key {
+		case "recvonly", "inactive":
+			return false
+		case "sendrecv", "sendonly":
+			return true
+		}
+	}
+	return true
+}
@@ -0,0 +1,276 @@
+package sora
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+func TestRemoteStreamLifecycle(t *testing.T) {
+	s := newFakeSora(t,
+		fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true},
+		fakePublisher{ConnectionID: "publisher-2", Audio: true, Video: true},
+	)
+
+	opts := DefaultOptions()
+	opts.Multistream = true
+	c := NewConnection(s.URL(), "sora", opts)
+	defer c.Disconnect()
+
+	added := make(chan *RemoteStream, 2)
+	removed := make(chan *RemoteStream, 2)
+	c.OnStreamAdded(func(stream *RemoteStream) { added <- stream })
+	c.OnStreamRemoved(func(stream *RemoteStream) { removed <- stream })
+
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	streams := map[string]*RemoteStream{}
+	for len(streams) < 2 {
+		select {
+		case stream := <-added:
+			streams[stream.ID()] = stream
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout waiting for streams, got %d", len(streams))
+		}
+	}
+
+	// 2 本目のトラックが同じ RemoteStream にまとめられるのを待つ
+	deadline := time.Now().Add(5 * time.Second)
+	for _, stream := range streams {
+		for len(stream.AudioTracks()) != 1 || len(stream.VideoTracks()) != 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("stream %s: expected 1 audio and 1 video track, but got %d tracks", stream.ID(), len(stream.Tracks()))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	ss := s.session(0)
+	if err := ss.removePublisher("publisher-1"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case stream := <-removed:
+		if stream.ID() != "publisher-1" {
+			t.Errorf("expected publisher-1 to be removed, but got %s", stream.ID())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for stream removal by update")
+	}
+
+	err := ss.send(map[string]interface{}{
+		"type":          "notify",
+		"event_type":    "connection.destroyed",
+		"role":          "sendonly",
+		"connection_id": "publisher-2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case stream := <-removed:
+		if stream.ID() != "publisher-2" {
+			t.Errorf("expected publisher-2 to be removed, but got %s", stream.ID())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for stream removal by connection.destroyed")
+	}
+}
+
+func TestRemoteStreamIDs(t *testing.T) {
+	offer := "v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\na=msid:A audio-A\r\na=sendonly\r\na=rtpmap:111 opus/48000/2\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:1\r\na=ssrc:1 msid:B video-B\r\na=sendrecv\r\na=rtpmap:96 VP8/90000\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:2\r\na=msid:C video-C\r\na=inactive\r\na=rtpmap:96 VP8/90000\r\n" +
+		"m=video 0 UDP/TLS/RTP/SAVPF 96\r\na=mid:3\r\na=msid:D video-D\r\na=sendonly\r\na=rtpmap:96 VP8/90000\r\n"
+
+	ids, err := remoteStreamIDs(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || !ids["A"] || !ids["B"] {
+		t.Errorf("expected A and B, but got %v", ids)
+	}
+}
+
+func TestTrackRemovedOnUpdate(t *testing.T) {
+	// m-line を recvonly にする場合と、port 0 で拒否する場合
+	for _, reject := range []bool{false, true} {
+		reject := reject
+		t.Run(fmt.Sprintf("reject=%v", reject), func(t *testing.T) {
+			testTrackRemovedOnUpdate(t, reject)
+		})
+	}
+}
+
+func testTrackRemovedOnUpdate(t *testing.T, reject bool) {
+	s := newFakeSora(t,
+		fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true},
+		fakePublisher{ConnectionID: "publisher-2", Audio: true, Video: false},
+	)
+	s.rejectRemoved = reject
+
+	opts := DefaultOptions()
+	opts.Multistream = true
+	c := NewConnection(s.URL(), "sora", opts)
+	defer c.Disconnect()
+
+	tracks := make(chan *webrtc.Track, 3)
+	removed := make(chan *webrtc.Track, 3)
+	c.OnTrack(func(track *webrtc.Track) { tracks <- track })
+	c.OnTrackRemoved(func(track *webrtc.Track) { removed <- track })
+
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-tracks:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout waiting for tracks, got %d", i)
+		}
+	}
+
+	ss := s.session(0)
+	if err := ss.removePublisher("publisher-1"); err != nil {
+		t.Fatal(err)
+	}
+	ss.expect("update")
+	if offer := ss.lastOffer(); reject != (strings.Contains(offer, "m=audio 0 ") && strings.Contains(offer, "m=video 0 ")) {
+		t.Errorf("unexpected re-offer (reject=%v):\n%s", reject, offer)
+	}
+
+	kinds := map[webrtc.RTPCodecType]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case track := <-removed:
+			if track.Label() != "publisher-1" {
+				t.Errorf("expected track of publisher-1 to be removed, but got %s", track.Label())
+			}
+			kinds[track.Kind()] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for track removal")
+		}
+	}
+	if !kinds[webrtc.RTPCodecTypeAudio] || !kinds[webrtc.RTPCodecTypeVideo] {
+		t.Errorf("expected audio and video tracks to be removed, but got %v", kinds)
+	}
+
+	select {
+	case track := <-removed:
+		t.Errorf("unexpected track removal: %s", track.Label())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTrackRemovedOnConnectionDestroyed(t *testing.T) {
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+	opts := DefaultOptions()
+	opts.Multistream = true
+	c := NewConnection(s.URL(), "sora", opts)
+	defer c.Disconnect()
+
+	tracks := make(chan *webrtc.Track, 2)
+	removed := make(chan *webrtc.Track, 4)
+	streamRemoved := make(chan *RemoteStream, 2)
+	c.OnTrack(func(track *webrtc.Track) { tracks <- track })
+	c.OnTrackRemoved(func(track *webrtc.Track) { removed <- track })
+	c.OnStreamRemoved(func(stream *RemoteStream) { streamRemoved <- stream })
+	events := c.Events()
+
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-tracks:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout waiting for tracks, got %d", i)
+		}
+	}
+
+	ss := s.session(0)
+	if err := ss.send(map[string]interface{}{
+		"type":          "notify",
+		"event_type":    "connection.destroyed",
+		"role":          "sendonly",
+		"connection_id": "publisher-1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case track := <-removed:
+			if track.Label() != "publisher-1" {
+				t.Errorf("expected track of publisher-1 to be removed, but got %s", track.Label())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for track removal")
+		}
+		waitEvent(t, events, func(e Event) bool { _, ok := e.(*TrackRemovedEvent); return ok })
+	}
+	select {
+	case stream := <-streamRemoved:
+		if len(stream.Tracks()) != 2 {
+			t.Errorf("expected removed stream to keep its tracks, but got %d", len(stream.Tracks()))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for stream removal")
+	}
+
+	// 続く update ではもう一度通知しない
+	if err := ss.removePublisher("publisher-1"); err != nil {
+		t.Fatal(err)
+	}
+	ss.expect("update")
+	select {
+	case track := <-removed:
+		t.Errorf("unexpected track removal: %s", track.Label())
+	case stream := <-streamRemoved:
+		t.Errorf("unexpected stream removal: %s", stream.ID())
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestEndedTracks(t *testing.T) {
+	codec := webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, 90000)
+	newTrack := func(ssrc uint32, label string) *webrtc.Track {
+		track, err := webrtc.NewTrack(webrtc.DefaultPayloadTypeVP8, ssrc, "video-"+label, label, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return track
+	}
+	tracks := map[string]*webrtc.Track{
+		"0": newTrack(1, "A"),
+		"1": newTrack(2, "B"),
+		"2": newTrack(3, "C"),
+		"3": newTrack(4, "D"),
+	}
+
+	// mid:0 は継続、mid:1 は m-line ごと削除、mid:2 は別の SSRC に置き換え、mid:3 は送信停止
+	offer := "v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:0\r\na=ssrc:1 msid:A video-A\r\na=sendonly\r\na=rtpmap:96 VP8/90000\r\n" +
+		"m=video 0 UDP/TLS/RTP/SAVPF 96\r\na=mid:1\r\na=ssrc:2 msid:B video-B\r\na=sendonly\r\na=rtpmap:96 VP8/90000\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:2\r\na=ssrc:5 msid:E video-E\r\na=sendonly\r\na=rtpmap:96 VP8/90000\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:3\r\na=inactive\r\na=rtpmap:96 VP8/90000\r\n"
+
+	ended, err := endedTracks(tracks, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ended) != 3 || ended[0].Label() != "B" || ended[1].Label() != "C" || ended[2].Label() != "D" {
+		labels := []string{}
+		for _, track := range ended {
+			labels = append(labels, track.Label())
+		}
+		t.Errorf("expected B, C and D to be ended, but got %v", labels)
+	}
+}
@@ -0,0 +1,134 @@
+package sora
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/hakobera/go-sora/sora"
+
+// span の属性キー
+const (
+	attrChannelID    = attribute.Key("sora.channel_id")
+	attrConnectionID = attribute.Key("sora.connection_id")
+	attrClientID     = attribute.Key("sora.client_id")
+	attrRole         = attribute.Key("sora.role")
+	attrSoraVersion  = attribute.Key("sora.version")
+	attrICEState     = attribute.Key("sora.ice_connection_state")
+	attrMessageType  = attribute.Key("sora.message_type")
+)
+
+func (c *Connection) tracer() trace.Tracer {
+	tp := c.Options.TracerProvider
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	return tp.Tracer(tracerName, trace.WithInstrumentationVersion(clientVersion))
+}
+
+// startSpan は channel_id と、確定していれば connection_id, client_id を属性に持つ span を開始します。
+func (c *Connection) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attrChannelID.String(c.Options.ChannelID))
+	if connectionID := c.ConnectionID(); connectionID != "" {
+		attrs = append(attrs, attrConnectionID.String(connectionID))
+	}
+	if clientID := c.ClientID(); clientID != "" {
+		attrs = append(attrs, attrClientID.String(clientID))
+	}
+	return c.tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// startConnectSpan はシグナリング開始から ICE 接続完了までを表す span を開始します。
+func (c *Connection) startConnectSpan() context.Context {
+	ctx, span := c.startSpan(context.Background(), "sora.connect", attrRole.String(string(c.Options.Role)))
+
+	c.spanMu.Lock()
+	c.connectCtx = ctx
+	c.connectSpan = span
+	c.spanMu.Unlock()
+	return ctx
+}
+
+// connectContext は sora.connect span を親に持つ context を返します。接続完了後は context.Background() を返します。
+func (c *Connection) connectContext() context.Context {
+	c.spanMu.Lock()
+	defer c.spanMu.Unlock()
+
+	if c.connectCtx == nil {
+		return context.Background()
+	}
+	return c.connectCtx
+}
+
+// startWaitSpan は接続中にサーバーからの応答を待つ span を開始します。終了は endWaitSpans で行います。
+func (c *Connection) startWaitSpan(key string, name string) {
+	ctx := c.connectContext()
+	_, span := c.startSpan(ctx, name)
+
+	c.spanMu.Lock()
+	defer c.spanMu.Unlock()
+
+	if c.waitSpans == nil {
+		c.waitSpans = map[string]trace.Span{}
+	}
+	if old, ok := c.waitSpans[key]; ok {
+		old.End()
+	}
+	c.waitSpans[key] = span
+}
+
+func (c *Connection) endWaitSpan(key string, err error, attrs ...attribute.KeyValue) {
+	c.spanMu.Lock()
+	span, ok := c.waitSpans[key]
+	delete(c.waitSpans, key)
+	c.spanMu.Unlock()
+
+	if !ok {
+		return
+	}
+	span.SetAttributes(attrs...)
+	if connectionID := c.ConnectionID(); connectionID != "" {
+		span.SetAttributes(attrConnectionID.String(connectionID))
+	}
+	endSpan(span, err)
+}
+
+// endConnectSpan は sora.connect span と、未終了の待ち span を終了します。
+func (c *Connection) endConnectSpan(err error) {
+	c.spanMu.Lock()
+	span := c.connectSpan
+	waitSpans := c.waitSpans
+	c.connectCtx = nil
+	c.connectSpan = nil
+	c.waitSpans = nil
+	c.spanMu.Unlock()
+
+	for _, s := range waitSpans {
+		endSpan(s, err)
+	}
+
+	if span == nil {
+		return
+	}
+	if connectionID := c.ConnectionID(); connectionID != "" {
+		span.SetAttributes(attrConnectionID.String(connectionID))
+	}
+	if clientID := c.ClientID(); clientID != "" {
+		span.SetAttributes(attrClientID.String(clientID))
+	}
+	if soraVersion := c.SoraVersion(); soraVersion != "" {
+		span.SetAttributes(attrSoraVersion.String(soraVersion))
+	}
+	endSpan(span, err)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,104 @@
+package sora
+
+import (
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func waitSpan(t *testing.T, exporter *tracetest.InMemoryExporter, name string) tracetest.SpanStub {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, s := range exporter.GetSpans() {
+			if s.Name == name {
+				return s
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("span %q was not recorded", name)
+	return tracetest.SpanStub{}
+}
+
+func spanAttribute(s tracetest.SpanStub, key string) string {
+	for _, kv := range s.Attributes {
+		if string(kv.Key) == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestTracingSignalingHandshake(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	s := newFakeSora(t, fakePublisher{ConnectionID: "publisher-1", Audio: true, Video: true})
+
+	opts := DefaultOptions()
+	opts.TracerProvider = tp
+	c := NewConnection(s.URL(), "sora", opts)
+	defer c.Disconnect()
+
+	connected := make(chan struct{}, 1)
+	c.OnConnect(func() {
+		connected <- struct{}{}
+	})
+
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("connection timeout")
+	}
+
+	ss := s.session(0)
+	if err := ss.reoffer("update"); err != nil {
+		t.Fatal(err)
+	}
+	ss.expect("update")
+
+	connect := waitSpan(t, exporter, "sora.connect")
+	if got := spanAttribute(connect, "sora.channel_id"); got != "sora" {
+		t.Errorf("sora.connect channel_id: expected sora, but got %q", got)
+	}
+	if got := spanAttribute(connect, "sora.connection_id"); got != "fake-connection-id" {
+		t.Errorf("sora.connect connection_id: expected fake-connection-id, but got %q", got)
+	}
+
+	children := []string{
+		"sora.openWS",
+		"sora.sendConnectMessage",
+		"sora.waitOffer",
+		"sora.createPeerConnection",
+		"sora.setOffer",
+		"sora.iceConnected",
+	}
+	for _, name := range children {
+		s := waitSpan(t, exporter, name)
+		if s.SpanContext.TraceID() != connect.SpanContext.TraceID() {
+			t.Errorf("%s: expected to be in the sora.connect trace", name)
+		}
+	}
+
+	update := waitSpan(t, exporter, "sora.update")
+	if got := spanAttribute(update, "sora.connection_id"); got != "fake-connection-id" {
+		t.Errorf("sora.update connection_id: expected fake-connection-id, but got %q", got)
+	}
+
+	var setOffers int
+	for _, s := range exporter.GetSpans() {
+		if s.Name == "sora.setOffer" && s.Parent.SpanID() == update.SpanContext.SpanID() {
+			setOffers++
+		}
+	}
+	if setOffers != 1 {
+		t.Errorf("expected sora.setOffer under sora.update, but got %d", setOffers)
+	}
+}
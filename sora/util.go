@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/rand"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
@@ -28,20 +29,48 @@ func unmarshalMessage(c *Connection, rawMessage []byte, v interface{}) error {
 	return nil
 }
 
+// metadataValue は nil のポインタや map、空の json.RawMessage を nil にして、connect メッセージで省略されるようにします。
+func metadataValue(v interface{}) interface{} {
+	if m, ok := v.(json.RawMessage); ok && len(m) == 0 {
+		return nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return nil
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		if rv.IsNil() {
+			return nil
+		}
+	}
+	return v
+}
+
 func strPtr(s string) *string {
 	return &s
 }
 
-func createOfferSessionDescription(sdp string) webrtc.SessionDescription {
+var tiasRegexp = regexp.MustCompile("b=TIAS:\\d+\\r\\n")
+
+// createOfferSessionDescription は ICE の設定で候補を絞り込み、OnRemoteSDP で書き換えた offer を返します。
+// offer の a=extmap から、ネゴシエーションする RTP ヘッダー拡張も決めます。
+func (c *Connection) createOfferSessionDescription(sdp string) (webrtc.SessionDescription, error) {
+	sdp, err := transformSDP(cleanupSDP(c.iceOptions().filterCandidates(sdp)), c.handlers().onRemoteSDPHandler)
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	if err := c.updateHeaderExtensions(sdp); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
 	return webrtc.SessionDescription{
 		Type: webrtc.SDPTypeOffer,
-		SDP:  cleanupSDP(sdp),
-	}
+		SDP:  sdp,
+	}, nil
 }
 
 func cleanupSDP(sdp string) string {
-	rep := regexp.MustCompile("b=TIAS:\\d+\\r\\n")
-	return rep.ReplaceAllString(sdp, "")
+	return tiasRegexp.ReplaceAllString(sdp, "")
 }
 
 func populateFromSDP(sd webrtc.SessionDescription) ([]*webrtc.RTPCodec, error) {
@@ -85,6 +114,8 @@ func populateFromSDP(sd webrtc.SessionDescription) ([]*webrtc.RTPCodec, error) {
 				codec = webrtc.NewRTPVP9Codec(payloadType, payloadCodec.ClockRate)
 			case strings.EqualFold(payloadCodec.Name, webrtc.H264):
 				codec = webrtc.NewRTPH264Codec(payloadType, payloadCodec.ClockRate)
+			case strings.EqualFold(payloadCodec.Name, string(VideoCodecTypeAV1)):
+				codec = webrtc.NewRTPCodec(webrtc.RTPCodecTypeVideo, string(VideoCodecTypeAV1), payloadCodec.ClockRate, 0, "", payloadType, nil)
 			default:
 				// ignoring other codecs
 				continue
@@ -1,6 +1,9 @@
 package sora
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+)
 
 func TestCleanupSDP(t *testing.T) {
 	cases := []struct {
@@ -24,3 +27,34 @@ func TestCleanupSDP(t *testing.T) {
 		}
 	}
 }
+
+func TestMetadataValue(t *testing.T) {
+	var nilMetadata *Metadata
+	var nilMap map[string]interface{}
+
+	cases := []struct {
+		in       interface{}
+		expected string
+	}{
+		{nil, `{}`},
+		{nilMetadata, `{}`},
+		{nilMap, `{}`},
+		{json.RawMessage{}, `{}`},
+		{&Metadata{SignalingKey: "key"}, `{"metadata":{"signaling_key":"key","turn_tcp_only":false,"turn_tls_only":false}}`},
+		{map[string]interface{}{"token": "t"}, `{"metadata":{"token":"t"}}`},
+		{json.RawMessage(`{"token":"t"}`), `{"metadata":{"token":"t"}}`},
+		{"token", `{"metadata":"token"}`},
+	}
+
+	for _, c := range cases {
+		b, err := json.Marshal(struct {
+			Metadata interface{} `json:"metadata,omitempty"`
+		}{metadataValue(c.in)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != c.expected {
+			t.Errorf("%#v: expected %s, but got %s", c.in, c.expected, b)
+		}
+	}
+}
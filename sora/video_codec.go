@@ -0,0 +1,102 @@
+package sora
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	// defaultPayloadTypeAV1 は pion/webrtc v2 に定義がないので、Chrome が使う値にしています
+	defaultPayloadTypeAV1 = 45
+
+	// defaultH264ProfileLevelID は profile-level-id がない場合の値です (RFC 6184)
+	defaultH264ProfileLevelID = "420010"
+)
+
+// selectVideoCodec は offer のコーデックから、video の CodecType とコーデックごとの設定に一致するものを選びます。
+// コーデックごとの設定がない場合は、名前が一致する最初のコーデックを返します。
+func selectVideoCodec(codecs []*webrtc.RTPCodec, video *Video) (*webrtc.RTPCodec, error) {
+	videoCodec, err := CreateVideoCodec(video.CodecType)
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, codec := range codecs {
+		if codec.Type != webrtc.RTPCodecTypeVideo || !strings.EqualFold(codec.Name, videoCodec.Name) {
+			continue
+		}
+		found = true
+		if video.matchFmtp(parseFmtp(codec.SDPFmtpLine)) {
+			return codec, nil
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Remote peer does not support %s", video.CodecType)
+	}
+	return nil, fmt.Errorf("Remote peer does not support %s with %s", video.CodecType, video.paramsString())
+}
+
+// matchFmtp は fmtp が CodecType に合わせたコーデックごとの設定に一致するかどうかを返します。
+func (v *Video) matchFmtp(fmtp map[string]string) bool {
+	switch v.CodecType {
+	case VideoCodecTypeVP9:
+		if v.VP9Params != nil {
+			return fmtpInt(fmtp, "profile-id") == v.VP9Params.ProfileID
+		}
+	case VideoCodecTypeAV1:
+		if v.AV1Params != nil {
+			return fmtpInt(fmtp, "profile") == v.AV1Params.Profile
+		}
+	case VideoCodecTypeH264:
+		if v.H264Params != nil {
+			id, ok := fmtp["profile-level-id"]
+			if !ok {
+				id = defaultH264ProfileLevelID
+			}
+			return strings.EqualFold(id, v.H264Params.ProfileLevelID)
+		}
+	}
+	return true
+}
+
+func (v *Video) paramsString() string {
+	switch {
+	case v.CodecType == VideoCodecTypeVP9 && v.VP9Params != nil:
+		return fmt.Sprintf("profile-id=%d", v.VP9Params.ProfileID)
+	case v.CodecType == VideoCodecTypeAV1 && v.AV1Params != nil:
+		return fmt.Sprintf("profile=%d", v.AV1Params.Profile)
+	case v.CodecType == VideoCodecTypeH264 && v.H264Params != nil:
+		return fmt.Sprintf("profile-level-id=%s", v.H264Params.ProfileLevelID)
+	}
+	return ""
+}
+
+// parseFmtp は a=fmtp の key=value;key=value の形式をパースします。キーは小文字にします。
+func parseFmtp(line string) map[string]string {
+	params := map[string]string{}
+	for _, p := range strings.Split(line, ";") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if kv[0] == "" {
+			continue
+		}
+		value := ""
+		if len(kv) == 2 {
+			value = strings.TrimSpace(kv[1])
+		}
+		params[strings.ToLower(kv[0])] = value
+	}
+	return params
+}
+
+// fmtpInt は fmtp の数値のパラメーターを返します。ない場合は 0 です。
+func fmtpInt(fmtp map[string]string, key string) int {
+	n, err := strconv.Atoi(fmtp[key])
+	if err != nil {
+		return 0
+	}
+	return n
+}
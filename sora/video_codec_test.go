@@ -0,0 +1,105 @@
+package sora
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v2"
+)
+
+var videoCodecOffer = strings.Join([]string{
+	"v=0",
+	"o=- 0 0 IN IP4 127.0.0.1",
+	"s=-",
+	"t=0 0",
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+	"c=IN IP4 0.0.0.0",
+	"a=rtpmap:111 opus/48000/2",
+	"a=fmtp:111 minptime=10;useinbandfec=1",
+	"m=video 9 UDP/TLS/RTP/SAVPF 96 98 100 102 125 127 45 35",
+	"c=IN IP4 0.0.0.0",
+	"a=rtpmap:96 VP8/90000",
+	"a=rtpmap:98 VP9/90000",
+	"a=fmtp:98 profile-id=0",
+	"a=rtpmap:100 VP9/90000",
+	"a=fmtp:100 profile-id=2",
+	"a=rtpmap:102 H264/90000",
+	"a=fmtp:102 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f",
+	"a=rtpmap:125 H264/90000",
+	"a=fmtp:125 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42E01F",
+	"a=rtpmap:127 H264/90000",
+	"a=fmtp:127 packetization-mode=1",
+	"a=rtpmap:45 AV1/90000",
+	"a=rtpmap:35 AV1/90000",
+	"a=fmtp:35 profile=1",
+	"",
+}, "\r\n")
+
+func TestSelectVideoCodec(t *testing.T) {
+	codecs, err := populateFromSDP(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: videoCodecOffer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name        string
+		video       Video
+		payloadType uint8
+	}{
+		{"VP8", Video{CodecType: VideoCodecTypeVP8}, 96},
+		{"VP9 without params", Video{CodecType: VideoCodecTypeVP9}, 98},
+		{"VP9 profile 2", Video{CodecType: VideoCodecTypeVP9, VP9Params: &VP9Params{ProfileID: 2}}, 100},
+		{"VP9 ignores other params", Video{CodecType: VideoCodecTypeVP9, H264Params: &H264Params{ProfileLevelID: "42e01f"}}, 98},
+		{"H264 without params", Video{CodecType: VideoCodecTypeH264}, 102},
+		{"H264 profile-level-id", Video{CodecType: VideoCodecTypeH264, H264Params: &H264Params{ProfileLevelID: "42e01f"}}, 125},
+		{"H264 default profile-level-id", Video{CodecType: VideoCodecTypeH264, H264Params: &H264Params{ProfileLevelID: "420010"}}, 127},
+		{"AV1 profile 0", Video{CodecType: VideoCodecTypeAV1, AV1Params: &AV1Params{Profile: 0}}, 45},
+		{"AV1 profile 1", Video{CodecType: VideoCodecTypeAV1, AV1Params: &AV1Params{Profile: 1}}, 35},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			codec, err := selectVideoCodec(codecs, &tc.video)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if codec.PayloadType != tc.payloadType {
+				t.Errorf("expected payload type %d, but got %d", tc.payloadType, codec.PayloadType)
+			}
+		})
+	}
+
+	errors := []Video{
+		{CodecType: VideoCodecTypeVP9, VP9Params: &VP9Params{ProfileID: 1}},
+		{CodecType: VideoCodecTypeH264, H264Params: &H264Params{ProfileLevelID: "640c1f"}},
+		{CodecType: VideoCodecTypeH265},
+	}
+	for _, video := range errors {
+		if _, err := selectVideoCodec(codecs, &video); err == nil {
+			t.Errorf("expected error for %+v", video)
+		}
+	}
+}
+
+func TestVideoParamsJSON(t *testing.T) {
+	cases := []struct {
+		video Video
+		json  string
+	}{
+		{Video{CodecType: VideoCodecTypeVP9}, `{"codec_type":"VP9"}`},
+		{Video{CodecType: VideoCodecTypeVP9, VP9Params: &VP9Params{ProfileID: 0}}, `{"codec_type":"VP9","vp9_params":{"profile_id":0}}`},
+		{Video{CodecType: VideoCodecTypeAV1, BitRate: 1000, AV1Params: &AV1Params{Profile: 1}}, `{"codec_type":"AV1","bitrate":1000,"av1_params":{"profile":1}}`},
+		{Video{CodecType: VideoCodecTypeH264, H264Params: &H264Params{ProfileLevelID: "42e01f"}}, `{"codec_type":"H264","h264_params":{"profile_level_id":"42e01f"}}`},
+	}
+
+	for _, tc := range cases {
+		b, err := json.Marshal(tc.video)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tc.json {
+			t.Errorf("expected %s, but got %s", tc.json, b)
+		}
+	}
+}
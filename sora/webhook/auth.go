@@ -0,0 +1,213 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/hakobera/go-sora/sora"
+)
+
+// AuthRequest は Sora が認証 Webhook に送るリクエスト
+// https://sora-doc.shiguredo.jp/auth_webhook
+type AuthRequest struct {
+	ID           string    `json:"id"`
+	Timestamp    string    `json:"timestamp"`
+	ChannelID    string    `json:"channel_id"`
+	ClientID     string    `json:"client_id"`
+	ConnectionID string    `json:"connection_id"`
+	Role         sora.Role `json:"role"`
+	Multistream  bool      `json:"multistream"`
+	Spotlight    bool      `json:"spotlight"`
+	Simulcast    bool      `json:"simulcast"`
+	Audio        bool      `json:"audio"`
+	Video        Video     `json:"video"`
+	Environment  string    `json:"environment"`
+	SoraClient   string    `json:"sora_client"`
+
+	// Metadata は connect メッセージの metadata を sora.Metadata としてデコードしたもの
+	Metadata *sora.Metadata `json:"-"`
+	// RawMetadata は connect メッセージの metadata そのもの
+	RawMetadata json.RawMessage `json:"metadata"`
+
+	ChannelConnections         int `json:"channel_connections"`
+	ChannelSendrecvConnections int `json:"channel_sendrecv_connections"`
+	ChannelSendonlyConnections int `json:"channel_sendonly_connections"`
+	ChannelRecvonlyConnections int `json:"channel_recvonly_connections"`
+}
+
+// UnmarshalJSON は metadata を RawMetadata と Metadata の両方にデコードします。
+func (r *AuthRequest) UnmarshalJSON(b []byte) error {
+	type authRequest AuthRequest
+	if err := json.Unmarshal(b, (*authRequest)(r)); err != nil {
+		return err
+	}
+
+	r.Metadata = nil
+	if len(r.RawMetadata) > 0 && !bytes.Equal(r.RawMetadata, []byte("null")) {
+		m := &sora.Metadata{}
+		// metadata が object でない場合は sora.Metadata としては扱わない
+		if err := json.Unmarshal(r.RawMetadata, m); err == nil {
+			r.Metadata = m
+		}
+	}
+	return nil
+}
+
+// Validate は認証に必要な項目がそろっているかを検証します。
+func (r *AuthRequest) Validate() error {
+	if r.ChannelID == "" {
+		return errors.New("channel_id is required")
+	}
+	if r.ConnectionID == "" {
+		return errors.New("connection_id is required")
+	}
+	switch r.Role {
+	case sora.SendRecvRole, sora.SendOnlyRole, sora.RecvOnlyRole:
+	default:
+		return fmt.Errorf("invalid role '%s'", r.Role)
+	}
+	return nil
+}
+
+// CheckSignalingKey は metadata の signaling_key が key と一致するかを、比較時間が一定になるように検証します。
+func (r *AuthRequest) CheckSignalingKey(key string) bool {
+	if r.Metadata == nil || key == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Metadata.SignalingKey), []byte(key)) == 1
+}
+
+// Video は認証 Webhook の video です。Sora は false、true、またはビデオの設定を送ります。
+type Video struct {
+	Enabled bool
+	sora.Video
+}
+
+// UnmarshalJSON は true/false とビデオの設定の両方をデコードします。
+func (v *Video) UnmarshalJSON(b []byte) error {
+	switch string(bytes.TrimSpace(b)) {
+	case "true":
+		*v = Video{Enabled: true}
+		return nil
+	case "false", "null":
+		*v = Video{}
+		return nil
+	}
+
+	video := sora.Video{}
+	if err := json.Unmarshal(b, &video); err != nil {
+		return err
+	}
+	*v = Video{Enabled: true, Video: video}
+	return nil
+}
+
+// MarshalJSON は設定がない場合は true/false を、ある場合はビデオの設定をエンコードします。
+func (v Video) MarshalJSON() ([]byte, error) {
+	if !v.Enabled {
+		return []byte("false"), nil
+	}
+	if v.Video == (sora.Video{}) {
+		return []byte("true"), nil
+	}
+	return json.Marshal(v.Video)
+}
+
+// AuthResponse は認証 Webhook のレスポンス
+// Allowed が true の場合、nil でない項目でコネクションの設定を上書きします。
+type AuthResponse struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+
+	ClientID        string      `json:"client_id,omitempty"`
+	Audio           *bool       `json:"audio,omitempty"`
+	Video           *Video      `json:"video,omitempty"`
+	VideoBitRate    *uint16     `json:"video_bit_rate,omitempty"`
+	SpotlightNumber *uint8      `json:"spotlight_number,omitempty"`
+	EventMetadata   interface{} `json:"event_metadata,omitempty"`
+
+	// Metadata と AuthzMetadata は offer メッセージでクライアントに渡す metadata と authz_metadata
+	Metadata      interface{} `json:"metadata,omitempty"`
+	AuthzMetadata interface{} `json:"authz_metadata,omitempty"`
+}
+
+// Allow は接続を許可するレスポンスを返します。
+func Allow() *AuthResponse {
+	return &AuthResponse{Allowed: true}
+}
+
+// Deny は reason を理由に接続を拒否するレスポンスを返します。
+func Deny(reason string) *AuthResponse {
+	return &AuthResponse{Allowed: false, Reason: reason}
+}
+
+// WithAudio は音声の有無を上書きします。
+func (r *AuthResponse) WithAudio(audio bool) *AuthResponse {
+	r.Audio = &audio
+	return r
+}
+
+// WithVideo はビデオの設定を上書きします。nil の場合はビデオを無効にします。
+func (r *AuthResponse) WithVideo(video *sora.Video) *AuthResponse {
+	if video == nil {
+		r.Video = &Video{}
+		return r
+	}
+	r.Video = &Video{Enabled: true, Video: *video}
+	return r
+}
+
+// WithVideoBitRate はビデオのビットレート (kbps) を上書きします。
+func (r *AuthResponse) WithVideoBitRate(bitRate uint16) *AuthResponse {
+	r.VideoBitRate = &bitRate
+	return r
+}
+
+// WithSpotlightNumber はスポットライトの数を上書きします。
+func (r *AuthResponse) WithSpotlightNumber(n uint8) *AuthResponse {
+	r.SpotlightNumber = &n
+	return r
+}
+
+// WithEventMetadata はイベント Webhook に含めるメタデータを設定します。
+func (r *AuthResponse) WithEventMetadata(v interface{}) *AuthResponse {
+	r.EventMetadata = v
+	return r
+}
+
+// WithMetadata は offer メッセージの metadata としてクライアントに渡す値を設定します。
+func (r *AuthResponse) WithMetadata(v interface{}) *AuthResponse {
+	r.Metadata = v
+	return r
+}
+
+// WithAuthzMetadata は offer メッセージの authz_metadata としてクライアントに渡す値を設定します。
+func (r *AuthResponse) WithAuthzMetadata(v interface{}) *AuthResponse {
+	r.AuthzMetadata = v
+	return r
+}
+
+// AuthFunc は認証 Webhook のリクエストを受け取り、接続の可否を返す関数です。
+// nil を返した場合は接続を拒否します。
+type AuthFunc func(ctx context.Context, req *AuthRequest) *AuthResponse
+
+// NewAuthHandler は認証 Webhook の http.Handler を返します。
+func NewAuthHandler(f AuthFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &AuthRequest{}
+		if !readJSON(w, r, req) {
+			return
+		}
+
+		res := f(r.Context(), req)
+		if res == nil {
+			res = Deny("")
+		}
+		writeJSON(w, res)
+	})
+}
@@ -0,0 +1,133 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hakobera/go-sora/sora"
+)
+
+func postJSON(t *testing.T, h http.Handler, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuthHandler(t *testing.T) {
+	h := NewAuthHandler(func(ctx context.Context, req *AuthRequest) *AuthResponse {
+		if err := req.Validate(); err != nil {
+			return Deny(err.Error())
+		}
+		if !req.CheckSignalingKey("secret") {
+			return Deny("invalid signaling_key")
+		}
+		return Allow().
+			WithAudio(false).
+			WithVideo(&sora.Video{CodecType: sora.VideoCodecTypeVP8}).
+			WithVideoBitRate(500).
+			WithSpotlightNumber(2).
+			WithEventMetadata(map[string]string{"room": "A"}).
+			WithMetadata(map[string]string{"name": "alice"}).
+			WithAuthzMetadata(map[string]bool{"is_admin": true})
+	})
+
+	cases := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{
+			name:     "allowed",
+			body:     `{"channel_id":"sora","connection_id":"C1","role":"sendrecv","audio":true,"video":true,"metadata":{"signaling_key":"secret"}}`,
+			expected: `{"allowed":true,"audio":false,"video":{"codec_type":"VP8"},"video_bit_rate":500,"spotlight_number":2,"event_metadata":{"room":"A"},"metadata":{"name":"alice"},"authz_metadata":{"is_admin":true}}`,
+		},
+		{
+			name:     "invalid signaling key",
+			body:     `{"channel_id":"sora","connection_id":"C1","role":"sendrecv","metadata":{"signaling_key":"wrong"}}`,
+			expected: `{"allowed":false,"reason":"invalid signaling_key"}`,
+		},
+		{
+			name:     "metadata is not an object",
+			body:     `{"channel_id":"sora","connection_id":"C1","role":"sendrecv","metadata":"secret"}`,
+			expected: `{"allowed":false,"reason":"invalid signaling_key"}`,
+		},
+		{
+			name:     "invalid role",
+			body:     `{"channel_id":"sora","connection_id":"C1","role":"viewer"}`,
+			expected: `{"allowed":false,"reason":"invalid role 'viewer'"}`,
+		},
+	}
+
+	for _, c := range cases {
+		rec := postJSON(t, h, c.body)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, but got %d", c.name, rec.Code)
+			continue
+		}
+		if got := rec.Body.String(); got != c.expected {
+			t.Errorf("%s: expected %s, but got %s", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestAuthHandlerBadRequest(t *testing.T) {
+	h := NewAuthHandler(func(ctx context.Context, req *AuthRequest) *AuthResponse {
+		return Allow()
+	})
+
+	if rec := postJSON(t, h, `{`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid JSON, but got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, but got %d", rec.Code)
+	}
+}
+
+func TestAuthHandlerNilResponseDenies(t *testing.T) {
+	h := NewAuthHandler(func(ctx context.Context, req *AuthRequest) *AuthResponse {
+		return nil
+	})
+	rec := postJSON(t, h, `{"channel_id":"sora"}`)
+	if got := rec.Body.String(); got != `{"allowed":false}` {
+		t.Errorf("expected denied, but got %s", got)
+	}
+}
+
+func TestVideoJSON(t *testing.T) {
+	cases := []struct {
+		in       string
+		expected Video
+	}{
+		{`true`, Video{Enabled: true}},
+		{`false`, Video{}},
+		{`{"codec_type":"VP9","bitrate":300}`, Video{Enabled: true, Video: sora.Video{CodecType: sora.VideoCodecTypeVP9, BitRate: 300}}},
+	}
+
+	for _, c := range cases {
+		var v Video
+		if err := json.Unmarshal([]byte(c.in), &v); err != nil {
+			t.Fatal(err)
+		}
+		if v != c.expected {
+			t.Errorf("%s: expected %+v, but got %+v", c.in, c.expected, v)
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != c.in {
+			t.Errorf("expected %s, but got %s", c.in, b)
+		}
+	}
+}
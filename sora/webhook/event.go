@@ -0,0 +1,287 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/hakobera/go-sora/sora"
+)
+
+// Event は Sora がイベント Webhook に送るリクエスト
+// https://sora-doc.shiguredo.jp/event_webhook
+type Event struct {
+	ID           string          `json:"id"`
+	Type         string          `json:"type"`
+	Timestamp    string          `json:"timestamp"`
+	ChannelID    string          `json:"channel_id"`
+	SessionID    string          `json:"session_id"`
+	ClientID     string          `json:"client_id"`
+	ConnectionID string          `json:"connection_id"`
+	Role         sora.Role       `json:"role"`
+	Data         json.RawMessage `json:"data"`
+
+	// EventMetadata は認証 Webhook で返した event_metadata
+	EventMetadata json.RawMessage `json:"event_metadata"`
+
+	// Raw は Sora から受け取ったリクエストボディそのもの
+	Raw json.RawMessage `json:"-"`
+}
+
+// UnmarshalJSON は各項目に加えて、受け取った JSON を Raw に保存します。
+func (e *Event) UnmarshalJSON(b []byte) error {
+	type event Event
+	if err := json.Unmarshal(b, (*event)(e)); err != nil {
+		return err
+	}
+	e.Raw = make(json.RawMessage, len(b))
+	copy(e.Raw, b)
+	return nil
+}
+
+// Base は共通項目を持つ Event を返します。
+func (e *Event) Base() *Event {
+	return e
+}
+
+// TypedEvent はイベント Webhook のリクエストを type ごとの型に変換したものです。
+// 実装は webhook パッケージ内の型に限られます。type に応じて型スイッチで判別してください。
+type TypedEvent interface {
+	// Base は共通項目を持つ Event を返します。
+	Base() *Event
+
+	typedEvent()
+}
+
+// ConnectionEventData は connection.created, connection.updated, connection.destroyed の data
+type ConnectionEventData struct {
+	Audio   bool  `json:"audio"`
+	Video   Video `json:"video"`
+	Minutes int   `json:"minutes"`
+
+	CreatedTime   int64 `json:"created_time,omitempty"`
+	DestroyedTime int64 `json:"destroyed_time,omitempty"`
+
+	TotalReceivedBytes int64 `json:"total_received_bytes,omitempty"`
+	TotalSentBytes     int64 `json:"total_sent_bytes,omitempty"`
+
+	ChannelConnections         int `json:"channel_connections,omitempty"`
+	ChannelSendrecvConnections int `json:"channel_sendrecv_connections,omitempty"`
+	ChannelSendonlyConnections int `json:"channel_sendonly_connections,omitempty"`
+	ChannelRecvonlyConnections int `json:"channel_recvonly_connections,omitempty"`
+}
+
+// ConnectionFailedEventData は connection.failed の data
+type ConnectionFailedEventData struct {
+	Message string `json:"message"`
+}
+
+// RecordingEventData は recording.started, recording.report の data
+type RecordingEventData struct {
+	RecordingID string `json:"recording_id"`
+
+	Filename         string `json:"filename,omitempty"`
+	FilePath         string `json:"file_path,omitempty"`
+	MetadataFilename string `json:"metadata_filename,omitempty"`
+	MetadataFilePath string `json:"metadata_file_path,omitempty"`
+
+	ExpireTime int64 `json:"expire_time,omitempty"`
+}
+
+// ArchiveEventData は archive.started, archive.available, archive.failed と split-archive.* の data
+type ArchiveEventData struct {
+	RecordingID string `json:"recording_id"`
+
+	Filename         string `json:"filename,omitempty"`
+	FilePath         string `json:"file_path,omitempty"`
+	MetadataFilename string `json:"metadata_filename,omitempty"`
+	MetadataFilePath string `json:"metadata_file_path,omitempty"`
+
+	Size     int64   `json:"size,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+
+	// Reason は archive.failed, split-archive.failed の失敗理由
+	Reason string `json:"reason,omitempty"`
+}
+
+// SpotlightEventData は spotlight.focused, spotlight.unfocused の data
+type SpotlightEventData struct {
+	SpotNumber int  `json:"spot_number"`
+	Fixed      bool `json:"fixed"`
+}
+
+// ConnectionCreatedEvent は type が connection.created のイベント
+type ConnectionCreatedEvent struct {
+	Event
+	Data ConnectionEventData
+}
+
+// ConnectionUpdatedEvent は type が connection.updated のイベント
+type ConnectionUpdatedEvent struct {
+	Event
+	Data ConnectionEventData
+}
+
+// ConnectionDestroyedEvent は type が connection.destroyed のイベント
+type ConnectionDestroyedEvent struct {
+	Event
+	Data ConnectionEventData
+}
+
+// ConnectionFailedEvent は type が connection.failed のイベント
+type ConnectionFailedEvent struct {
+	Event
+	Data ConnectionFailedEventData
+}
+
+// RecordingStartedEvent は type が recording.started のイベント
+type RecordingStartedEvent struct {
+	Event
+	Data RecordingEventData
+}
+
+// RecordingReportEvent は type が recording.report のイベント
+type RecordingReportEvent struct {
+	Event
+	Data RecordingEventData
+}
+
+// ArchiveStartedEvent は type が archive.started または split-archive.started のイベント
+type ArchiveStartedEvent struct {
+	Event
+	Data ArchiveEventData
+}
+
+// ArchiveAvailableEvent は type が archive.available または split-archive.available のイベント
+type ArchiveAvailableEvent struct {
+	Event
+	Data ArchiveEventData
+}
+
+// ArchiveEndEvent は type が split-archive.end のイベント
+type ArchiveEndEvent struct {
+	Event
+	Data ArchiveEventData
+}
+
+// ArchiveFailedEvent は type が archive.failed または split-archive.failed のイベント
+type ArchiveFailedEvent struct {
+	Event
+	Data ArchiveEventData
+}
+
+// SpotlightFocusedEvent は type が spotlight.focused のイベント
+type SpotlightFocusedEvent struct {
+	Event
+	Data SpotlightEventData
+}
+
+// SpotlightUnfocusedEvent は type が spotlight.unfocused のイベント
+type SpotlightUnfocusedEvent struct {
+	Event
+	Data SpotlightEventData
+}
+
+// UnknownEvent は go-sora が知らない type のイベント
+// 新しいバージョンの Sora が追加したイベントを受け取った場合も、Event.Data から内容を取り出せます。
+type UnknownEvent struct {
+	Event
+}
+
+func (*ConnectionCreatedEvent) typedEvent()   {}
+func (*ConnectionUpdatedEvent) typedEvent()   {}
+func (*ConnectionDestroyedEvent) typedEvent() {}
+func (*ConnectionFailedEvent) typedEvent()    {}
+func (*RecordingStartedEvent) typedEvent()    {}
+func (*RecordingReportEvent) typedEvent()     {}
+func (*ArchiveStartedEvent) typedEvent()      {}
+func (*ArchiveAvailableEvent) typedEvent()    {}
+func (*ArchiveEndEvent) typedEvent()          {}
+func (*ArchiveFailedEvent) typedEvent()       {}
+func (*SpotlightFocusedEvent) typedEvent()    {}
+func (*SpotlightUnfocusedEvent) typedEvent()  {}
+func (*UnknownEvent) typedEvent()             {}
+
+// ParseEvent はイベント Webhook のリクエストボディを type に対応する TypedEvent に変換します。
+func ParseEvent(b []byte) (TypedEvent, error) {
+	base := Event{}
+	if err := json.Unmarshal(b, &base); err != nil {
+		return nil, err
+	}
+	return base.typed()
+}
+
+// typed は Event を type に対応する TypedEvent に変換し、data をデコードします。
+func (e *Event) typed() (TypedEvent, error) {
+	var event TypedEvent
+	var data interface{}
+
+	switch e.Type {
+	case "connection.created":
+		ev := &ConnectionCreatedEvent{Event: *e}
+		event, data = ev, &ev.Data
+	case "connection.updated":
+		ev := &ConnectionUpdatedEvent{Event: *e}
+		event, data = ev, &ev.Data
+	case "connection.destroyed":
+		ev := &ConnectionDestroyedEvent{Event: *e}
+		event, data = ev, &ev.Data
+	case "connection.failed":
+		ev := &ConnectionFailedEvent{Event: *e}
+		event, data = ev, &ev.Data
+	case "recording.started":
+		ev := &RecordingStartedEvent{Event: *e}
+		event, data = ev, &ev.Data
+	case "recording.report":
+		ev := &RecordingReportEvent{Event: *e}
+		event, data = ev, &ev.Data
+	case "archive.started", "split-archive.started":
+		ev := &ArchiveStartedEvent{Event: *e}
+		event, data = ev, &ev.Data
+	case "archive.available", "split-archive.available":
+		ev := &ArchiveAvailableEvent{Event: *e}
+		event, data = ev, &ev.Data
+	case "split-archive.end":
+		ev := &ArchiveEndEvent{Event: *e}
+		event, data = ev, &ev.Data
+	case "archive.failed", "split-archive.failed":
+		ev := &ArchiveFailedEvent{Event: *e}
+		event, data = ev, &ev.Data
+	case "spotlight.focused":
+		ev := &SpotlightFocusedEvent{Event: *e}
+		event, data = ev, &ev.Data
+	case "spotlight.unfocused":
+		ev := &SpotlightUnfocusedEvent{Event: *e}
+		event, data = ev, &ev.Data
+	default:
+		return &UnknownEvent{Event: *e}, nil
+	}
+
+	if len(e.Data) > 0 {
+		if err := json.Unmarshal(e.Data, data); err != nil {
+			return nil, err
+		}
+	}
+	return event, nil
+}
+
+// EventFunc はイベント Webhook のリクエストを処理する関数です。
+// エラーを返した場合は Sora に 500 を返します。
+type EventFunc func(ctx context.Context, event *Event) error
+
+// NewEventHandler はイベント Webhook の http.Handler を返します。
+// イベントを型ごとに振り分けたり、再試行したりする場合は Receiver を使ってください。
+func NewEventHandler(f EventFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := &Event{}
+		if !readJSON(w, r, event) {
+			return
+		}
+
+		if err := f(r.Context(), event); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, struct{}{})
+	})
+}
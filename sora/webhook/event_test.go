@@ -0,0 +1,34 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/hakobera/go-sora/sora"
+)
+
+func TestEventHandler(t *testing.T) {
+	var got *Event
+	h := NewEventHandler(func(ctx context.Context, event *Event) error {
+		got = event
+		if event.Type == "unknown" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	rec := postJSON(t, h, `{"id":"E1","type":"connection.created","channel_id":"sora","connection_id":"C1","role":"sendonly","data":{"audio":true},"event_metadata":{"room":"A"}}`)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200, but got %d", rec.Code)
+	}
+	if got == nil || got.ConnectionID != "C1" || got.Role != sora.SendOnlyRole || string(got.Data) != `{"audio":true}` || string(got.EventMetadata) != `{"room":"A"}` {
+		t.Errorf("unexpected event: %+v", got)
+	}
+
+	rec = postJSON(t, h, `{"id":"E2","type":"unknown"}`)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, but got %d", rec.Code)
+	}
+}
@@ -0,0 +1,230 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// デフォルトで処理済みとして覚えておくイベント ID の数
+const defaultSeenEventsSize = 10000
+
+// Handler は Receiver が受け取ったイベントを処理します。
+// エラーを返した場合、Receiver は ReceiverOptions.MaxRetries 回まで再実行します。
+type Handler interface {
+	HandleEvent(ctx context.Context, event TypedEvent) error
+}
+
+// HandlerFunc は関数を Handler として使うための型です。
+type HandlerFunc func(ctx context.Context, event TypedEvent) error
+
+// HandleEvent は f(ctx, event) を呼び出します。
+func (f HandlerFunc) HandleEvent(ctx context.Context, event TypedEvent) error {
+	return f(ctx, event)
+}
+
+// ReceiverOptions は Receiver の設定です。
+type ReceiverOptions struct {
+	// MaxRetries はハンドラーがエラーを返した時に再実行する回数
+	MaxRetries int
+
+	// RetryInterval は再実行までの待ち時間
+	RetryInterval time.Duration
+
+	// SeenEventsSize は処理済みとして覚えておくイベント ID の数。0 の場合は 10000
+	SeenEventsSize int
+
+	// OnError はハンドラーが再実行してもエラーを返した時に呼ばれます。
+	OnError func(event TypedEvent, err error)
+}
+
+type route struct {
+	eventType string
+	handler   Handler
+}
+
+// delivery は 1 つのイベント ID について、処理が完了したハンドラーを記録します。
+type delivery struct {
+	done    map[int]bool
+	running chan struct{}
+}
+
+// Receiver はイベント Webhook を受け付け、type ごとに登録されたハンドラーに振り分ける http.Handler です。
+// 同じイベント ID のリクエストを再び受け取った場合、前回エラーになったハンドラーだけを実行します。
+// ハンドラーの登録は ServeHTTP を呼び出す前に済ませてください。
+type Receiver struct {
+	options ReceiverOptions
+	routes  []route
+
+	mu         sync.Mutex
+	deliveries map[string]*delivery
+	seen       []string
+}
+
+// NewReceiver は Receiver を作成します。options が nil の場合はデフォルトの設定を使います。
+func NewReceiver(options *ReceiverOptions) *Receiver {
+	r := &Receiver{
+		deliveries: map[string]*delivery{},
+	}
+	if options != nil {
+		r.options = *options
+	}
+	if r.options.SeenEventsSize <= 0 {
+		r.options.SeenEventsSize = defaultSeenEventsSize
+	}
+	if r.options.OnError == nil {
+		r.options.OnError = func(event TypedEvent, err error) {}
+	}
+	return r
+}
+
+// Handle は eventType のイベントを処理するハンドラーを登録します。
+// eventType が "connection.*" のように "*" で終わる場合は前方一致で判定します。
+func (r *Receiver) Handle(eventType string, h Handler) {
+	r.routes = append(r.routes, route{eventType: eventType, handler: h})
+}
+
+// HandleFunc は eventType のイベントを処理する関数を登録します。
+func (r *Receiver) HandleFunc(eventType string, f func(ctx context.Context, event TypedEvent) error) {
+	r.Handle(eventType, HandlerFunc(f))
+}
+
+// HandleAll はすべてのイベントを処理するハンドラーを登録します。
+func (r *Receiver) HandleAll(h Handler) {
+	r.Handle("*", h)
+}
+
+func (rt route) match(eventType string) bool {
+	if strings.HasSuffix(rt.eventType, "*") {
+		return strings.HasPrefix(eventType, strings.TrimSuffix(rt.eventType, "*"))
+	}
+	return rt.eventType == eventType
+}
+
+// ServeHTTP はイベント Webhook のリクエストを処理します。
+// いずれかのハンドラーが最後までエラーを返した場合は Sora に 500 を返します。
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	base := &Event{}
+	if !readJSON(w, req, base) {
+		return
+	}
+	event, err := base.typed()
+	if err != nil {
+		http.Error(w, "invalid event data", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.Dispatch(req.Context(), event); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, struct{}{})
+}
+
+// Dispatch はイベントを登録されたハンドラーに渡します。
+// 処理済みのイベント ID の場合は、完了していないハンドラーだけを実行します。
+func (r *Receiver) Dispatch(ctx context.Context, event TypedEvent) error {
+	id := event.Base().ID
+
+	d, err := r.acquire(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer r.release(id, d)
+
+	var failed int
+	var lastErr error
+	for i, rt := range r.routes {
+		if !rt.match(event.Base().Type) || d.done[i] {
+			continue
+		}
+		if err := r.handle(ctx, rt.handler, event); err != nil {
+			r.options.OnError(event, err)
+			failed++
+			lastErr = err
+			continue
+		}
+		d.done[i] = true
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d handler(s) failed: %v", failed, lastErr)
+	}
+	return nil
+}
+
+// handle はハンドラーを実行し、エラーの場合は MaxRetries 回まで再実行します。
+func (r *Receiver) handle(ctx context.Context, h Handler, event TypedEvent) error {
+	var err error
+	for attempt := 0; attempt <= r.options.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(r.options.RetryInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err = h.HandleEvent(ctx, event); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// acquire はイベント ID の処理状況を返します。同じイベント ID を処理中の場合は終わるまで待ちます。
+func (r *Receiver) acquire(ctx context.Context, id string) (*delivery, error) {
+	if id == "" {
+		// ID がなければ重複を判定できないので、毎回すべてのハンドラーを実行する
+		return &delivery{done: map[int]bool{}}, nil
+	}
+
+	for {
+		r.mu.Lock()
+		d, ok := r.deliveries[id]
+		if !ok {
+			d = &delivery{done: map[int]bool{}}
+			r.deliveries[id] = d
+			r.seen = append(r.seen, id)
+			r.evict()
+		}
+		if d.running == nil {
+			d.running = make(chan struct{})
+			r.mu.Unlock()
+			return d, nil
+		}
+		running := d.running
+		r.mu.Unlock()
+
+		select {
+		case <-running:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (r *Receiver) release(id string, d *delivery) {
+	if id == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	close(d.running)
+	d.running = nil
+}
+
+// evict は覚えておくイベント ID が SeenEventsSize を超えた分を古い順に忘れます。処理中のものは残します。
+func (r *Receiver) evict() {
+	for len(r.seen) > r.options.SeenEventsSize {
+		id := r.seen[0]
+		if d, ok := r.deliveries[id]; ok && d.running != nil {
+			break
+		}
+		r.seen = r.seen[1:]
+		delete(r.deliveries, id)
+	}
+}
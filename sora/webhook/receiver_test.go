@@ -0,0 +1,219 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseEvent(t *testing.T) {
+	cases := []struct {
+		body  string
+		check func(TypedEvent) bool
+	}{
+		{
+			`{"id":"E1","type":"connection.created","connection_id":"C1","data":{"audio":true,"video":{"codec_type":"VP9"},"minutes":0,"channel_connections":2}}`,
+			func(e TypedEvent) bool {
+				ev, ok := e.(*ConnectionCreatedEvent)
+				return ok && ev.ConnectionID == "C1" && ev.Data.Audio && ev.Data.Video.CodecType == "VP9" && ev.Data.ChannelConnections == 2
+			},
+		},
+		{
+			`{"id":"E2","type":"connection.destroyed","data":{"minutes":3,"total_sent_bytes":1024}}`,
+			func(e TypedEvent) bool {
+				ev, ok := e.(*ConnectionDestroyedEvent)
+				return ok && ev.Data.Minutes == 3 && ev.Data.TotalSentBytes == 1024
+			},
+		},
+		{
+			`{"id":"E3","type":"recording.report","data":{"recording_id":"R1","filename":"R1.webm"}}`,
+			func(e TypedEvent) bool {
+				ev, ok := e.(*RecordingReportEvent)
+				return ok && ev.Data.RecordingID == "R1" && ev.Data.Filename == "R1.webm"
+			},
+		},
+		{
+			`{"id":"E4","type":"archive.available","data":{"recording_id":"R1","file_path":"/tmp/a.webm","size":100,"duration":1.5}}`,
+			func(e TypedEvent) bool {
+				ev, ok := e.(*ArchiveAvailableEvent)
+				return ok && ev.Data.FilePath == "/tmp/a.webm" && ev.Data.Size == 100 && ev.Data.Duration == 1.5
+			},
+		},
+		{
+			`{"id":"E5","type":"split-archive.end","data":{"recording_id":"R1"}}`,
+			func(e TypedEvent) bool {
+				_, ok := e.(*ArchiveEndEvent)
+				return ok
+			},
+		},
+		{
+			`{"id":"E6","type":"new.event","data":{"x":1}}`,
+			func(e TypedEvent) bool {
+				ev, ok := e.(*UnknownEvent)
+				return ok && ev.Type == "new.event" && string(ev.Data) == `{"x":1}`
+			},
+		},
+	}
+
+	for _, c := range cases {
+		e, err := ParseEvent([]byte(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.check(e) {
+			t.Errorf("unexpected event %T %+v for %s", e, e, c.body)
+		}
+		if string(e.Base().Raw) != c.body {
+			t.Errorf("expected raw %s, but got %s", c.body, e.Base().Raw)
+		}
+	}
+}
+
+func TestReceiverRetryAndIdempotency(t *testing.T) {
+	r := NewReceiver(&ReceiverOptions{MaxRetries: 1})
+
+	var created, all, flaky int
+	r.HandleFunc("connection.created", func(ctx context.Context, e TypedEvent) error {
+		created++
+		return nil
+	})
+	r.HandleAll(HandlerFunc(func(ctx context.Context, e TypedEvent) error {
+		all++
+		return nil
+	}))
+	r.HandleFunc("connection.*", func(ctx context.Context, e TypedEvent) error {
+		flaky++
+		// 1 回目のリクエストでは再試行を含めて失敗し、2 回目のリクエストで成功する
+		if flaky <= 2 {
+			return errors.New("temporary error")
+		}
+		return nil
+	})
+
+	body := `{"id":"E1","type":"connection.created","data":{}}`
+	if rec := postJSON(t, r, body); rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, but got %d", rec.Code)
+	}
+	if created != 1 || all != 1 || flaky != 2 {
+		t.Errorf("unexpected calls: created=%d, all=%d, flaky=%d", created, all, flaky)
+	}
+
+	// 再送されたイベントでは、失敗したハンドラーだけが実行される
+	if rec := postJSON(t, r, body); rec.Code != http.StatusOK {
+		t.Errorf("expected 200, but got %d", rec.Code)
+	}
+	if created != 1 || all != 1 || flaky != 3 {
+		t.Errorf("unexpected calls: created=%d, all=%d, flaky=%d", created, all, flaky)
+	}
+
+	// 処理済みのイベントは何も実行しない
+	if rec := postJSON(t, r, body); rec.Code != http.StatusOK {
+		t.Errorf("expected 200, but got %d", rec.Code)
+	}
+	if created != 1 || all != 1 || flaky != 3 {
+		t.Errorf("unexpected calls: created=%d, all=%d, flaky=%d", created, all, flaky)
+	}
+
+	// 別の type のイベントは前方一致しないハンドラーに渡らない
+	if rec := postJSON(t, r, `{"id":"E2","type":"recording.report","data":{}}`); rec.Code != http.StatusOK {
+		t.Errorf("expected 200, but got %d", rec.Code)
+	}
+	if created != 1 || all != 2 || flaky != 3 {
+		t.Errorf("unexpected calls: created=%d, all=%d, flaky=%d", created, all, flaky)
+	}
+}
+
+func TestReceiverForgetsOldEvents(t *testing.T) {
+	r := NewReceiver(&ReceiverOptions{SeenEventsSize: 1})
+	var calls int
+	r.HandleAll(HandlerFunc(func(ctx context.Context, e TypedEvent) error {
+		calls++
+		return nil
+	}))
+
+	for _, body := range []string{
+		`{"id":"E1","type":"connection.created"}`,
+		`{"id":"E2","type":"connection.created"}`,
+		`{"id":"E1","type":"connection.created"}`,
+	} {
+		postJSON(t, r, body)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, but got %d", calls)
+	}
+}
+
+func TestSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.jsonl")
+	file, err := OpenJSONLinesFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	ch := NewChannelSink(2)
+
+	r := NewReceiver(nil)
+	r.HandleAll(file)
+	r.HandleAll(NewJSONLinesSink(buf))
+	r.HandleAll(ch)
+
+	bodies := []string{
+		"{\n  \"id\": \"E1\",\n  \"type\": \"connection.created\"\n}",
+		`{"id":"E2","type":"archive.available","data":{"recording_id":"R1"}}`,
+	}
+	for _, body := range bodies {
+		if rec := postJSON(t, r, body); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, but got %d", rec.Code)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"id":"E1","type":"connection.created"}` + "\n" + bodies[1] + "\n"
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != expected {
+		t.Errorf("expected file %q, but got %q", expected, b)
+	}
+	if buf.String() != expected {
+		t.Errorf("expected buffer %q, but got %q", expected, buf.String())
+	}
+
+	for _, id := range []string{"E1", "E2"} {
+		e := <-ch.Events()
+		if e.Base().ID != id {
+			t.Errorf("expected %s, but got %s", id, e.Base().ID)
+		}
+	}
+
+	// channel が詰まっている場合は context が終わるとエラーになる
+	full := NewChannelSink(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := full.HandleEvent(ctx, &UnknownEvent{}); err != context.Canceled {
+		t.Errorf("expected context.Canceled, but got %v", err)
+	}
+}
+
+func TestReceiverBadEventData(t *testing.T) {
+	r := NewReceiver(nil)
+	rec := postJSON(t, r, `{"id":"E1","type":"connection.created","data":{"minutes":"x"}}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid event data") {
+		t.Errorf("unexpected response: %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,42 @@
+package webhook
+
+import (
+	"context"
+	"net/http"
+)
+
+// SessionEvent は Sora がセッション Webhook に送るリクエスト
+// https://sora-doc.shiguredo.jp/session_webhook
+type SessionEvent struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Timestamp string `json:"timestamp"`
+	ChannelID string `json:"channel_id"`
+	SessionID string `json:"session_id"`
+
+	CreatedTime   int64 `json:"created_time,omitempty"`
+	DestroyedTime int64 `json:"destroyed_time,omitempty"`
+
+	MaxConnections   int `json:"max_connections,omitempty"`
+	TotalConnections int `json:"total_connections,omitempty"`
+}
+
+// SessionFunc はセッション Webhook のリクエストを処理する関数です。
+// エラーを返した場合は Sora に 500 を返します。
+type SessionFunc func(ctx context.Context, event *SessionEvent) error
+
+// NewSessionHandler はセッション Webhook の http.Handler を返します。
+func NewSessionHandler(f SessionFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := &SessionEvent{}
+		if !readJSON(w, r, event) {
+			return
+		}
+
+		if err := f(r.Context(), event); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, struct{}{})
+	})
+}
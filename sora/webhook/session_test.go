@@ -0,0 +1,23 @@
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestSessionHandler(t *testing.T) {
+	var got *SessionEvent
+	h := NewSessionHandler(func(ctx context.Context, event *SessionEvent) error {
+		got = event
+		return nil
+	})
+
+	rec := postJSON(t, h, `{"id":"E1","type":"session.created","channel_id":"sora","session_id":"S1","created_time":1600000000}`)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{}` {
+		t.Errorf("unexpected response: %d %s", rec.Code, rec.Body.String())
+	}
+	if got == nil || got.Type != "session.created" || got.SessionID != "S1" || got.CreatedTime != 1600000000 {
+		t.Errorf("unexpected event: %+v", got)
+	}
+}
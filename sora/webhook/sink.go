@@ -0,0 +1,91 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// JSONLinesSink はイベントを 1 行 1 イベントの JSON で書き出す Handler です。
+// Sora から受け取ったリクエストボディをそのまま書き出すので、Go のコードを介さずに集計や分析に使えます。
+type JSONLinesSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONLinesSink は w に書き出す JSONLinesSink を作成します。
+func NewJSONLinesSink(w io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{w: w}
+}
+
+// OpenJSONLinesFile は path のファイルに追記する JSONLinesSink を作成します。ファイルがなければ作成します。
+func OpenJSONLinesFile(path string) (*JSONLinesSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLinesSink(f), nil
+}
+
+// HandleEvent はイベントを 1 行書き出します。
+func (s *JSONLinesSink) HandleEvent(ctx context.Context, event TypedEvent) error {
+	line := event.Base().Raw
+	if len(line) == 0 {
+		b, err := json.Marshal(event.Base())
+		if err != nil {
+			return err
+		}
+		line = b
+	}
+	// 改行を含む JSON でも 1 行に収まるようにする
+	buf := &bytes.Buffer{}
+	if err := json.Compact(buf, line); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+// Close は書き出し先が io.Closer であれば閉じます。
+func (s *JSONLinesSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// ChannelSink はイベントを channel に送る Handler です。
+// channel に空きがない場合は、受信されるかリクエストの context が終わるまで待ちます。
+type ChannelSink struct {
+	ch chan TypedEvent
+}
+
+// NewChannelSink はバッファサイズが size の ChannelSink を作成します。
+func NewChannelSink(size int) *ChannelSink {
+	return &ChannelSink{ch: make(chan TypedEvent, size)}
+}
+
+// Events はイベントを受信する channel を返します。
+func (s *ChannelSink) Events() <-chan TypedEvent {
+	return s.ch
+}
+
+// HandleEvent はイベントを channel に送ります。
+func (s *ChannelSink) HandleEvent(ctx context.Context, event TypedEvent) error {
+	select {
+	case s.ch <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,7 +1,9 @@
 package sora
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/pion/webrtc/v2"
 )
@@ -10,20 +12,23 @@ import (
 // https://sora-doc.shiguredo.jp/signaling_type
 
 type connectMessage struct {
-	Type                    string                 `json:"type"`
-	Role                    Role                   `json:"role"`
-	ChannelID               string                 `json:"channel_id"`
-	ClientID                string                 `json:"client_id,omitempty"`
-	Metadata                *Metadata              `json:"metadata,omitempty"`
-	SignalingNotifyMetadata map[string]interface{} `json:"signaling_notify_metadata,omitempty"`
-	Multistream             bool                   `json:"multistream,omitempty"`
-	Spotlight               uint8                  `json:"spotlight,omitempty"`
-	Simulcast               *Simulcast             `json:"simulcast,omitempty"`
-	Audio                   bool                   `json:"audio"`
-	Video                   *Video                 `json:"video"`
-	Sdp                     string                 `json:"sdp,omitempty"`
-	SoraClient              string                 `json:"sora_client"`
-	Environment             string                 `json:"environment"`
+	Type                    string      `json:"type"`
+	Role                    Role        `json:"role"`
+	ChannelID               string      `json:"channel_id"`
+	ClientID                string      `json:"client_id,omitempty"`
+	Metadata                interface{} `json:"metadata,omitempty"`
+	SignalingNotifyMetadata interface{} `json:"signaling_notify_metadata,omitempty"`
+	Multistream             bool        `json:"multistream,omitempty"`
+	Spotlight               uint8       `json:"spotlight,omitempty"`
+	Simulcast               *Simulcast  `json:"simulcast,omitempty"`
+	Audio                   bool        `json:"audio"`
+	Video                   interface{} `json:"video"`
+	Sdp                     string      `json:"sdp,omitempty"`
+	SoraClient              string      `json:"sora_client"`
+	Environment             string      `json:"environment"`
+	E2EE                    bool        `json:"e2ee,omitempty"`
+
+	ForwardingFilter *ForwardingFilter `json:"forwarding_filter,omitempty"`
 }
 
 // Role はクライアント役割を指定します
@@ -86,9 +91,33 @@ type Video struct {
 
 	// ビデオのビットレート指定。指定できる値は 1 から 50000 です
 	BitRate uint16 `json:"bitrate,omitempty"`
+
+	// CodecType に合わせたコーデックごとの設定。設定すると、offer の中から fmtp が一致するペイロードタイプを選びます
+	VP9Params  *VP9Params  `json:"vp9_params,omitempty"`
+	AV1Params  *AV1Params  `json:"av1_params,omitempty"`
+	H264Params *H264Params `json:"h264_params,omitempty"`
+}
+
+// VP9Params は VP9 の設定です
+type VP9Params struct {
+	// ProfileID は VP9 のプロファイル。指定できる値は 0 から 3 です
+	ProfileID int `json:"profile_id"`
+}
+
+// AV1Params は AV1 の設定です
+type AV1Params struct {
+	// Profile は AV1 のプロファイル。指定できる値は 0 から 2 です
+	Profile int `json:"profile"`
+}
+
+// H264Params は H.264 の設定です
+type H264Params struct {
+	// ProfileLevelID は 42e01f のような 16 進数 6 桁の profile-level-id です
+	ProfileLevelID string `json:"profile_level_id"`
 }
 
 // Metadata は認証 Webhook に渡される認証用のメタデータ
+// ConnectionOptions.Metadata に指定できる値の 1 つです。
 type Metadata struct {
 	SignalingKey string `json:"signaling_key"`
 	TurnTCPOnly  bool   `json:"turn_tcp_only"`
@@ -101,12 +130,21 @@ type signalingConfig struct {
 }
 
 type offerMessage struct {
-	Type         string          `json:"type"`
-	Version      string          `json:"version"`
-	ClientID     string          `json:"client_id"`
-	Config       signalingConfig `json:"config"`
-	ConnectionID string          `json:"connection_id"`
-	Sdp          string          `json:"sdp"`
+	Type         string            `json:"type"`
+	Version      string            `json:"version"`
+	SessionID    string            `json:"session_id"`
+	ClientID     string            `json:"client_id"`
+	Config       signalingConfig   `json:"config"`
+	ConnectionID string            `json:"connection_id"`
+	Sdp          string            `json:"sdp"`
+	Mid          map[string]string `json:"mid,omitempty"`
+	Simulcast    bool              `json:"simulcast,omitempty"`
+	Encodings    []Encoding        `json:"encodings,omitempty"`
+
+	// Metadata は認証 Webhook が返した metadata
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+	// AuthzMetadata は認証 Webhook が返した authz_metadata
+	AuthzMetadata json.RawMessage `json:"authz_metadata,omitempty"`
 }
 
 type answerMessage struct {
@@ -118,6 +156,11 @@ type signalingMessage struct {
 	Type string `json:"type"`
 }
 
+type disconnectMessage struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason,omitempty"`
+}
+
 type pingMessage struct {
 	Type  string `json:"type"`
 	Stats bool   `json:"stats"`
@@ -151,25 +194,47 @@ type SignalingNotifyMessage struct {
 	ChannelConnections           int                      `json:"channel_connections"`
 	ChannelUpstreamConnections   int                      `json:"channel_upstream_connections"`
 	ChannelDownstreamConnections int                      `json:"channel_downstream_connections"`
+	ChannelSendrecvConnections   int                      `json:"channel_sendrecv_connections"`
+	ChannelSendonlyConnections   int                      `json:"channel_sendonly_connections"`
+	ChannelRecvonlyConnections   int                      `json:"channel_recvonly_connections"`
+	SessionID                    string                   `json:"session_id"`
 	ClientID                     string                   `json:"client_id"`
 	ConnectionID                 string                   `json:"connection_id"`
 	Audio                        bool                     `json:"audio"`
 	Video                        bool                     `json:"video"`
-	Metadata                     map[string]interface{}   `json:"metadata"`
+	Metadata                     map[string]interface{}   `json:"-"`
+	RawMetadata                  json.RawMessage          `json:"metadata"`
 	MetadataList                 []map[string]interface{} `json:"metadata_list"`
+	AuthnMetadata                interface{}              `json:"authn_metadata"`
+	AuthzMetadata                interface{}              `json:"authz_metadata"`
+	TurnTransportType            string                   `json:"turn_transport_type"`
+}
+
+// decodeMetadata は metadata が object の場合に Metadata にデコードします。
+// object 以外の metadata は RawMetadata だけで受け取れます。
+func (m *SignalingNotifyMessage) decodeMetadata() {
+	m.Metadata = nil
+	if len(m.RawMetadata) == 0 {
+		return
+	}
+	metadata := map[string]interface{}{}
+	if err := json.Unmarshal(m.RawMetadata, &metadata); err == nil {
+		m.Metadata = metadata
+	}
 }
 
 // SpotlightNotifyMessage はスポットライト機能を利用した場合のシグナリング通知メッセージ
 // https://sora-doc.shiguredo.jp/signaling_notify#id9
 type SpotlightNotifyMessage struct {
-	Type        string `json:"type"`
-	EventType   string `json:"event_type"`
-	ChannelID   string `json:"channel_id"`
-	ClientID    string `json:"client_id"`
-	SpotlightID string `json:"spotlight_id"`
-	Audio       bool   `json:"audio"`
-	Video       bool   `json:"video"`
-	Fixed       bool   `json:"fixed"`
+	Type         string `json:"type"`
+	EventType    string `json:"event_type"`
+	ChannelID    string `json:"channel_id"`
+	ClientID     string `json:"client_id"`
+	ConnectionID string `json:"connection_id"`
+	SpotlightID  string `json:"spotlight_id"`
+	Audio        bool   `json:"audio"`
+	Video        bool   `json:"video"`
+	Fixed        bool   `json:"fixed"`
 }
 
 // NetworkNotifyMessage はネットワークのシグナリング通知メッセージ
@@ -179,3 +244,25 @@ type NetworkNotifyMessage struct {
 	EventType     string `json:"event_type"`
 	UnstableLevel int    `json:"unstable_level"`
 }
+
+// RecordingNotifyMessage は録画の開始、終了のシグナリング通知メッセージ
+type RecordingNotifyMessage struct {
+	Type        string `json:"type"`
+	EventType   string `json:"event_type"`
+	ChannelID   string `json:"channel_id"`
+	RecordingID string `json:"recording_id"`
+}
+
+// MuteNotifyMessage は音声、映像のミュート状態が変わった時のシグナリング通知メッセージ
+type MuteNotifyMessage struct {
+	Type         string `json:"type"`
+	EventType    string `json:"event_type"`
+	ChannelID    string `json:"channel_id"`
+	ClientID     string `json:"client_id"`
+	ConnectionID string `json:"connection_id"`
+}
+
+// Muted はミュートされた場合に true を返します。
+func (m *MuteNotifyMessage) Muted() bool {
+	return strings.HasSuffix(m.EventType, ".muted")
+}